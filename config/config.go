@@ -1,38 +1,72 @@
 package config
 
 import (
-	"log"
 	"sync"
 
 	"github.com/kelseyhightower/envconfig"
+	"github.com/salestock/sersan/logger"
 )
 
 type Config struct {
-	Port                     string `envconfig:"port" default:"4444"`
-	GridConfigFile           string `envconfig:"grid_config_file" default:"config/grids.yaml"`
-	StartupTimeout           int32  `envconfig:"startup_timeout" default:"900000"`
-	NewSessionAttemptTimeout int32  `envconfig:"new_session_attempt_timeout" default:"60000"`
-	GridStartupTimeout       int32  `envconfig:"grid_startup_timeout" default:"60000"`
-	RetryCount               int32  `envconfig:"retry_count" default:"30"`
-	SigningKey               string `envconfig:"signing_key" default:"secret_key"`
-	GridLabel                string `envconfig:"grid_label" default:"dev"`
-	NodeSelectorKey          string `envconfig:"node_selector_key"`
-	NodeSelectorValue        string `envconfig:"node_selector_value"`
-	CPURequest               string `envconfig:"cpu_request" default:"400m"`
-	MemoryRequest            string `envconfig:"memory_request" default:"600Mi"`
-	CPULimit                 string `envconfig:"cpu_limit" default:"600m"`
-	MemoryLimit              string `envconfig:"memory_limit" default:"1000Mi"`
-	GridTimeout              int    `envconfig:"sersan_grid_timeout" default:"300"`
-	CacheTimeout             int    `envconfig:"cache_timeout" default:"10"`
-	MaxIdleConns             int    `envconfig:"max_idle_conns" default:"100"`
-	MaxIdleConnsPerHost      int    `envconfig:"max_idle_conns_per_host" default:"100"`
-	MaxConnsPerHost          int    `envconfig:"max_conns_per_host" default:"100"`
-	ProjectID                string `envconfig:"project_id" default:""`
-	Zone                     string `envconfig:"zone" default:""`
-	Subnetwork               string `envconfig:"subnetwork" default:""`
-	MachineType              string `envconfig:"machine_type" default:"custom-2-4096"`
-	ExternalIP               bool   `envconfig:"external_ip" default:"false"`
-	BucketName               string `envconfig:"bucket_name" default:"sersan-api"`
+	Port                     string   `envconfig:"port" default:"4444"`
+	GridConfigFile           string   `envconfig:"grid_config_file" default:"config/grids.yaml"`
+	StartupTimeout           int32    `envconfig:"startup_timeout" default:"900000"`
+	NewSessionAttemptTimeout int32    `envconfig:"new_session_attempt_timeout" default:"60000"`
+	GridStartupTimeout       int32    `envconfig:"grid_startup_timeout" default:"60000"`
+	RetryCount               int32    `envconfig:"retry_count" default:"30"`
+	NewSessionBackoff        int32    `envconfig:"new_session_backoff" default:"500"`
+	NewSessionMaxBackoff     int32    `envconfig:"new_session_max_backoff" default:"10000"`
+	CommandTimeout           int32    `envconfig:"command_timeout" default:"300000"`
+	SigningKey               string   `envconfig:"signing_key" default:"secret_key"`
+	GridLabel                string   `envconfig:"grid_label" default:"dev"`
+	NodeSelectorKey          string   `envconfig:"node_selector_key"`
+	NodeSelectorValue        string   `envconfig:"node_selector_value"`
+	CPURequest               string   `envconfig:"cpu_request" default:"400m"`
+	MemoryRequest            string   `envconfig:"memory_request" default:"600Mi"`
+	CPULimit                 string   `envconfig:"cpu_limit" default:"600m"`
+	MemoryLimit              string   `envconfig:"memory_limit" default:"1000Mi"`
+	GridTimeout              int      `envconfig:"sersan_grid_timeout" default:"300"`
+	CacheTimeout             int      `envconfig:"cache_timeout" default:"10"`
+	MaxIdleConns             int      `envconfig:"max_idle_conns" default:"100"`
+	MaxIdleConnsPerHost      int      `envconfig:"max_idle_conns_per_host" default:"100"`
+	MaxConnsPerHost          int      `envconfig:"max_conns_per_host" default:"100"`
+	ProjectID                string   `envconfig:"project_id" default:""`
+	Zone                     string   `envconfig:"zone" default:""`
+	Subnetwork               string   `envconfig:"subnetwork" default:""`
+	MachineType              string   `envconfig:"machine_type" default:"custom-2-4096"`
+	ExternalIP               bool     `envconfig:"external_ip" default:"false"`
+	BucketName               string   `envconfig:"bucket_name" default:"sersan-api"`
+	DrainDelay               int32    `envconfig:"drain_delay" default:"15000"`
+	DrainTimeout             int32    `envconfig:"drain_timeout" default:"120000"`
+	KubernetesQPS            float32  `envconfig:"kubernetes_qps" default:"5"`
+	KubernetesBurst          int      `envconfig:"kubernetes_burst" default:"10"`
+	PodUnschedulableTimeout  int32    `envconfig:"pod_unschedulable_timeout" default:"60000"`
+	ComputeInsertRetries     int      `envconfig:"compute_insert_retries" default:"3"`
+	DockerHost               string   `envconfig:"docker_host" default:"unix:///var/run/docker.sock"`
+	DockerNetwork            string   `envconfig:"docker_network" default:""`
+	DockerPublishHost        string   `envconfig:"docker_publish_host" default:"127.0.0.1"`
+	CallbackURL              string   `envconfig:"callback_url" default:""`
+	AppCacheDir              string   `envconfig:"app_cache_dir" default:"/tmp/sersan-apps"`
+	AppRetention             int      `envconfig:"app_retention" default:"86400"`
+	AppMaxSize               int64    `envconfig:"app_max_size" default:"1073741824"`
+	AppCacheSize             int64    `envconfig:"app_cache_size" default:"10737418240"`
+	AppUploadToken           string   `envconfig:"app_upload_token" default:""`
+	LogLevel                 string   `envconfig:"log_level" default:"info"`
+	LogFormat                string   `envconfig:"log_format" default:"json"`
+	OTLPEndpoint             string   `envconfig:"otel_exporter_otlp_endpoint" default:""`
+	TraceServiceName         string   `envconfig:"otel_service_name" default:"sersan"`
+	TraceSampleRatio         float64  `envconfig:"trace_sample_ratio" default:"1"`
+	WebhookURLs              []string `envconfig:"webhook_urls"`
+	WebhookEvents            []string `envconfig:"webhook_events"`
+	WebhookSecret            string   `envconfig:"webhook_secret" default:""`
+	WebhookRetries           int      `envconfig:"webhook_retries" default:"5"`
+	WebhookTimeout           int32    `envconfig:"webhook_timeout" default:"10000"`
+	WebhookQueueSize         int      `envconfig:"webhook_queue_size" default:"1000"`
+	AdminToken               string   `envconfig:"admin_token" default:""`
+	HistoryDB                string   `envconfig:"history_db" default:"/tmp/sersan-history.db"`
+	HistoryRetention         int      `envconfig:"history_retention" default:"2592000"`
+	DashboardNoVNCURL        string   `envconfig:"dashboard_novnc_url" default:""`
+	PeerDNS                  string   `envconfig:"peer_dns" default:""`
 }
 
 var conf Config
@@ -43,7 +77,7 @@ func Get() Config {
 	once.Do(func() {
 		err := envconfig.Process("", &conf)
 		if err != nil {
-			log.Fatal("Can't load config: ", err)
+			logger.Fatalf("Can't load config: %v", err)
 		}
 	})
 
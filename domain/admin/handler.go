@@ -0,0 +1,460 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/domain/session"
+	"github.com/salestock/sersan/lib"
+	"github.com/salestock/sersan/logger"
+	"github.com/salestock/sersan/utils"
+)
+
+// ErrGridNotFound Grid version is not configured
+var ErrGridNotFound = errors.New("Grid version not found")
+
+// idleReapInterval Interval between the checks of idle sessions
+const idleReapInterval = 10 * time.Second
+
+// AdminHandler Admin handler. Sessions, pause and drained grids are kept by
+// each replica, requests are fanned out to every replica of the hub when the
+// replicas are known.
+type AdminHandler struct {
+	Config         *config.Config          `inject:""`
+	GridConfig     *lib.GridConfig         `inject:""`
+	SessionService *session.SessionService `inject:""`
+	StartTracker   *lib.StartTracker       `inject:""`
+	EventBus       *lib.EventBus           `inject:""`
+	Sessions       *lib.SessionRegistry    `inject:""`
+	Peers          *lib.Peers              `inject:""`
+}
+
+// Status Status of the replica, or of the hub when merged from every
+// replica: paused or draining when any replica is.
+type Status struct {
+	Paused   bool     `json:"paused"`
+	Draining bool     `json:"draining"`
+	Starting int      `json:"starting"`
+	Sessions int      `json:"sessions"`
+	Drained  []string `json:"drained"`
+	Replicas int      `json:"replicas"`
+}
+
+// GridStatus Configured grid version
+type GridStatus struct {
+	Grid     string `json:"grid"`
+	Engine   string `json:"engine"`
+	Drained  bool   `json:"drained"`
+	Sessions int    `json:"sessions"`
+}
+
+// AdminStatus Handler for the replica status on /admin/status
+func (h AdminHandler) AdminStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r, http.MethodGet) {
+		return
+	}
+	h.respondStatus(w, r)
+}
+
+// AdminPause Handler pausing new sessions on /admin/pause. New session
+// requests are refused with 503 until resumed, live sessions go on.
+func (h AdminHandler) AdminPause(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r, http.MethodPost) {
+		return
+	}
+	if !h.Peers.Fanned(r) {
+		h.StartTracker.Pause()
+		logger.Warnf("[ADMIN] New sessions paused")
+	}
+	h.respondStatus(w, r)
+}
+
+// AdminResume Handler resuming new sessions on /admin/resume
+func (h AdminHandler) AdminResume(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r, http.MethodPost) {
+		return
+	}
+	if !h.Peers.Fanned(r) {
+		h.StartTracker.Resume()
+		logger.Infof("[ADMIN] New sessions resumed")
+	}
+	h.respondStatus(w, r)
+}
+
+// AdminSessions Handler listing the live sessions on /admin/sessions
+func (h AdminHandler) AdminSessions(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r, http.MethodGet) {
+		return
+	}
+	if !h.Peers.Fanned(r) {
+		utils.ResponseOk(w, http.StatusOK, h.Sessions.List())
+		return
+	}
+	lists := [][]lib.LiveSession{}
+	if !h.fanout(w, r, func(response lib.PeerResponse) error {
+		var sessions []lib.LiveSession
+		if err := response.Decode(&sessions); err != nil {
+			return err
+		}
+		lists = append(lists, sessions)
+		return nil
+	}) {
+		return
+	}
+	utils.ResponseOk(w, http.StatusOK, lib.MergeSessions(lists...))
+}
+
+// AdminSession Handler for one live session on /admin/sessions/<id>, by
+// request ID or Sersan session ID. DELETE terminates the session: its grid is
+// deleted and its later commands fail with invalid session id on every
+// replica.
+func (h AdminHandler) AdminSession(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	if reason := r.URL.Query().Get("ended"); r.Method == http.MethodDelete && r.Header.Get(lib.PeerHeader) != "" && reason != "" {
+		// The replica owning the session ended it, only remember it
+		sessionID := strings.TrimPrefix(r.URL.Path, "/admin/sessions/")
+		h.Sessions.End(sessionID, reason)
+		utils.ResponseOk(w, http.StatusOK, sessionID)
+		return
+	}
+	if h.Peers.Fanned(r) {
+		owner, err := h.Peers.Owner(r.Context(), r.URL.EscapedPath())
+		if err != nil {
+			utils.ResponseFailed(w, http.StatusBadGateway, err)
+			return
+		}
+		if owner == "" {
+			utils.ResponseFailed(w, http.StatusNotFound, lib.ErrSessionNotFound)
+			return
+		}
+		h.Peers.Forward(w, r, owner)
+		return
+	}
+	live, err := h.Sessions.Find(strings.TrimPrefix(r.URL.Path, "/admin/sessions/"))
+	if err != nil {
+		utils.ResponseFailed(w, http.StatusNotFound, err)
+		return
+	}
+	if r.Method == http.MethodGet {
+		utils.ResponseOk(w, http.StatusOK, live)
+		return
+	}
+	if err := h.end(r.Context(), live, "terminated"); err != nil {
+		utils.ResponseFailed(w, http.StatusInternalServerError, err)
+		return
+	}
+	utils.ResponseOk(w, http.StatusOK, live)
+}
+
+// end End the session for reason: its grid is deleted, a reaped event is
+// published and its later commands fail with invalid session id on every
+// replica
+func (h AdminHandler) end(ctx context.Context, live lib.LiveSession, reason string) error {
+	log := logger.WithFields(logger.Fields{logger.RequestID: live.RequestID, logger.Instance: live.Instance, logger.User: live.User})
+	h.Sessions.End(live.SessionID, reason)
+	h.recordEnded(ctx, live.SessionID, reason, log)
+	if err := h.SessionService.Delete(live.Info.ServiceName, live.Info.Engine); err != nil {
+		log.Errorf("[ADMIN] Unable to delete grid of %s session: %v", reason, err)
+		return err
+	}
+	h.EventBus.Publish(lib.EndedEvent(lib.EventSessionReaped, live.SessionID, live.Info, reason))
+	log.Warnf("[ADMIN] Session %s", reason)
+	return nil
+}
+
+// recordEnded Tell every replica why the session ended, so that its later
+// commands fail with invalid session id whichever replica serves them.
+// Replicas failing to record it are only logged.
+func (h AdminHandler) recordEnded(ctx context.Context, sessionID string, reason string, log *logger.Entry) {
+	if h.Peers == nil || h.Peers.Resolve == nil {
+		return
+	}
+	uri := "/admin/sessions/" + url.PathEscape(sessionID) + "?ended=" + url.QueryEscape(reason)
+	responses, err := h.Peers.Fanout(ctx, http.MethodDelete, uri)
+	if err != nil {
+		log.Warnf("[ADMIN] Unable to tell replicas the session was %s: %v", reason, err)
+		return
+	}
+	for _, response := range responses {
+		var ended string
+		if err := response.Decode(&ended); err != nil {
+			log.Warnf("[ADMIN] Unable to tell replica the session was %s: %v", reason, err)
+		}
+	}
+}
+
+// ReapIdle End the sessions created by this replica once idle for longer
+// than their newCommandTimeout, until ctx is done. Appium ends such sessions
+// on its side, so their grids would otherwise be kept until their lifetime.
+func (h AdminHandler) ReapIdle(ctx context.Context) {
+	ticker := time.NewTicker(idleReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.reapIdle(ctx)
+		}
+	}
+}
+
+// reapIdle End the idle sessions created by this replica. Commands may be
+// served by any replica, so a session is only idle when idle on every one.
+func (h AdminHandler) reapIdle(ctx context.Context) {
+	idle := []lib.LiveSession{}
+	for _, live := range h.Sessions.List() {
+		// Only the replica which created the session knows its client
+		if live.Remote != "" && live.Info.IdleTimeout > 0 && live.Idle > float64(live.Info.IdleTimeout) {
+			idle = append(idle, live)
+		}
+	}
+	if len(idle) == 0 {
+		return
+	}
+	if h.Peers != nil && h.Peers.Resolve != nil {
+		responses, err := h.Peers.Fanout(ctx, http.MethodGet, "/admin/sessions")
+		if err != nil {
+			logger.Warnf("[ADMIN] Unable to check idle sessions: %v", err)
+			return
+		}
+		lists := [][]lib.LiveSession{}
+		for _, response := range responses {
+			var sessions []lib.LiveSession
+			if err := response.Decode(&sessions); err != nil {
+				logger.Warnf("[ADMIN] Unable to check idle sessions: %v", err)
+				return
+			}
+			lists = append(lists, sessions)
+		}
+		hubIdle := map[string]float64{}
+		for _, session := range lib.MergeSessions(lists...) {
+			hubIdle[session.SessionID] = session.Idle
+		}
+		stillIdle := idle[:0]
+		for _, live := range idle {
+			if seconds, ok := hubIdle[live.SessionID]; ok && seconds > float64(live.Info.IdleTimeout) {
+				stillIdle = append(stillIdle, live)
+			}
+		}
+		idle = stillIdle
+	}
+	for _, live := range idle {
+		h.end(ctx, live, "timed out")
+	}
+}
+
+// AdminGrids Handler listing the configured grid versions on /admin/grids
+func (h AdminHandler) AdminGrids(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r, http.MethodGet) {
+		return
+	}
+	h.respondGrids(w, r)
+}
+
+// respondGrids Respond with the grid versions of the replica, or of the hub
+// when fanned out: drained when drained on any replica, with the live sessions
+// of every replica.
+func (h AdminHandler) respondGrids(w http.ResponseWriter, r *http.Request) {
+	if !h.Peers.Fanned(r) {
+		utils.ResponseOk(w, http.StatusOK, h.grids())
+		return
+	}
+	merged := map[string]int{}
+	hub := []GridStatus{}
+	if !h.fanout(w, r, func(response lib.PeerResponse) error {
+		var grids []GridStatus
+		if err := response.Decode(&grids); err != nil {
+			return err
+		}
+		for _, grid := range grids {
+			if i, ok := merged[grid.Grid]; ok {
+				hub[i].Drained = hub[i].Drained || grid.Drained
+				hub[i].Sessions += grid.Sessions
+				continue
+			}
+			merged[grid.Grid] = len(hub)
+			hub = append(hub, grid)
+		}
+		return nil
+	}) {
+		return
+	}
+	sort.Slice(hub, func(i, j int) bool { return hub[i].Grid < hub[j].Grid })
+	utils.ResponseOk(w, http.StatusOK, hub)
+}
+
+func (h AdminHandler) grids() []GridStatus {
+	sessions := make(map[string]int)
+	for _, live := range h.Sessions.List() {
+		sessions[live.Grid]++
+	}
+	grids := []GridStatus{}
+	h.GridConfig.Each(func(name string, version string, grid *lib.Grid) {
+		if grid == nil {
+			return
+		}
+		key := name + "-" + version
+		grids = append(grids, GridStatus{Grid: key, Engine: lib.EngineName(grid.Engine), Sessions: sessions[key]})
+	})
+	for i := range grids {
+		grids[i].Drained = h.GridConfig.Drained(grids[i].Grid)
+	}
+	sort.Slice(grids, func(i, j int) bool { return grids[i].Grid < grids[j].Grid })
+	return grids
+}
+
+// AdminGrid Handler draining a grid version on /admin/grids/<grid>/drain
+// and undraining it on /admin/grids/<grid>/undrain. Drained grid versions
+// accept no new session, their live sessions go on.
+func (h AdminHandler) AdminGrid(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r, http.MethodPost) {
+		return
+	}
+	fragments := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/grids/"), "/")
+	if len(fragments) != 2 || (fragments[1] != "drain" && fragments[1] != "undrain") {
+		utils.ResponseFailed(w, http.StatusNotFound, ErrGridNotFound)
+		return
+	}
+	key, drained := fragments[0], fragments[1] == "drain"
+	if h.Peers.Fanned(r) {
+		if _, ok := h.GridConfig.Lookup(key); !ok {
+			utils.ResponseFailed(w, http.StatusNotFound, ErrGridNotFound)
+			return
+		}
+		h.respondGrids(w, r)
+		return
+	}
+	if !h.GridConfig.SetDrained(key, drained) {
+		utils.ResponseFailed(w, http.StatusNotFound, ErrGridNotFound)
+		return
+	}
+	if drained {
+		logger.Warnf("[ADMIN] Grid %s drained", key)
+	} else {
+		logger.Infof("[ADMIN] Grid %s undrained", key)
+	}
+	h.respondGrids(w, r)
+}
+
+// SyncPeers Pause new sessions and drain grid versions like the replicas
+// already running, so that replicas started after a pause or a drain follow
+// it. Replicas not serving yet, this one included, are skipped.
+func (h AdminHandler) SyncPeers(ctx context.Context) {
+	if h.Peers == nil || h.Peers.Resolve == nil {
+		return
+	}
+	responses, err := h.Peers.Fanout(ctx, http.MethodGet, "/admin/status")
+	if err != nil {
+		logger.Warnf("[ADMIN] Unable to sync pause and drained grids: %v", err)
+		return
+	}
+	for _, response := range responses {
+		var status Status
+		if err := response.Decode(&status); err != nil {
+			logger.Debugf("[ADMIN] Skipping replica on sync: %v", err)
+			continue
+		}
+		if status.Paused {
+			h.StartTracker.Pause()
+			logger.Warnf("[ADMIN] New sessions paused like replica %s", response.Addr)
+		}
+		for _, key := range status.Drained {
+			if h.GridConfig.SetDrained(key, true) {
+				logger.Warnf("[ADMIN] Grid %s drained like replica %s", key, response.Addr)
+			}
+		}
+		return
+	}
+}
+
+// respondStatus Respond with the status of the replica, or of the hub when
+// fanned out
+func (h AdminHandler) respondStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.Peers.Fanned(r) {
+		utils.ResponseOk(w, http.StatusOK, h.status())
+		return
+	}
+	hub := Status{Drained: []string{}}
+	drained := map[string]bool{}
+	if !h.fanout(w, r, func(response lib.PeerResponse) error {
+		var status Status
+		if err := response.Decode(&status); err != nil {
+			return err
+		}
+		hub.Paused = hub.Paused || status.Paused
+		hub.Draining = hub.Draining || status.Draining
+		hub.Starting += status.Starting
+		hub.Sessions += status.Sessions
+		hub.Replicas += status.Replicas
+		for _, key := range status.Drained {
+			if !drained[key] {
+				drained[key] = true
+				hub.Drained = append(hub.Drained, key)
+			}
+		}
+		return nil
+	}) {
+		return
+	}
+	sort.Strings(hub.Drained)
+	utils.ResponseOk(w, http.StatusOK, hub)
+}
+
+func (h AdminHandler) status() Status {
+	status := Status{
+		Paused:   h.StartTracker.Paused(),
+		Draining: h.StartTracker.Draining(),
+		Starting: h.StartTracker.Count(),
+		Sessions: len(h.Sessions.List()),
+		Drained:  []string{},
+		Replicas: 1,
+	}
+	h.GridConfig.Each(func(name string, version string, grid *lib.Grid) {
+		if grid != nil && h.GridConfig.Drained(name+"-"+version) {
+			status.Drained = append(status.Drained, name+"-"+version)
+		}
+	})
+	sort.Strings(status.Drained)
+	return status
+}
+
+// fanout Send r to every replica and merge their responses. It responds
+// with 502 and returns false when a replica fails.
+func (h AdminHandler) fanout(w http.ResponseWriter, r *http.Request, merge func(response lib.PeerResponse) error) bool {
+	responses, err := h.Peers.Fanout(r.Context(), r.Method, r.URL.RequestURI())
+	if err == nil {
+		for _, response := range responses {
+			if err = merge(response); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		utils.ResponseFailed(w, http.StatusBadGateway, err)
+		return false
+	}
+	return true
+}
+
+func (h AdminHandler) authorized(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if !utils.AdminAuthorized(r, h.Config.AdminToken) {
+		utils.ResponseFailed(w, http.StatusUnauthorized, utils.ErrUnauthorized)
+		return false
+	}
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	utils.JsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
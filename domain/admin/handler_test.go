@@ -0,0 +1,262 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/domain/session"
+	"github.com/salestock/sersan/lib"
+	"github.com/salestock/sersan/utils"
+)
+
+const testToken = "admin_token"
+
+// testReplica Admin handler of one replica of a test hub
+type testReplica struct {
+	*httptest.Server
+	Handler *AdminHandler
+}
+
+// newTestHub Replicas knowing each other as peers
+func newTestHub(count int) []*testReplica {
+	conf := config.Get()
+	conf.AdminToken = testToken
+	addrs := []string{}
+	peers := &lib.Peers{
+		Token:   testToken,
+		Resolve: func() ([]string, error) { return addrs, nil },
+	}
+	replicas := []*testReplica{}
+	for i := 0; i < count; i++ {
+		handler := &AdminHandler{
+			Config: &conf,
+			GridConfig: &lib.GridConfig{Grids: map[string]lib.Versions{
+				"fake": {Default: "1.0", Versions: map[string]*lib.Grid{"1.0": {Engine: lib.FakeType}}},
+			}},
+			SessionService: &session.SessionService{},
+			StartTracker:   &lib.StartTracker{},
+			EventBus:       &lib.EventBus{},
+			Sessions:       &lib.SessionRegistry{},
+			Peers:          peers,
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/admin/status", handler.AdminStatus)
+		mux.HandleFunc("/admin/pause", handler.AdminPause)
+		mux.HandleFunc("/admin/resume", handler.AdminResume)
+		mux.HandleFunc("/admin/sessions", handler.AdminSessions)
+		mux.HandleFunc("/admin/sessions/", handler.AdminSession)
+		mux.HandleFunc("/admin/grids", handler.AdminGrids)
+		mux.HandleFunc("/admin/grids/", handler.AdminGrid)
+		server := httptest.NewServer(mux)
+		addrs = append(addrs, strings.TrimPrefix(server.URL, "http://"))
+		replicas = append(replicas, &testReplica{Server: server, Handler: handler})
+	}
+	return replicas
+}
+
+func closeTestHub(replicas []*testReplica) {
+	for _, replica := range replicas {
+		replica.Close()
+	}
+}
+
+func (replica *testReplica) do(t *testing.T, method string, path string, data interface{}) int {
+	req, err := http.NewRequest(method, replica.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if data != nil {
+		envelope := struct {
+			Data interface{} `json:"data"`
+		}{data}
+		if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestPauseAppliesToEveryReplica(t *testing.T) {
+	replicas := newTestHub(3)
+	defer closeTestHub(replicas)
+
+	var status Status
+	if code := replicas[0].do(t, http.MethodPost, "/admin/pause", &status); code != http.StatusOK {
+		t.Fatalf("pause answered %d", code)
+	}
+	if !status.Paused || status.Replicas != 3 {
+		t.Errorf("Hub status %+v, want paused on 3 replicas", status)
+	}
+	for i, replica := range replicas {
+		if !replica.Handler.StartTracker.Paused() {
+			t.Errorf("Replica %d is not paused", i)
+		}
+	}
+
+	replicas[1].do(t, http.MethodPost, "/admin/resume", &status)
+	for i, replica := range replicas {
+		if replica.Handler.StartTracker.Paused() {
+			t.Errorf("Replica %d is still paused", i)
+		}
+	}
+}
+
+func TestDrainAppliesToEveryReplica(t *testing.T) {
+	replicas := newTestHub(2)
+	defer closeTestHub(replicas)
+
+	var grids []GridStatus
+	if code := replicas[1].do(t, http.MethodPost, "/admin/grids/fake-1.0/drain", &grids); code != http.StatusOK {
+		t.Fatalf("drain answered %d", code)
+	}
+	if len(grids) != 1 || !grids[0].Drained {
+		t.Errorf("Hub grids %+v, want fake-1.0 drained", grids)
+	}
+	for i, replica := range replicas {
+		if !replica.Handler.GridConfig.Drained("fake-1.0") {
+			t.Errorf("Replica %d did not drain the grid", i)
+		}
+	}
+	if code := replicas[0].do(t, http.MethodPost, "/admin/grids/fake-2.0/drain", nil); code != http.StatusNotFound {
+		t.Errorf("drain of unknown grid answered %d, want 404", code)
+	}
+}
+
+func TestSessionsOfEveryReplica(t *testing.T) {
+	replicas := newTestHub(2)
+	defer closeTestHub(replicas)
+	shared := &utils.SessionInfo{RequestID: "r1", Grid: "fake-1.0", Owner: "alice"}
+	replicas[0].Handler.Sessions.Add("s1", shared, "10.0.0.1", time.Minute)
+	replicas[0].Handler.Sessions.Touch("s1", shared, time.Minute)
+	replicas[1].Handler.Sessions.Touch("s1", shared, time.Minute)
+	replicas[1].Handler.Sessions.Add("s2", &utils.SessionInfo{RequestID: "r2", Grid: "fake-1.0"}, "10.0.0.2", time.Minute)
+
+	var sessions []lib.LiveSession
+	replicas[1].do(t, http.MethodGet, "/admin/sessions", &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("Got %d sessions, want 2", len(sessions))
+	}
+	for _, session := range sessions {
+		if session.SessionID == "s1" && (session.Commands != 2 || session.Remote != "10.0.0.1") {
+			t.Errorf("Merged session %+v, want 2 commands from 10.0.0.1", session)
+		}
+	}
+
+	var grids []GridStatus
+	replicas[0].do(t, http.MethodGet, "/admin/grids", &grids)
+	if len(grids) != 1 || grids[0].Sessions != 3 {
+		t.Errorf("Hub grids %+v, want 3 sessions listed by replicas", grids)
+	}
+
+	var session lib.LiveSession
+	if code := replicas[0].do(t, http.MethodGet, "/admin/sessions/r2", &session); code != http.StatusOK || session.SessionID != "s2" {
+		t.Errorf("Session r2 answered %d with %+v, want s2 from the other replica", code, session)
+	}
+	if code := replicas[0].do(t, http.MethodGet, "/admin/sessions/r3", nil); code != http.StatusNotFound {
+		t.Errorf("Unknown session answered %d, want 404", code)
+	}
+}
+
+func TestTerminateEndsSessionOnEveryReplica(t *testing.T) {
+	replicas := newTestHub(3)
+	defer closeTestHub(replicas)
+	name, err := lib.GetFakeClient().CreateGrid(context.Background(), &lib.GridBase{Grid: &lib.Grid{Engine: lib.FakeType}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicas[0].Handler.Sessions.Add("s1", &utils.SessionInfo{RequestID: "r1", ServiceName: name, Engine: lib.FakeType}, "10.0.0.1", time.Minute)
+
+	var live lib.LiveSession
+	if code := replicas[1].do(t, http.MethodDelete, "/admin/sessions/r1", &live); code != http.StatusOK || live.SessionID != "s1" {
+		t.Fatalf("Terminate answered %d with %+v, want s1 terminated", code, live)
+	}
+	if _, ok := lib.GetFakeClient().Grid(name); ok {
+		t.Errorf("Grid %s of the terminated session is still running", name)
+	}
+	// Any replica may serve the later commands of the session
+	for i, replica := range replicas {
+		if reason, ended := replica.Handler.Sessions.Ended("s1"); !ended || reason != "terminated" {
+			t.Errorf("Replica %d does not know the session was terminated", i)
+		}
+	}
+	if code := replicas[2].do(t, http.MethodDelete, "/admin/sessions/r1", nil); code != http.StatusNotFound {
+		t.Errorf("Terminate of an ended session answered %d, want 404", code)
+	}
+}
+
+func TestReapIdleSessions(t *testing.T) {
+	replicas := newTestHub(2)
+	defer closeTestHub(replicas)
+	newGrid := func() string {
+		name, err := lib.GetFakeClient().CreateGrid(context.Background(), &lib.GridBase{Grid: &lib.Grid{Engine: lib.FakeType}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	idleGrid, activeGrid := newGrid(), newGrid()
+	defer lib.GetFakeClient().DeleteGrid(activeGrid)
+	created := time.Now().Add(-time.Minute).Unix()
+	sessions := map[string]*utils.SessionInfo{
+		"idle":    {RequestID: "r1", ServiceName: idleGrid, Engine: lib.FakeType, Created: created, IdleTimeout: 30},
+		"active":  {RequestID: "r2", ServiceName: activeGrid, Engine: lib.FakeType, Created: created, IdleTimeout: 30},
+		"default": {RequestID: "r3", Engine: lib.FakeType, Created: created},
+	}
+	for sessionID, info := range sessions {
+		replicas[0].Handler.Sessions.Add(sessionID, info, "10.0.0.1", time.Hour)
+	}
+	// The client sends its commands through the other replica
+	replicas[1].Handler.Sessions.Touch("active", sessions["active"], time.Hour)
+
+	replicas[0].Handler.reapIdle(context.Background())
+	for i, replica := range replicas {
+		if reason, ended := replica.Handler.Sessions.Ended("idle"); !ended || reason != "timed out" {
+			t.Errorf("Replica %d does not know the idle session timed out", i)
+		}
+		for _, sessionID := range []string{"active", "default"} {
+			if _, ended := replica.Handler.Sessions.Ended(sessionID); ended {
+				t.Errorf("Replica %d ended the %s session", i, sessionID)
+			}
+		}
+	}
+	if _, ok := lib.GetFakeClient().Grid(idleGrid); ok {
+		t.Errorf("Grid %s of the idle session is still running", idleGrid)
+	}
+	if _, ok := lib.GetFakeClient().Grid(activeGrid); !ok {
+		t.Errorf("Grid %s of the active session was deleted", activeGrid)
+	}
+}
+
+func TestSyncPeers(t *testing.T) {
+	replicas := newTestHub(2)
+	defer closeTestHub(replicas)
+	replicas[0].Handler.StartTracker.Pause()
+	replicas[0].Handler.GridConfig.SetDrained("fake-1.0", true)
+
+	replicas[1].Handler.SyncPeers(context.Background())
+	if !replicas[1].Handler.StartTracker.Paused() || !replicas[1].Handler.GridConfig.Drained("fake-1.0") {
+		t.Errorf("Replica did not follow the pause and drained grid of its peer")
+	}
+}
+
+func TestUnreachableReplica(t *testing.T) {
+	replicas := newTestHub(2)
+	defer closeTestHub(replicas)
+	replicas[1].Close()
+
+	if code := replicas[0].do(t, http.MethodPost, "/admin/pause", nil); code != http.StatusBadGateway {
+		t.Errorf("pause answered %d, want 502", code)
+	}
+}
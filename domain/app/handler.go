@@ -0,0 +1,89 @@
+package app
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/lib"
+	"github.com/salestock/sersan/utils"
+)
+
+// multipartOverhead Room left for the multipart headers of an upload
+const multipartOverhead = 1 << 20
+
+// AppHandler App handler
+type AppHandler struct {
+	Config     *config.Config `inject:""`
+	AppService *AppService    `inject:""`
+	Peers      *lib.Peers     `inject:""`
+}
+
+// Apps Handler for app uploads on /apps, authorized with APP_UPLOAD_TOKEN
+// or ADMIN_TOKEN. The app is either the file field of a multipart form or
+// the raw request body, named by the name query parameter.
+func (h AppHandler) Apps(w http.ResponseWriter, r *http.Request) {
+	if !utils.AdminAuthorized(r, h.Config.AppUploadToken) && !utils.AdminAuthorized(r, h.Config.AdminToken) {
+		utils.ResponseFailed(w, http.StatusUnauthorized, utils.ErrUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		utils.JsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, h.AppService.AppCache.MaxSize+multipartOverhead)
+	var body io.Reader = r.Body
+	name := r.URL.Query().Get("name")
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			utils.ResponseFailed(w, http.StatusBadRequest, err)
+			return
+		}
+		defer file.Close()
+		body, name = file, header.Filename
+	}
+	app, err := h.AppService.Store(body, name)
+	if err != nil {
+		utils.ResponseFailed(w, http.StatusInternalServerError, err)
+		return
+	}
+	utils.ResponseOk(w, http.StatusCreated, app)
+}
+
+// App Handler for app downloads on /apps/<file>, used by the grids. Apps
+// cached by another replica are copied from it first.
+func (h AppHandler) App(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		utils.JsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	appCache := h.AppService.AppCache
+	name := path.Base(r.URL.Path)
+	id := strings.TrimSuffix(name, path.Ext(name))
+	cached, err := appCache.Local(id)
+	if err == lib.ErrAppNotFound && h.Peers.Fanned(r) {
+		cached, err = appCache.Find(r.Context(), id)
+	}
+	if err != nil {
+		utils.ResponseFailed(w, http.StatusNotFound, lib.ErrAppNotFound)
+		return
+	}
+	file, err := appCache.Open(cached)
+	if err != nil {
+		utils.ResponseFailed(w, http.StatusNotFound, lib.ErrAppNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		utils.ResponseFailed(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": cached}))
+	http.ServeContent(w, r, cached, info.ModTime(), file)
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/lib"
+)
+
+const testUploadToken = "upload_token"
+
+func TestUploadAndDownloadOnAnotherReplica(t *testing.T) {
+	conf := config.Get()
+	conf.AdminToken = "admin_token"
+	conf.AppUploadToken = testUploadToken
+	addrs := []string{}
+	peers := &lib.Peers{
+		Token:   conf.AdminToken,
+		Resolve: func() ([]string, error) { return addrs, nil },
+	}
+	urls := []string{}
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "sersan-apps")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		appCache := &lib.AppCache{Dir: dir, Retention: time.Hour, MaxSize: 1024, Client: &http.Client{}, Peers: peers}
+		handler := &AppHandler{Config: &conf, AppService: &AppService{Config: &conf, AppCache: appCache}, Peers: peers}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/apps", handler.Apps)
+		mux.HandleFunc("/apps/", handler.App)
+		server := httptest.NewServer(mux)
+		defer server.Close()
+		addrs = append(addrs, strings.TrimPrefix(server.URL, "http://"))
+		urls = append(urls, server.URL)
+	}
+
+	upload := func(token string, body []byte) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, urls[0]+"/apps?name=app.apk", bytes.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for _, token := range []string{"", "wrong"} {
+		resp := upload(token, []byte("app"))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Upload with token %q answered %d, want 401", token, resp.StatusCode)
+		}
+	}
+	resp := upload(testUploadToken, make([]byte, 2<<20))
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated {
+		t.Error("Uploaded an app larger than APP_MAX_SIZE")
+	}
+
+	resp = upload(testUploadToken, []byte("app"))
+	var envelope struct {
+		Data App `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&envelope)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Upload answered %d, want 201", resp.StatusCode)
+	}
+
+	// The grid may download the app from any replica
+	resp, err := http.Get(urls[1] + "/apps/" + envelope.Data.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "app" {
+		t.Errorf("Download answered %d %q, want the app uploaded to the other replica", resp.StatusCode, body)
+	}
+	resp, _ = http.Get(urls[1] + "/apps/" + hexSHA256("unknown") + ".apk")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Download of unknown app answered %d, want 404", resp.StatusCode)
+	}
+}
@@ -0,0 +1,9 @@
+package app
+
+// App Cached app
+type App struct {
+	ID string `json:"id"`
+	// App Value of the app capability referring to the cached app
+	App  string `json:"app"`
+	File string `json:"file"`
+}
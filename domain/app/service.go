@@ -0,0 +1,116 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/lib"
+)
+
+// appCaps Capabilities holding the app, nested ones included
+var appCaps = []string{"app", "appium:app"}
+
+// AppService App service
+type AppService struct {
+	Config   *config.Config `inject:""`
+	AppCache *lib.AppCache  `inject:""`
+}
+
+// Store Store an uploaded app
+func (s AppService) Store(r io.Reader, name string) (*App, error) {
+	file, err := s.AppCache.Store(r, name)
+	if err != nil {
+		return nil, err
+	}
+	id := strings.TrimSuffix(file, path.Ext(file))
+	return &App{ID: id, App: lib.AppScheme + id, File: file}, nil
+}
+
+// Rewrite Rewrite the app capabilities of a new session request to the
+// address of the cached app. The body is returned unchanged when it has no
+// app to rewrite.
+func (s AppService) Rewrite(ctx context.Context, body []byte) ([]byte, error) {
+	var request map[string]interface{}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return body, nil
+	}
+	changed := false
+	rewrite := func(caps interface{}) error {
+		capsMap, ok := caps.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		targets := []map[string]interface{}{capsMap}
+		if options, ok := capsMap["appium:options"].(map[string]interface{}); ok {
+			targets = append(targets, options)
+		}
+		for _, target := range targets {
+			for _, key := range appCaps {
+				app, ok := target[key].(string)
+				if !ok {
+					continue
+				}
+				resolved, err := s.resolve(ctx, app)
+				if err != nil {
+					return err
+				}
+				if resolved != app {
+					target[key] = resolved
+					changed = true
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := rewrite(request["desiredCapabilities"]); err != nil {
+		return nil, err
+	}
+	if w3c, ok := request["capabilities"].(map[string]interface{}); ok {
+		if err := rewrite(w3c["alwaysMatch"]); err != nil {
+			return nil, err
+		}
+		if firstMatch, ok := w3c["firstMatch"].([]interface{}); ok {
+			for _, caps := range firstMatch {
+				if err := rewrite(caps); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if !changed {
+		return body, nil
+	}
+	return json.Marshal(request)
+}
+
+// resolve Address reachable from the grid of the app. Uploaded apps and
+// apps given by URL are served by Sersan, other values are left as is.
+func (s AppService) resolve(ctx context.Context, app string) (string, error) {
+	callbackURL := strings.TrimSuffix(s.Config.CallbackURL, "/")
+	switch {
+	case strings.HasPrefix(app, lib.AppScheme):
+		if callbackURL == "" {
+			return "", errors.New("Uploaded apps require CALLBACK_URL")
+		}
+		file, err := s.AppCache.Find(ctx, strings.TrimPrefix(app, lib.AppScheme))
+		if err != nil {
+			return "", err
+		}
+		return callbackURL + "/apps/" + file, nil
+	case callbackURL == "" || strings.HasPrefix(app, callbackURL+"/"):
+		return app, nil
+	case strings.HasPrefix(app, "http://"), strings.HasPrefix(app, "https://"):
+		file, err := s.AppCache.Fetch(ctx, app)
+		if err != nil {
+			return "", err
+		}
+		return callbackURL + "/apps/" + file, nil
+	}
+	return app, nil
+}
@@ -0,0 +1,147 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/lib"
+)
+
+const testCallbackURL = "http://sersan:4444"
+
+// newTestAppService App service with an empty cache and an origin serving
+// /app.apk, to close once done
+func newTestAppService(t *testing.T) (*AppService, *httptest.Server) {
+	dir, err := ioutil.TempDir("", "sersan-apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app.apk" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("downloaded"))
+	}))
+	conf := config.Get()
+	conf.CallbackURL = testCallbackURL + "/"
+	return &AppService{
+		Config:   &conf,
+		AppCache: &lib.AppCache{Dir: dir, Retention: time.Hour, MaxSize: 1024, Client: &http.Client{}},
+	}, origin
+}
+
+func hexSHA256(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestRewrite(t *testing.T) {
+	s, origin := newTestAppService(t)
+	defer os.RemoveAll(s.AppCache.Dir)
+	defer origin.Close()
+	uploaded, err := s.Store(strings.NewReader("uploaded"), "uploaded.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadedURL := testCallbackURL + "/apps/" + uploaded.File
+	downloadedURL := testCallbackURL + "/apps/" + hexSHA256("downloaded") + ".apk"
+
+	for _, test := range []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{
+			"desired capabilities",
+			`{"desiredCapabilities":{"app":"` + origin.URL + `/app.apk"}}`,
+			`{"desiredCapabilities":{"app":"` + downloadedURL + `"}}`,
+		},
+		{
+			"W3C alwaysMatch and firstMatch",
+			`{"capabilities":{"alwaysMatch":{"appium:app":"` + uploaded.App + `"},"firstMatch":[{},{"appium:app":"` + origin.URL + `/app.apk"}]}}`,
+			`{"capabilities":{"alwaysMatch":{"appium:app":"` + uploadedURL + `"},"firstMatch":[{},{"appium:app":"` + downloadedURL + `"}]}}`,
+		},
+		{
+			"nested appium:options",
+			`{"capabilities":{"alwaysMatch":{"platformName":"Android","appium:options":{"app":"` + uploaded.App + `"}}}}`,
+			`{"capabilities":{"alwaysMatch":{"platformName":"Android","appium:options":{"app":"` + uploadedURL + `"}}}}`,
+		},
+		{
+			"app served by Sersan already",
+			`{"capabilities":{"alwaysMatch":{"appium:app":"` + uploadedURL + `"}}}`,
+			`{"capabilities":{"alwaysMatch":{"appium:app":"` + uploadedURL + `"}}}`,
+		},
+		{
+			"app on the grid",
+			`{"capabilities":{"alwaysMatch":{"appium:app":"/sdcard/app.apk"}}}`,
+			`{"capabilities":{"alwaysMatch":{"appium:app":"/sdcard/app.apk"}}}`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			body, err := s.Rewrite(context.Background(), []byte(test.request))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want interface{}
+			json.Unmarshal(body, &got)
+			json.Unmarshal([]byte(test.want), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Rewritten to %s, want %s", body, test.want)
+			}
+		})
+	}
+}
+
+func TestRewriteUnchanged(t *testing.T) {
+	s, origin := newTestAppService(t)
+	defer os.RemoveAll(s.AppCache.Dir)
+	defer origin.Close()
+	for _, request := range []string{
+		`not json`,
+		`{"desiredCapabilities":{"browserName":"chrome"}}`,
+	} {
+		body, err := s.Rewrite(context.Background(), []byte(request))
+		if err != nil || string(body) != request {
+			t.Errorf("Rewritten %s to %s (%v), want it unchanged", request, body, err)
+		}
+	}
+
+	s.Config.CallbackURL = ""
+	request := `{"desiredCapabilities":{"app":"` + origin.URL + `/app.apk"}}`
+	if body, err := s.Rewrite(context.Background(), []byte(request)); err != nil || string(body) != request {
+		t.Errorf("Rewritten %s to %s (%v) without CALLBACK_URL, want it unchanged", request, body, err)
+	}
+}
+
+func TestRewriteErrors(t *testing.T) {
+	s, origin := newTestAppService(t)
+	defer os.RemoveAll(s.AppCache.Dir)
+	defer origin.Close()
+	for _, test := range []struct {
+		name        string
+		callbackURL string
+		app         string
+	}{
+		{"unknown upload", testCallbackURL, lib.AppScheme + hexSHA256("unknown")},
+		{"upload without CALLBACK_URL", "", lib.AppScheme + hexSHA256("unknown")},
+		{"missing download", testCallbackURL, origin.URL + "/missing.apk"},
+	} {
+		s.Config.CallbackURL = test.callbackURL
+		request := `{"capabilities":{"firstMatch":[{"appium:app":"` + test.app + `"}]}}`
+		if _, err := s.Rewrite(context.Background(), []byte(request)); err == nil {
+			t.Errorf("Rewrote the %s", test.name)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package dashboard
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/lib"
+	"github.com/salestock/sersan/logger"
+	"github.com/salestock/sersan/utils"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	recentFailures = 20
+	defaultLogTail = 500
+	vncDialTimeout = 10 * time.Second
+)
+
+var (
+	// ErrNoVNC Grid of the session has no VNC server
+	ErrNoVNC = errors.New("Session has no VNC server")
+	// ErrNoVideo Grid of the session does not record video
+	ErrNoVideo = errors.New("Session has no video")
+
+	pageTemplate = template.Must(template.New("dashboard").Parse(page))
+)
+
+// DashboardHandler Dashboard handler
+type DashboardHandler struct {
+	Config         *config.Config       `inject:""`
+	GridConfig     *lib.GridConfig      `inject:""`
+	StartTracker   *lib.StartTracker    `inject:""`
+	Sessions       *lib.SessionRegistry `inject:""`
+	HistoryStore   *lib.HistoryStore    `inject:""`
+	TunedTransport *http.Transport      `inject:""`
+	Peers          *lib.Peers           `inject:""`
+}
+
+// Overview Dashboard data of the replica, or of the hub when merged from
+// every replica. Queue is the number of session creations in progress, and
+// Unreachable the number of replicas left out because they did not answer.
+type Overview struct {
+	Paused      bool                 `json:"paused"`
+	Draining    bool                 `json:"draining"`
+	Queue       int                  `json:"queue"`
+	Sessions    []Session            `json:"sessions"`
+	Grids       []Capacity           `json:"grids"`
+	Failures    []*lib.SessionRecord `json:"failures"`
+	Replicas    int                  `json:"replicas"`
+	Unreachable int                  `json:"unreachable"`
+}
+
+// Session Live session, with whether its grid records video
+type Session struct {
+	lib.LiveSession
+	Video bool `json:"video"`
+}
+
+// Capacity Live sessions and warm pool of a grid version
+type Capacity struct {
+	Grid     string         `json:"grid"`
+	Engine   string         `json:"engine"`
+	Drained  bool           `json:"drained"`
+	Sessions int            `json:"sessions"`
+	Pool     *lib.PoolStats `json:"pool,omitempty"`
+}
+
+// Dashboard Handler for the dashboard page on /dashboard. The page asks for
+// the admin token and reads everything else from the admin endpoints.
+func (h DashboardHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	pageTemplate.Execute(w, struct{ NoVNC string }{h.Config.DashboardNoVNCURL})
+}
+
+// DashboardOverview Handler for the dashboard data on /admin/dashboard
+func (h DashboardHandler) DashboardOverview(w http.ResponseWriter, r *http.Request) {
+	if !utils.AdminAuthorized(r, h.Config.AdminToken) {
+		utils.ResponseFailed(w, http.StatusUnauthorized, utils.ErrUnauthorized)
+		return
+	}
+	if !h.Peers.Fanned(r) {
+		utils.ResponseOk(w, http.StatusOK, h.overview())
+		return
+	}
+	responses, err := h.Peers.Fanout(r.Context(), http.MethodGet, r.URL.RequestURI())
+	if err != nil {
+		utils.ResponseFailed(w, http.StatusBadGateway, err)
+		return
+	}
+	utils.ResponseOk(w, http.StatusOK, h.merge(responses))
+}
+
+// merge Overview of the hub from the overviews of its replicas. Replicas not
+// answering are left out, so that the dashboard goes on while replicas are
+// replaced.
+func (h DashboardHandler) merge(responses []lib.PeerResponse) Overview {
+	hub := Overview{Sessions: []Session{}, Grids: []Capacity{}}
+	sessions := [][]lib.LiveSession{}
+	failures := [][]*lib.SessionRecord{}
+	grids := map[string]int{}
+	for _, response := range responses {
+		var overview Overview
+		if err := response.Decode(&overview); err != nil {
+			logger.Warnf("Dashboard left out a replica: %v", err)
+			hub.Unreachable++
+			continue
+		}
+		hub.Replicas++
+		hub.Paused = hub.Paused || overview.Paused
+		hub.Draining = hub.Draining || overview.Draining
+		hub.Queue += overview.Queue
+		live := make([]lib.LiveSession, len(overview.Sessions))
+		for i, session := range overview.Sessions {
+			live[i] = session.LiveSession
+		}
+		sessions = append(sessions, live)
+		failures = append(failures, overview.Failures)
+		for _, capacity := range overview.Grids {
+			i, ok := grids[capacity.Grid]
+			if !ok {
+				grids[capacity.Grid] = len(hub.Grids)
+				hub.Grids = append(hub.Grids, capacity)
+				continue
+			}
+			merged := &hub.Grids[i]
+			merged.Drained = merged.Drained || capacity.Drained
+			merged.Sessions += capacity.Sessions
+			if capacity.Pool == nil {
+				continue
+			}
+			if merged.Pool == nil {
+				merged.Pool = &lib.PoolStats{}
+			}
+			merged.Pool.Idle += capacity.Pool.Idle
+			merged.Pool.Warming += capacity.Pool.Warming
+			merged.Pool.MinIdle += capacity.Pool.MinIdle
+			merged.Pool.MaxIdle += capacity.Pool.MaxIdle
+		}
+	}
+	for _, live := range lib.MergeSessions(sessions...) {
+		hub.Sessions = append(hub.Sessions, h.withVideo(live))
+	}
+	sort.Slice(hub.Grids, func(i, j int) bool { return hub.Grids[i].Grid < hub.Grids[j].Grid })
+	hub.Failures = lib.MergeRecords(recentFailures, failures...)
+	return hub
+}
+
+// overview Dashboard data of the replica
+func (h DashboardHandler) overview() Overview {
+	overview := Overview{
+		Paused:   h.StartTracker.Paused(),
+		Draining: h.StartTracker.Draining(),
+		Queue:    h.StartTracker.Count(),
+		Sessions: []Session{},
+		Grids:    []Capacity{},
+		Failures: []*lib.SessionRecord{},
+		Replicas: 1,
+	}
+	sessions := make(map[string]int)
+	for _, live := range h.Sessions.List() {
+		sessions[live.Grid]++
+		overview.Sessions = append(overview.Sessions, h.withVideo(live))
+	}
+	h.GridConfig.Each(func(name string, version string, grid *lib.Grid) {
+		if grid == nil {
+			return
+		}
+		key := name + "-" + version
+		overview.Grids = append(overview.Grids, Capacity{Grid: key, Engine: lib.EngineName(grid.Engine), Sessions: sessions[key]})
+	})
+	for i := range overview.Grids {
+		capacity := &overview.Grids[i]
+		capacity.Drained = h.GridConfig.Drained(capacity.Grid)
+		if stats, ok := lib.GetWarmPools().Stats(capacity.Grid); ok {
+			capacity.Pool = &stats
+		}
+	}
+	sort.Slice(overview.Grids, func(i, j int) bool { return overview.Grids[i].Grid < overview.Grids[j].Grid })
+	if h.HistoryStore.Enabled() {
+		failures, err := h.HistoryStore.Query(lib.HistoryQuery{Outcome: lib.OutcomeFailed, Limit: recentFailures})
+		if err != nil {
+			logger.Errorf("Failed to query recent failures: %v", err)
+		} else {
+			overview.Failures = failures
+		}
+	}
+	return overview
+}
+
+func (h DashboardHandler) withVideo(live lib.LiveSession) Session {
+	grid, ok := h.GridConfig.Lookup(live.Grid)
+	return Session{LiveSession: live, Video: ok && grid.VideoPath != ""}
+}
+
+// SessionVNC Handler bridging a websocket on /admin/vnc/<id> to the VNC
+// server of the session grid. Sersan authenticates to the VNC server with the
+// grid vncPassword, viewers connect without password.
+func (h DashboardHandler) SessionVNC(w http.ResponseWriter, r *http.Request) {
+	live, ok := h.session(w, r, true)
+	if !ok {
+		return
+	}
+	if !live.VNC {
+		utils.ResponseFailed(w, http.StatusNotFound, ErrNoVNC)
+		return
+	}
+	var password string
+	if grid, ok := h.GridConfig.Lookup(live.Grid); ok {
+		password = grid.VNCPassword
+	}
+	target := net.JoinHostPort(live.Info.Host, live.Info.VNCPort)
+	log := logger.WithFields(logger.Fields{logger.RequestID: live.RequestID, logger.Instance: live.Instance})
+	websocket.Server{
+		Handshake: func(conf *websocket.Config, r *http.Request) error {
+			// noVNC asks for the binary subprotocol
+			for _, protocol := range conf.Protocol {
+				if protocol == "binary" {
+					conf.Protocol = []string{protocol}
+					return nil
+				}
+			}
+			conf.Protocol = nil
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			ws.PayloadType = websocket.BinaryFrame
+			conn, err := net.DialTimeout("tcp", target, vncDialTimeout)
+			if err != nil {
+				log.Warnf("Unable to connect to VNC server %s: %v", target, err)
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(vncDialTimeout))
+			if err := vncHandshake(conn, ws, password); err != nil {
+				log.Warnf("VNC handshake with %s failed: %v", target, err)
+				return
+			}
+			conn.SetDeadline(time.Time{})
+			log.Debugf("VNC connected to %s", target)
+			go func() {
+				io.Copy(conn, ws)
+				conn.Close()
+			}()
+			io.Copy(ws, conn)
+		},
+	}.ServeHTTP(w, r)
+}
+
+// SessionLogs Handler streaming the logs of the session grid on
+// /admin/logs/<id>. The tail query parameter is the number of past lines,
+// and follow keeps streaming new lines.
+func (h DashboardHandler) SessionLogs(w http.ResponseWriter, r *http.Request) {
+	live, ok := h.session(w, r, false)
+	if !ok {
+		return
+	}
+	client, err := lib.GetEngineClient(live.Info.Engine)
+	if err != nil {
+		utils.ResponseFailed(w, http.StatusInternalServerError, err)
+		return
+	}
+	streamer, ok := client.(lib.LogStreamer)
+	if !ok {
+		utils.ResponseFailed(w, http.StatusNotImplemented, fmt.Errorf("Engine %s does not stream logs", lib.EngineName(live.Info.Engine)))
+		return
+	}
+	tail, err := strconv.ParseInt(r.URL.Query().Get("tail"), 10, 64)
+	if err != nil {
+		tail = defaultLogTail
+	}
+	follow := r.URL.Query().Get("follow") == "true"
+	logs, err := streamer.Logs(r.Context(), live.Instance, tail, follow)
+	if err != nil {
+		utils.ResponseFailed(w, http.StatusBadGateway, err)
+		return
+	}
+	defer logs.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := logs.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// SessionVideo Handler for the recording of the session on /admin/video/<id>,
+// proxied from the videoPath of its grid
+func (h DashboardHandler) SessionVideo(w http.ResponseWriter, r *http.Request) {
+	live, ok := h.session(w, r, true)
+	if !ok {
+		return
+	}
+	grid, ok := h.GridConfig.Lookup(live.Grid)
+	if !ok || grid.VideoPath == "" {
+		utils.ResponseFailed(w, http.StatusNotFound, ErrNoVideo)
+		return
+	}
+	target := &url.URL{Scheme: live.Info.Scheme, Host: net.JoinHostPort(live.Info.Host, live.Info.Port)}
+	proxy := &httputil.ReverseProxy{
+		Transport: h.TunedTransport,
+		Director: func(r *http.Request) {
+			r.URL.Scheme, r.URL.Host, r.URL.Path, r.URL.RawQuery = target.Scheme, target.Host, grid.VideoPath, ""
+			r.Host = target.Host
+			r.Header.Del("Authorization")
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// session Live session named by the last path fragment, for admins. Browser
+// endpoints accept the admin token as query parameter. Requests on sessions
+// live on another replica are forwarded to it.
+func (h DashboardHandler) session(w http.ResponseWriter, r *http.Request, browser bool) (lib.LiveSession, bool) {
+	authorized := utils.AdminAuthorized
+	if browser {
+		authorized = utils.BrowserAuthorized
+	}
+	if !authorized(r, h.Config.AdminToken) {
+		utils.ResponseFailed(w, http.StatusUnauthorized, utils.ErrUnauthorized)
+		return lib.LiveSession{}, false
+	}
+	id := path.Base(r.URL.Path)
+	live, err := h.Sessions.Find(id)
+	if err == nil {
+		return live, true
+	}
+	if h.Peers.Fanned(r) {
+		owner, err := h.Peers.Owner(r.Context(), "/admin/sessions/"+url.PathEscape(id))
+		if err != nil {
+			utils.ResponseFailed(w, http.StatusBadGateway, err)
+			return lib.LiveSession{}, false
+		}
+		if owner != "" {
+			h.Peers.Forward(w, r, owner)
+			return lib.LiveSession{}, false
+		}
+	}
+	utils.ResponseFailed(w, http.StatusNotFound, err)
+	return lib.LiveSession{}, false
+}
@@ -0,0 +1,138 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/domain/admin"
+	"github.com/salestock/sersan/lib"
+	"github.com/salestock/sersan/utils"
+)
+
+const testToken = "admin_token"
+
+// testReplica Dashboard of one replica of a test hub
+type testReplica struct {
+	*httptest.Server
+	Handler *DashboardHandler
+}
+
+// newTestHub Replicas knowing each other as peers
+func newTestHub(count int) []*testReplica {
+	conf := config.Get()
+	conf.AdminToken = testToken
+	addrs := []string{}
+	peers := &lib.Peers{
+		Token:   testToken,
+		Resolve: func() ([]string, error) { return addrs, nil },
+	}
+	replicas := []*testReplica{}
+	for i := 0; i < count; i++ {
+		gridConfig := &lib.GridConfig{Grids: map[string]lib.Versions{
+			"fake": {Default: "1.0", Versions: map[string]*lib.Grid{"1.0": {Engine: lib.FakeType, VideoPath: "/video.mp4"}}},
+		}}
+		sessions := &lib.SessionRegistry{}
+		handler := &DashboardHandler{
+			Config:         &conf,
+			GridConfig:     gridConfig,
+			StartTracker:   &lib.StartTracker{},
+			Sessions:       sessions,
+			HistoryStore:   &lib.HistoryStore{},
+			TunedTransport: &http.Transport{},
+			Peers:          peers,
+		}
+		adminHandler := &admin.AdminHandler{Config: &conf, GridConfig: gridConfig, Sessions: sessions, Peers: peers}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/admin/sessions/", adminHandler.AdminSession)
+		mux.HandleFunc("/admin/dashboard", handler.DashboardOverview)
+		mux.HandleFunc("/admin/video/", handler.SessionVideo)
+		server := httptest.NewServer(mux)
+		addrs = append(addrs, strings.TrimPrefix(server.URL, "http://"))
+		replicas = append(replicas, &testReplica{Server: server, Handler: handler})
+	}
+	return replicas
+}
+
+func closeTestHub(replicas []*testReplica) {
+	for _, replica := range replicas {
+		replica.Close()
+	}
+}
+
+func TestOverviewOfEveryReplica(t *testing.T) {
+	replicas := newTestHub(2)
+	defer closeTestHub(replicas)
+	replicas[0].Handler.Sessions.Add("s1", &utils.SessionInfo{RequestID: "r1", Grid: "fake-1.0"}, "10.0.0.1", time.Minute)
+	replicas[1].Handler.Sessions.Add("s2", &utils.SessionInfo{RequestID: "r2", Grid: "fake-1.0"}, "10.0.0.2", time.Minute)
+	replicas[1].Handler.StartTracker.Pause()
+
+	req, _ := http.NewRequest(http.MethodGet, replicas[0].URL+"/admin/dashboard", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var envelope struct {
+		Data Overview `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		t.Fatal(err)
+	}
+	overview := envelope.Data
+	if overview.Replicas != 2 || !overview.Paused || len(overview.Sessions) != 2 {
+		t.Errorf("Overview %+v, want 2 sessions of 2 replicas, paused", overview)
+	}
+	if len(overview.Grids) != 1 || overview.Grids[0].Sessions != 2 {
+		t.Errorf("Grids %+v, want 2 sessions on fake-1.0", overview.Grids)
+	}
+	for _, session := range overview.Sessions {
+		if !session.Video {
+			t.Errorf("Session %s has no video", session.SessionID)
+		}
+	}
+}
+
+func TestVideoOfSessionOnAnotherReplica(t *testing.T) {
+	grid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/video.mp4" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("recording"))
+	}))
+	defer grid.Close()
+	gridURL, _ := url.Parse(grid.URL)
+	host, port, _ := net.SplitHostPort(gridURL.Host)
+
+	replicas := newTestHub(2)
+	defer closeTestHub(replicas)
+	replicas[1].Handler.Sessions.Add("s1", &utils.SessionInfo{RequestID: "r1", Grid: "fake-1.0", Scheme: "http", Host: host, Port: port}, "", time.Minute)
+
+	resp, err := http.Get(replicas[0].URL + "/admin/video/r1?token=" + testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "recording" {
+		t.Errorf("Video answered %d %q, want the recording of the other replica", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(replicas[0].URL + "/admin/video/r2?token=" + testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Video of unknown session answered %d, want 404", resp.StatusCode)
+	}
+}
@@ -0,0 +1,305 @@
+package dashboard
+
+// page Dashboard page, polling /admin/dashboard. Session screens are shown
+// by a built-in view only VNC viewer, or by noVNC imported from
+// DASHBOARD_NOVNC_URL when set.
+const page = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Sersan</title>
+<style>
+body { font-family: sans-serif; margin: 0; color: #222; }
+header { background: #263238; color: #fff; padding: 10px 20px; display: flex; gap: 20px; align-items: center; }
+header h1 { font-size: 18px; margin: 0; flex: 1; }
+main { display: flex; gap: 20px; padding: 20px; }
+section { flex: 1; min-width: 0; }
+h2 { font-size: 15px; margin: 20px 0 8px; }
+table { border-collapse: collapse; width: 100%; font-size: 13px; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #ddd; white-space: nowrap; }
+tbody tr.session { cursor: pointer; }
+tbody tr.session:hover, tr.selected { background: #e3f2fd; }
+.badge { padding: 2px 6px; border-radius: 3px; background: #eee; }
+.warn { background: #ffe0b2; }
+#detail { flex: 1; min-width: 0; display: none; }
+#screen { width: 100%; height: 480px; background: #000; }
+#logs { height: 240px; overflow: auto; background: #111; color: #ddd; font-size: 12px; padding: 8px; margin: 0; }
+video { width: 100%; }
+.reason { white-space: normal; }
+</style>
+</head>
+<body data-novnc="{{.NoVNC}}">
+<header>
+<h1>Sersan</h1>
+<span>Replicas <b id="replicas">0</b></span>
+<span>Queue <b id="queue">0</b></span>
+<span>Sessions <b id="count">0</b></span>
+<span id="state" class="badge"></span>
+</header>
+<main>
+<section>
+<h2>Sessions</h2>
+<table>
+<thead><tr><th>User</th><th>Grid</th><th>Instance</th><th>Age</th><th>Idle</th><th>Commands</th></tr></thead>
+<tbody id="sessions"></tbody>
+</table>
+<h2>Capacity</h2>
+<table>
+<thead><tr><th>Grid</th><th>Engine</th><th>Sessions</th><th>Warm pool</th><th></th></tr></thead>
+<tbody id="grids"></tbody>
+</table>
+<h2>Recent failures</h2>
+<table>
+<thead><tr><th>Time</th><th>User</th><th>Browser</th><th>Grid</th><th>Reason</th></tr></thead>
+<tbody id="failures"></tbody>
+</table>
+</section>
+<section id="detail">
+<h2 id="title"></h2>
+<div id="screen"></div>
+<div id="video"></div>
+<h2>Logs</h2>
+<pre id="logs"></pre>
+</section>
+</main>
+<script>
+let token = new URLSearchParams(location.search).get("token") || localStorage.getItem("sersanToken");
+let selected = null, rfb = null, logs = null;
+
+function authorize() {
+  token = prompt("Admin token");
+  if (token) localStorage.setItem("sersanToken", token);
+}
+
+async function api(path) {
+  const resp = await fetch(path, {headers: {Authorization: "Bearer " + token}});
+  if (resp.status === 401) {
+    authorize();
+    throw new Error("Unauthorized");
+  }
+  return resp;
+}
+
+function seconds(s) {
+  s = Math.round(s);
+  return s < 60 ? s + "s" : s < 3600 ? Math.floor(s / 60) + "m" + (s % 60) + "s" : Math.floor(s / 3600) + "h" + Math.floor(s % 3600 / 60) + "m";
+}
+
+function row(cells) {
+  const tr = document.createElement("tr");
+  for (const cell of cells) {
+    const td = document.createElement("td");
+    td.textContent = cell === undefined ? "" : cell;
+    tr.appendChild(td);
+  }
+  return tr;
+}
+
+function sessionID(s) {
+  return encodeURIComponent(s.requestId || s.sessionId);
+}
+
+async function refresh() {
+  const data = (await (await api("/admin/dashboard")).json()).data;
+  document.getElementById("replicas").textContent = data.replicas + (data.unreachable ? " (" + data.unreachable + " unreachable)" : "");
+  document.getElementById("queue").textContent = data.queue;
+  document.getElementById("count").textContent = data.sessions.length;
+  const state = document.getElementById("state");
+  state.textContent = data.draining ? "draining" : data.paused ? "paused" : "accepting";
+  state.className = data.draining || data.paused ? "badge warn" : "badge";
+
+  const sessions = document.getElementById("sessions");
+  sessions.textContent = "";
+  for (const s of data.sessions) {
+    const tr = row([s.user, s.grid, s.instance, seconds(s.age), seconds(s.idle), s.commands]);
+    tr.className = selected && sessionID(selected) === sessionID(s) ? "session selected" : "session";
+    tr.onclick = () => showSession(s);
+    sessions.appendChild(tr);
+  }
+
+  const grids = document.getElementById("grids");
+  grids.textContent = "";
+  for (const g of data.grids) {
+    const pool = g.pool ? g.pool.idle + " idle, " + g.pool.warming + " warming (" + g.pool.minIdle + "-" + g.pool.maxIdle + ")" : "";
+    grids.appendChild(row([g.grid, g.engine, g.sessions, pool, g.drained ? "drained" : ""]));
+  }
+
+  const failures = document.getElementById("failures");
+  failures.textContent = "";
+  for (const f of data.failures) {
+    const tr = row([new Date(f.requestedAt).toLocaleString(), f.user, [f.browser, f.version].join(" "), f.grid, f.failureReason]);
+    tr.lastChild.className = "reason";
+    failures.appendChild(tr);
+  }
+}
+
+async function showSession(s) {
+  selected = s;
+  if (rfb) rfb.disconnect();
+  if (logs) logs.abort();
+  rfb = null;
+  document.getElementById("detail").style.display = "block";
+  document.getElementById("title").textContent = s.user + " on " + s.grid + " (" + s.instance + ")";
+  const screen = document.getElementById("screen");
+  screen.textContent = s.vnc ? "" : "No VNC server";
+  screen.style.display = s.vnc ? "block" : "none";
+  if (s.vnc) {
+    const scheme = location.protocol === "https:" ? "wss://" : "ws://";
+    const url = scheme + location.host + "/admin/vnc/" + sessionID(s) + "?token=" + encodeURIComponent(token);
+    if (document.body.dataset.novnc) {
+      const RFB = (await import(document.body.dataset.novnc)).default;
+      rfb = new RFB(screen, url);
+      rfb.scaleViewport = true;
+      rfb.viewOnly = true;
+    } else {
+      rfb = viewScreen(screen, url);
+    }
+  }
+  const video = document.getElementById("video");
+  video.textContent = "";
+  if (s.video) {
+    const v = document.createElement("video");
+    v.controls = true;
+    v.src = "/admin/video/" + sessionID(s) + "?token=" + encodeURIComponent(token);
+    video.appendChild(v);
+  }
+  streamLogs(s);
+  refresh();
+}
+
+// View only VNC viewer, with the raw, CopyRect and DesktopSize encodings in
+// 32 bit true colour. Sersan authenticates to the VNC server, the viewer only
+// needs security type None.
+function viewScreen(screen, url) {
+  const canvas = document.createElement("canvas");
+  canvas.style.width = canvas.style.height = "100%";
+  canvas.style.objectFit = "contain";
+  screen.appendChild(canvas);
+  const ctx = canvas.getContext("2d");
+  const ws = new WebSocket(url, "binary");
+  ws.binaryType = "arraybuffer";
+  let chunks = [], length = 0, wake = null, closed = false, stopped = false;
+  ws.onmessage = e => {
+    chunks.push(new Uint8Array(e.data));
+    length += e.data.byteLength;
+    if (wake) wake();
+  };
+  ws.onclose = () => {
+    closed = true;
+    if (wake) wake();
+  };
+
+  async function read(n) {
+    while (length < n) {
+      if (closed) throw new Error("VNC connection closed");
+      await new Promise(resolve => wake = resolve);
+      wake = null;
+    }
+    const bytes = new Uint8Array(n);
+    for (let offset = 0; offset < n;) {
+      const chunk = chunks[0], taken = Math.min(chunk.length, n - offset);
+      bytes.set(chunk.subarray(0, taken), offset);
+      offset += taken;
+      if (taken === chunk.length) chunks.shift(); else chunks[0] = chunk.subarray(taken);
+    }
+    length -= n;
+    return bytes;
+  }
+  const view = bytes => new DataView(bytes.buffer);
+
+  function request(incremental) {
+    const msg = new DataView(new ArrayBuffer(10));
+    msg.setUint8(0, 3);
+    msg.setUint8(1, incremental);
+    msg.setUint16(6, canvas.width);
+    msg.setUint16(8, canvas.height);
+    ws.send(msg.buffer);
+  }
+
+  async function run() {
+    await read(12);
+    ws.send(new TextEncoder().encode("RFB 003.008\n"));
+    await read((await read(1))[0]);
+    ws.send(new Uint8Array([1]));
+    if (view(await read(4)).getUint32(0) !== 0) throw new Error("VNC security handshake failed");
+    ws.send(new Uint8Array([1]));
+    const init = view(await read(24));
+    canvas.width = init.getUint16(0);
+    canvas.height = init.getUint16(2);
+    await read(init.getUint32(20));
+    ws.send(new Uint8Array([0, 0, 0, 0, 32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 0, 8, 16, 0, 0, 0]));
+    const encodings = new DataView(new ArrayBuffer(16));
+    encodings.setUint8(0, 2);
+    encodings.setUint16(2, 3);
+    encodings.setInt32(4, 1);
+    encodings.setInt32(8, 0);
+    encodings.setInt32(12, -223);
+    ws.send(encodings.buffer);
+    request(0);
+    for (;;) {
+      const type = (await read(1))[0];
+      if (type === 0) {
+        const rects = view(await read(3)).getUint16(1);
+        for (let i = 0; i < rects; i++) {
+          const rect = view(await read(12));
+          const x = rect.getUint16(0), y = rect.getUint16(2), w = rect.getUint16(4), h = rect.getUint16(6);
+          const encoding = rect.getInt32(8);
+          if (encoding === 0) {
+            const pixels = await read(w * h * 4);
+            for (let p = 3; p < pixels.length; p += 4) pixels[p] = 255;
+            if (w && h) ctx.putImageData(new ImageData(new Uint8ClampedArray(pixels.buffer), w, h), x, y);
+          } else if (encoding === 1) {
+            const src = view(await read(4));
+            ctx.drawImage(canvas, src.getUint16(0), src.getUint16(2), w, h, x, y, w, h);
+          } else if (encoding === -223) {
+            canvas.width = w;
+            canvas.height = h;
+          } else {
+            throw new Error("Unsupported VNC encoding " + encoding);
+          }
+        }
+        request(1);
+      } else if (type === 1) {
+        await read(view(await read(5)).getUint16(3) * 6);
+      } else if (type === 3) {
+        await read(view(await read(7)).getUint32(3));
+      } else if (type !== 2) {
+        throw new Error("Unsupported VNC message " + type);
+      }
+    }
+  }
+
+  run().catch(e => {
+    if (!stopped) screen.textContent = e.message;
+    ws.close();
+  });
+  return {disconnect: () => {
+    stopped = true;
+    ws.close();
+  }};
+}
+
+async function streamLogs(s) {
+  const pre = document.getElementById("logs");
+  pre.textContent = "";
+  logs = new AbortController();
+  try {
+    const resp = await fetch("/admin/logs/" + sessionID(s) + "?follow=true", {headers: {Authorization: "Bearer " + token}, signal: logs.signal});
+    const reader = resp.body.getReader();
+    const decoder = new TextDecoder();
+    for (;;) {
+      const {done, value} = await reader.read();
+      if (done) break;
+      pre.textContent += decoder.decode(value, {stream: true});
+      pre.scrollTop = pre.scrollHeight;
+    }
+  } catch (e) {}
+}
+
+if (!token) authorize();
+refresh().catch(() => {});
+setInterval(() => refresh().catch(() => {}), 5000);
+</script>
+</body>
+</html>
+`
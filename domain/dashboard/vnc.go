@@ -0,0 +1,197 @@
+package dashboard
+
+import (
+	"crypto/des"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// RFB security types
+const (
+	vncSecurityNone = 1
+	vncSecurityVNC  = 2
+)
+
+var (
+	// ErrVNCPassword Grid VNC server asks for a password and the grid has no
+	// vncPassword
+	ErrVNCPassword = errors.New("VNC server requires a password, set vncPassword on the grid")
+
+	rfbVersion = []byte("RFB 003.008\n")
+)
+
+// vncHandshake Authenticate to the VNC server of a grid, then present it to
+// the viewer as a VNC server without authentication, so that the viewer
+// never needs the grid password. The connections are relayed as is once the
+// viewer sent its ClientInit.
+func vncHandshake(server io.ReadWriter, viewer io.ReadWriter, password string) error {
+	if err := vncAuthenticate(server, password); err != nil {
+		return err
+	}
+	version := make([]byte, len(rfbVersion))
+	if _, err := viewer.Write(rfbVersion); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(viewer, version); err != nil {
+		return err
+	}
+	minor := vncMinorVersion(version)
+	if minor < 7 {
+		if err := binary.Write(viewer, binary.BigEndian, uint32(vncSecurityNone)); err != nil {
+			return err
+		}
+	} else {
+		if _, err := viewer.Write([]byte{1, vncSecurityNone}); err != nil {
+			return err
+		}
+		choice := make([]byte, 1)
+		if _, err := io.ReadFull(viewer, choice); err != nil {
+			return err
+		}
+		if choice[0] != vncSecurityNone {
+			return fmt.Errorf("Viewer chose unsupported VNC security type %d", choice[0])
+		}
+		if minor >= 8 {
+			if err := binary.Write(viewer, binary.BigEndian, uint32(0)); err != nil {
+				return err
+			}
+		}
+	}
+	clientInit := make([]byte, 1)
+	if _, err := io.ReadFull(viewer, clientInit); err != nil {
+		return err
+	}
+	_, err := server.Write(clientInit)
+	return err
+}
+
+// vncAuthenticate Go through the version and security handshakes of the VNC
+// server, with the VNC authentication when the server requires it
+func vncAuthenticate(server io.ReadWriter, password string) error {
+	version := make([]byte, len(rfbVersion))
+	if _, err := io.ReadFull(server, version); err != nil {
+		return err
+	}
+	minor := vncMinorVersion(version)
+	if minor < 0 {
+		return fmt.Errorf("Unsupported VNC server version %q", version)
+	}
+	switch {
+	case minor >= 8:
+		minor, version = 8, rfbVersion
+	case minor < 7:
+		// Unknown versions are handled as 3.3
+		minor, version = 3, []byte("RFB 003.003\n")
+	}
+	if _, err := server.Write(version); err != nil {
+		return err
+	}
+
+	var security byte
+	if minor < 7 {
+		var chosen uint32
+		if err := binary.Read(server, binary.BigEndian, &chosen); err != nil {
+			return err
+		}
+		if chosen == 0 {
+			return vncFailure(server, "VNC server refused the connection")
+		}
+		security = byte(chosen)
+	} else {
+		count := make([]byte, 1)
+		if _, err := io.ReadFull(server, count); err != nil {
+			return err
+		}
+		if count[0] == 0 {
+			return vncFailure(server, "VNC server refused the connection")
+		}
+		types := make([]byte, count[0])
+		if _, err := io.ReadFull(server, types); err != nil {
+			return err
+		}
+		for _, t := range types {
+			if t == vncSecurityNone || (t == vncSecurityVNC && security != vncSecurityNone) {
+				security = t
+			}
+		}
+		if security == 0 {
+			return fmt.Errorf("VNC server offers no supported security type: %v", types)
+		}
+		if _, err := server.Write([]byte{security}); err != nil {
+			return err
+		}
+	}
+
+	switch security {
+	case vncSecurityNone:
+		if minor < 8 {
+			return nil
+		}
+	case vncSecurityVNC:
+		if password == "" {
+			return ErrVNCPassword
+		}
+		challenge := make([]byte, 16)
+		if _, err := io.ReadFull(server, challenge); err != nil {
+			return err
+		}
+		if _, err := server.Write(vncResponse(challenge, password)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unsupported VNC security type %d", security)
+	}
+	var result uint32
+	if err := binary.Read(server, binary.BigEndian, &result); err != nil {
+		return err
+	}
+	if result != 0 {
+		if minor >= 8 {
+			return vncFailure(server, "VNC authentication failed")
+		}
+		return errors.New("VNC authentication failed")
+	}
+	return nil
+}
+
+// vncResponse DES encryption of the challenge with the password, whose bytes
+// have their bits reversed as VNC servers expect
+func vncResponse(challenge []byte, password string) []byte {
+	key := make([]byte, 8)
+	copy(key, password)
+	for i := range key {
+		key[i] = bits.Reverse8(key[i])
+	}
+	cipher, _ := des.NewCipher(key)
+	response := make([]byte, len(challenge))
+	for i := 0; i < len(challenge); i += des.BlockSize {
+		cipher.Encrypt(response[i:i+des.BlockSize], challenge[i:i+des.BlockSize])
+	}
+	return response
+}
+
+// vncFailure Error with the reason sent by the VNC server
+func vncFailure(server io.Reader, message string) error {
+	var length uint32
+	if err := binary.Read(server, binary.BigEndian, &length); err != nil || length > 1024 {
+		return errors.New(message)
+	}
+	reason := make([]byte, length)
+	if _, err := io.ReadFull(server, reason); err != nil {
+		return errors.New(message)
+	}
+	return fmt.Errorf("%s: %s", message, reason)
+}
+
+// vncMinorVersion Minor RFB version of a ProtocolVersion message, -1 when
+// it is not one
+func vncMinorVersion(version []byte) int {
+	var major, minor int
+	if _, err := fmt.Sscanf(string(version), "RFB %03d.%03d\n", &major, &minor); err != nil || major != 3 {
+		return -1
+	}
+	return minor
+}
@@ -0,0 +1,145 @@
+package dashboard
+
+import (
+	"bytes"
+	"crypto/des"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeVNCServer VNC server side of a connection, speaking the given version
+// and asking for the password when not empty
+func fakeVNCServer(t *testing.T, conn net.Conn, version string, password string) {
+	defer conn.Close()
+	conn.Write([]byte(version))
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Errorf("Reading version: %v", err)
+		return
+	}
+	if version == "RFB 003.003\n" {
+		security := uint32(1)
+		if password != "" {
+			security = 2
+		}
+		binary.Write(conn, binary.BigEndian, security)
+	} else {
+		conn.Write([]byte{1, 2})
+		choice := make([]byte, 1)
+		io.ReadFull(conn, choice)
+	}
+	if password != "" {
+		challenge := bytes.Repeat([]byte{0x5a}, 16)
+		conn.Write(challenge)
+		response := make([]byte, 16)
+		io.ReadFull(conn, response)
+		key := make([]byte, 8)
+		copy(key, password)
+		for i, b := range key {
+			var reversed byte
+			for bit := uint(0); bit < 8; bit++ {
+				reversed |= (b >> bit & 1) << (7 - bit)
+			}
+			key[i] = reversed
+		}
+		cipher, _ := des.NewCipher(key)
+		expected := make([]byte, 16)
+		cipher.Encrypt(expected[:8], challenge[:8])
+		cipher.Encrypt(expected[8:], challenge[8:])
+		if !bytes.Equal(response, expected) {
+			binary.Write(conn, binary.BigEndian, uint32(1))
+			binary.Write(conn, binary.BigEndian, uint32(len("Wrong password")))
+			conn.Write([]byte("Wrong password"))
+			return
+		}
+		binary.Write(conn, binary.BigEndian, uint32(0))
+	}
+	clientInit := make([]byte, 1)
+	if _, err := io.ReadFull(conn, clientInit); err != nil {
+		t.Errorf("Reading ClientInit: %v", err)
+		return
+	}
+	conn.Write([]byte("server init"))
+}
+
+// viewVNC Viewer side of a connection, asking for security type None
+func viewVNC(t *testing.T, conn net.Conn) string {
+	version := make([]byte, 12)
+	io.ReadFull(conn, version)
+	if string(version) != "RFB 003.008\n" {
+		t.Errorf("Viewer got version %q", version)
+	}
+	conn.Write(version)
+	types := make([]byte, 2)
+	io.ReadFull(conn, types)
+	if !bytes.Equal(types, []byte{1, vncSecurityNone}) {
+		t.Errorf("Viewer got security types %v, want None only", types)
+	}
+	conn.Write([]byte{vncSecurityNone})
+	var result uint32
+	binary.Read(conn, binary.BigEndian, &result)
+	if result != 0 {
+		t.Errorf("Viewer got security result %d", result)
+	}
+	conn.Write([]byte{1})
+	serverInit := make([]byte, len("server init"))
+	io.ReadFull(conn, serverInit)
+	return string(serverInit)
+}
+
+func TestVNCHandshake(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		version  string
+		password string
+	}{
+		{"3.8 with password", "RFB 003.008\n", "secret"},
+		{"3.3 with password", "RFB 003.003\n", "secret"},
+		{"3.3 without password", "RFB 003.003\n", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server, hubToServer := net.Pipe()
+			viewer, hubToViewer := net.Pipe()
+			defer viewer.Close()
+			go fakeVNCServer(t, server, test.version, test.password)
+			errs := make(chan error, 1)
+			go func() {
+				defer hubToServer.Close()
+				defer hubToViewer.Close()
+				if err := vncHandshake(hubToServer, hubToViewer, test.password); err != nil {
+					errs <- err
+					return
+				}
+				close(errs)
+				io.Copy(hubToViewer, hubToServer)
+			}()
+			if serverInit := viewVNC(t, viewer); serverInit != "server init" {
+				t.Errorf("Viewer got %q, want the ServerInit of the VNC server", serverInit)
+			}
+			if err := <-errs; err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestVNCHandshakeWrongPassword(t *testing.T) {
+	server, hub := net.Pipe()
+	defer hub.Close()
+	go fakeVNCServer(t, server, "RFB 003.008\n", "secret")
+	err := vncAuthenticate(hub, "wrong")
+	if err == nil || err.Error() != "VNC authentication failed: Wrong password" {
+		t.Errorf("Got %v, want the failure reason of the VNC server", err)
+	}
+}
+
+func TestVNCHandshakeWithoutPassword(t *testing.T) {
+	server, hub := net.Pipe()
+	defer hub.Close()
+	go fakeVNCServer(t, server, "RFB 003.008\n", "secret")
+	if err := vncAuthenticate(hub, ""); err != ErrVNCPassword {
+		t.Errorf("Got %v, want %v", err, ErrVNCPassword)
+	}
+}
@@ -0,0 +1,176 @@
+package event
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/lib"
+	"github.com/salestock/sersan/logger"
+	"github.com/salestock/sersan/utils"
+)
+
+const (
+	subscriberBuffer  = 256
+	heartbeatInterval = 15 * time.Second
+	// resolveInterval Interval between resolutions of the replicas whose
+	// streams are relayed, to follow replicas replaced while streaming
+	resolveInterval = 15 * time.Second
+)
+
+// EventHandler Event handler
+type EventHandler struct {
+	Config   *config.Config `inject:""`
+	EventBus *lib.EventBus  `inject:""`
+	Peers    *lib.Peers     `inject:""`
+}
+
+// Events Handler for the session lifecycle event stream on /admin/events,
+// served as Server-Sent Events. The type query parameter keeps only the
+// comma separated event types. When the replicas are known, the streams of
+// every replica are merged.
+func (h EventHandler) Events(w http.ResponseWriter, r *http.Request) {
+	if !utils.BrowserAuthorized(r, h.Config.AdminToken) {
+		utils.ResponseFailed(w, http.StatusUnauthorized, utils.ErrUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		utils.ResponseFailed(w, http.StatusInternalServerError, errors.New("Streaming is not supported"))
+		return
+	}
+	var types map[string]bool
+	if filter := r.URL.Query().Get("type"); filter != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(filter, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	var events <-chan lib.Event
+	var relayed chan []byte
+	if h.Peers.Fanned(r) {
+		query := r.URL.Query()
+		query.Del("token")
+		relayed = make(chan []byte, subscriberBuffer)
+		go h.relay(r.Context(), r.URL.Path+"?"+query.Encode(), relayed)
+	} else {
+		subscribed, unsubscribe := h.EventBus.Subscribe(subscriberBuffer)
+		defer unsubscribe()
+		events = subscribed
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case event := <-events:
+			if types != nil && !types[event.Type] {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		case block := <-relayed:
+			w.Write(block)
+		}
+		flusher.Flush()
+	}
+}
+
+// relay Relay the events streamed by every replica to blocks until ctx is
+// done. Streams ended, e.g. by replicas shut down, are reopened while their
+// replica resolves.
+func (h EventHandler) relay(ctx context.Context, uri string, blocks chan<- []byte) {
+	var lock sync.Mutex
+	streams := map[string]bool{}
+	resolve := time.NewTicker(resolveInterval)
+	defer resolve.Stop()
+	for {
+		addrs, err := h.Peers.Resolve()
+		if err != nil {
+			logger.Warnf("Unable to resolve replicas to stream events from: %v", err)
+		}
+		for _, addr := range addrs {
+			lock.Lock()
+			streaming := streams[addr]
+			streams[addr] = true
+			lock.Unlock()
+			if streaming {
+				continue
+			}
+			go func(addr string) {
+				if err := h.stream(ctx, addr, uri, blocks); err != nil && ctx.Err() == nil {
+					logger.Warnf("Event stream of replica %s ended: %v", addr, err)
+				}
+				lock.Lock()
+				delete(streams, addr)
+				lock.Unlock()
+			}(addr)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-resolve.C:
+		}
+	}
+}
+
+// stream Relay the events streamed by the replica at addr to blocks, one
+// block per event. Heartbeats are left out.
+func (h EventHandler) stream(ctx context.Context, addr string, uri string, blocks chan<- []byte) error {
+	req, err := h.Peers.Request(ctx, http.MethodGet, addr, uri)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Replica answered %d", resp.StatusCode)
+	}
+	reader := bufio.NewReader(resp.Body)
+	var block []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			if line[0] != ':' {
+				block = append(block, line...)
+			}
+			continue
+		}
+		if len(block) == 0 {
+			continue
+		}
+		select {
+		case blocks <- append(block, '\n'):
+		case <-ctx.Done():
+			return nil
+		}
+		block = nil
+	}
+}
@@ -0,0 +1,73 @@
+package event
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/lib"
+)
+
+const testToken = "admin_token"
+
+func TestEventsOfEveryReplica(t *testing.T) {
+	conf := config.Get()
+	conf.AdminToken = testToken
+	addrs := []string{}
+	peers := &lib.Peers{
+		Token:   testToken,
+		Resolve: func() ([]string, error) { return addrs, nil },
+	}
+	buses := []*lib.EventBus{}
+	for i := 0; i < 2; i++ {
+		handler := &EventHandler{Config: &conf, EventBus: &lib.EventBus{}, Peers: peers}
+		server := httptest.NewServer(http.HandlerFunc(handler.Events))
+		defer server.Close()
+		addrs = append(addrs, strings.TrimPrefix(server.URL, "http://"))
+		buses = append(buses, handler.EventBus)
+	}
+
+	resp, err := http.Get("http://" + addrs[0] + "/admin/events?token=" + testToken + "&type=session.created,session.failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	types := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "event: ") {
+				types <- strings.TrimPrefix(line, "event: ")
+			}
+		}
+		close(types)
+	}()
+
+	// Replica streams are relayed once connected, publish until they are
+	seen := map[string]bool{}
+	publish := time.NewTicker(20 * time.Millisecond)
+	defer publish.Stop()
+	timeout := time.After(5 * time.Second)
+	for !seen[lib.EventSessionCreated] || !seen[lib.EventSessionFailed] {
+		select {
+		case <-publish.C:
+			buses[0].Publish(lib.Event{Type: lib.EventSessionCreated})
+			buses[1].Publish(lib.Event{Type: lib.EventSessionFailed})
+			buses[1].Publish(lib.Event{Type: lib.EventSessionDeleted})
+		case eventType, ok := <-types:
+			if !ok {
+				t.Fatal("Event stream ended")
+			}
+			if eventType == lib.EventSessionDeleted {
+				t.Errorf("Got %s event, filtered out by type", eventType)
+			}
+			seen[eventType] = true
+		case <-timeout:
+			t.Fatalf("Got events %v, want the events of both replicas", seen)
+		}
+	}
+}
@@ -1,14 +1,22 @@
 package health
 
 import (
+    "errors"
     "net/http"
 
+    "github.com/salestock/sersan/lib"
     "github.com/salestock/sersan/utils"
 )
 
 type HealthHandler struct {
+    StartTracker *lib.StartTracker `inject:""`
 }
 
+// HealthCheck Readiness check, fails as soon as Sersan starts draining
 func (c HealthHandler) HealthCheck(w http.ResponseWriter, r *http.Request) {
+    if c.StartTracker.Draining() {
+        utils.ResponseFailed(w, http.StatusServiceUnavailable, errors.New("Sersan API draining"))
+        return
+    }
     utils.ResponseOk(w, 200, "Sersan API running")
 }
@@ -0,0 +1,160 @@
+package history
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/lib"
+	"github.com/salestock/sersan/utils"
+)
+
+// ErrHistoryDisabled History is not recorded
+var ErrHistoryDisabled = errors.New("Session history is disabled")
+
+// HistoryHandler History handler. Each replica records the sessions it
+// created or ended, queries are fanned out to every replica when the replicas
+// are known.
+type HistoryHandler struct {
+	Config       *config.Config    `inject:""`
+	HistoryStore *lib.HistoryStore `inject:""`
+	Peers        *lib.Peers        `inject:""`
+}
+
+// History Handler for session history queries on /admin/history, filtered
+// by the user, browser, outcome, from and to (RFC 3339) query parameters
+// and returning at most limit sessions, newest first
+func (h HistoryHandler) History(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+	params := r.URL.Query()
+	q := lib.HistoryQuery{
+		User:    params.Get("user"),
+		Browser: params.Get("browser"),
+		Outcome: params.Get("outcome"),
+	}
+	var err error
+	if q.From, err = parseTime(params.Get("from")); err != nil {
+		utils.ResponseFailed(w, http.StatusBadRequest, err)
+		return
+	}
+	if q.To, err = parseTime(params.Get("to")); err != nil {
+		utils.ResponseFailed(w, http.StatusBadRequest, err)
+		return
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			utils.ResponseFailed(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if h.Peers.Fanned(r) {
+		if q.Limit <= 0 || q.Limit > lib.HistoryMaxResults {
+			q.Limit = lib.HistoryMaxResults
+		}
+		lists := [][]*lib.SessionRecord{}
+		if h.fanout(w, r, func(response lib.PeerResponse) error {
+			var records []*lib.SessionRecord
+			if err := response.Decode(&records); err != nil {
+				return err
+			}
+			lists = append(lists, records)
+			return nil
+		}) {
+			utils.ResponseOk(w, http.StatusOK, lib.MergeRecords(q.Limit, lists...))
+		}
+		return
+	}
+	records, err := h.HistoryStore.Query(q)
+	if err != nil {
+		utils.ResponseFailed(w, http.StatusInternalServerError, err)
+		return
+	}
+	utils.ResponseOk(w, http.StatusOK, records)
+}
+
+// HistoryRecord Handler for one session on /admin/history/<request id>
+func (h HistoryHandler) HistoryRecord(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+	if h.Peers.Fanned(r) {
+		// Sessions are recorded by the replicas which created or ended them
+		records := []*lib.SessionRecord{}
+		if !h.fanout(w, r, func(response lib.PeerResponse) error {
+			if response.Err == nil && response.Status == http.StatusNotFound {
+				return nil
+			}
+			record := &lib.SessionRecord{}
+			if err := response.Decode(record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		}) {
+			return
+		}
+		records = lib.MergeRecords(0, records)
+		if len(records) == 0 {
+			utils.ResponseFailed(w, http.StatusNotFound, lib.ErrSessionRecordNotFound)
+			return
+		}
+		utils.ResponseOk(w, http.StatusOK, records[0])
+		return
+	}
+	record, err := h.HistoryStore.Get(path.Base(r.URL.Path))
+	if err == lib.ErrSessionRecordNotFound {
+		utils.ResponseFailed(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		utils.ResponseFailed(w, http.StatusInternalServerError, err)
+		return
+	}
+	utils.ResponseOk(w, http.StatusOK, record)
+}
+
+func (h HistoryHandler) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if !utils.AdminAuthorized(r, h.Config.AdminToken) {
+		utils.ResponseFailed(w, http.StatusUnauthorized, utils.ErrUnauthorized)
+		return false
+	}
+	if r.Method != http.MethodGet {
+		utils.JsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if !h.HistoryStore.Enabled() {
+		utils.ResponseFailed(w, http.StatusNotFound, ErrHistoryDisabled)
+		return false
+	}
+	return true
+}
+
+// fanout Send r to every replica and decode their responses. It responds
+// with 502 and returns false when a replica fails.
+func (h HistoryHandler) fanout(w http.ResponseWriter, r *http.Request, decode func(response lib.PeerResponse) error) bool {
+	responses, err := h.Peers.Fanout(r.Context(), r.Method, r.URL.RequestURI())
+	if err == nil {
+		for _, response := range responses {
+			if err = decode(response); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		utils.ResponseFailed(w, http.StatusBadGateway, err)
+		return false
+	}
+	return true
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
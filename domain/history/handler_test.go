@@ -0,0 +1,110 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/lib"
+)
+
+const testToken = "admin_token"
+
+func get(t *testing.T, url string, data interface{}) int {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if data != nil {
+		envelope := struct {
+			Data interface{} `json:"data"`
+		}{data}
+		if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHistoryOfEveryReplica(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sersan-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := config.Get()
+	conf.AdminToken = testToken
+	addrs := []string{}
+	peers := &lib.Peers{
+		Token:   testToken,
+		Resolve: func() ([]string, error) { return addrs, nil },
+	}
+	stores := []*lib.HistoryStore{}
+	for i := 0; i < 2; i++ {
+		store := &lib.HistoryStore{Path: filepath.Join(dir, fmt.Sprintf("history-%d.db", i)), Retention: time.Hour}
+		if err := store.Open(); err != nil {
+			t.Fatal(err)
+		}
+		handler := &HistoryHandler{Config: &conf, HistoryStore: store, Peers: peers}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/admin/history", handler.History)
+		mux.HandleFunc("/admin/history/", handler.HistoryRecord)
+		server := httptest.NewServer(mux)
+		defer server.Close()
+		addrs = append(addrs, strings.TrimPrefix(server.URL, "http://"))
+		stores = append(stores, store)
+	}
+
+	// Session a is created by the first replica and deleted through the second
+	start := time.Now().Add(-time.Minute)
+	for _, record := range []struct {
+		store *lib.HistoryStore
+		event lib.Event
+	}{
+		{stores[0], lib.Event{Type: lib.EventSessionRequested, Time: start, RequestID: "a", User: "alice", Browser: "chrome"}},
+		{stores[0], lib.Event{Type: lib.EventSessionCreated, Time: start.Add(time.Second), RequestID: "a", SessionID: "s"}},
+		{stores[1], lib.Event{Type: lib.EventSessionDeleted, Time: start.Add(time.Minute), RequestID: "a", SessionID: "s", User: "alice", Duration: 59}},
+		{stores[1], lib.Event{Type: lib.EventSessionRequested, Time: start.Add(2 * time.Second), RequestID: "b", User: "bob"}},
+		{stores[1], lib.Event{Type: lib.EventSessionFailed, Time: start.Add(3 * time.Second), RequestID: "b", Reason: "Grid is not ready"}},
+	} {
+		if err := record.store.Record(record.event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var records []*lib.SessionRecord
+	if code := get(t, "http://"+addrs[0]+"/admin/history", &records); code != http.StatusOK {
+		t.Fatalf("History answered %d", code)
+	}
+	if len(records) != 2 || records[0].RequestID != "b" || records[1].RequestID != "a" {
+		t.Fatalf("Got %d records, want b then a", len(records))
+	}
+	if a := records[1]; a.Browser != "chrome" || a.EndCause != "deleted" || a.Duration != 59 || !a.RequestedAt.Equal(start) {
+		t.Errorf("Record %+v, want the creation and the deletion of the session merged", a)
+	}
+
+	records = nil
+	get(t, "http://"+addrs[1]+"/admin/history?outcome=failed&limit=5", &records)
+	if len(records) != 1 || records[0].RequestID != "b" {
+		t.Errorf("Got %d failed records, want b", len(records))
+	}
+
+	var record lib.SessionRecord
+	if code := get(t, "http://"+addrs[1]+"/admin/history/a", &record); code != http.StatusOK || record.Browser != "chrome" || record.EndCause != "deleted" {
+		t.Errorf("Record a answered %d with %+v, want the merged record", code, record)
+	}
+	if code := get(t, "http://"+addrs[0]+"/admin/history/c", nil); code != http.StatusNotFound {
+		t.Errorf("Unknown record answered %d, want 404", code)
+	}
+}
@@ -7,17 +7,22 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	cache "github.com/patrickmn/go-cache"
 	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/domain/app"
+	"github.com/salestock/sersan/lib"
+	"github.com/salestock/sersan/logger"
+	"github.com/salestock/sersan/tracing"
 	"github.com/salestock/sersan/utils"
 )
 
@@ -30,93 +35,220 @@ var (
 		},
 	}
 	hostname string
+
+	// proxyBuffers Copy buffers of proxied responses, shared so that large
+	// screenshots are streamed without allocating a buffer per command
+	proxyBuffers = &bufferPool{pool: sync.Pool{New: func() interface{} { return make([]byte, 32*1024) }}}
 )
 
+// bufferPool Buffer pool of the reverse proxy
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func (p *bufferPool) Get() []byte  { return p.pool.Get().([]byte) }
+func (p *bufferPool) Put(b []byte) { p.pool.Put(b) }
+
 // SessionHandler Session handler
 type SessionHandler struct {
-	SessionService *SessionService `inject:""`
-	TunedTransport *http.Transport `inject:""`
-	Cache          *cache.Cache    `inject:""`
+	Config         *config.Config       `inject:""`
+	SessionService *SessionService      `inject:""`
+	AppService     *app.AppService      `inject:""`
+	TunedTransport *http.Transport      `inject:""`
+	Cache          *cache.Cache         `inject:""`
+	StartTracker   *lib.StartTracker    `inject:""`
+	EventBus       *lib.EventBus        `inject:""`
+	Sessions       *lib.SessionRegistry `inject:""`
 }
 
 // Create Handler for new session request
 func (h SessionHandler) Create(w http.ResponseWriter, r *http.Request) {
 	sessionStartTime := time.Now()
 	hostname, err := os.Hostname()
+	user, remote := utils.RequestInfo(r)
+	requestID := utils.GenerateUUID()
+	log := logger.WithFields(logger.Fields{logger.RequestID: requestID, logger.User: user, logger.Remote: remote})
+	ctx, span := tracing.StartKind(tracing.Extract(r), "NewSession", tracing.KindServer)
+	ctx, timings := tracing.WithTimings(ctx)
+	span.SetAttribute("sersan.request_id", requestID)
+	span.SetAttribute("enduser.id", user)
+	if sc := span.Context; sc.Valid() {
+		log = log.With(logger.TraceID, sc.TraceIDString())
+	}
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	defer rec.endSpan(span)
 	if err != nil {
-		log.Printf("Init %s: %v", os.Args[0], err)
+		log.Warnf("Init %s: %v", os.Args[0], err)
 	}
-	conf := config.Get()
-	user, remote := utils.RequestInfo(r)
 	body, err := ioutil.ReadAll(r.Body)
 	r.Body.Close()
 	if err != nil {
-		log.Printf("Error Reading Request %v", err)
+		log.Errorf("Error Reading Request %v", err)
 		return
 	}
 	var browser *Browser
 	err = json.Unmarshal(body, &browser)
 	if err != nil {
-		log.Printf("Error Reading Request %v", err)
+		log.Warnf("Error Reading Request %v", err)
 		return
 	}
-	if browser.W3CCaps.Caps.Name != "" && browser.Caps.Name == "" {
-		browser.Caps = browser.W3CCaps.Caps
+	w3cCaps := browser.W3CCaps.Caps
+	if browser.Caps.Name == "" && (w3cCaps.Name != "" || w3cCaps.PlatformName != "") {
+		browser.Caps = w3cCaps
+	}
+	events := &sessionEvents{
+		bus:     h.EventBus,
+		start:   sessionStartTime,
+		timings: timings,
+		event: lib.Event{
+			RequestID: requestID,
+			User:      user,
+			Remote:    remote,
+			Browser:   browser.Caps.Name,
+			Version:   browser.Caps.Version,
+		},
+	}
+	if events.event.Version == "" {
+		events.event.Version = browser.Caps.W3CVersion
 	}
+	if events.event.Browser == "" {
+		events.event.Browser, events.event.Version = browser.Caps.PlatformName, browser.Caps.PlatformVersion
+	}
+	events.publish(lib.EventSessionRequested, "", requestedCaps(body))
 
-	gridStarter, _ := h.SessionService.Create(browser)
-	startedGrid, err := gridStarter.StartWithCancel()
+	// Starting the grid and creating the session are aborted when the client
+	// goes away or the server shuts down
+	startCtx, startDone, err := h.StartTracker.Track(logger.NewContext(ctx, log))
 	if err != nil {
-		log.Printf("Failed to create pod: %v", err)
+		log.Warnf("Session refused: %v", err)
+		events.publish(lib.EventSessionFailed, err.Error(), nil)
+		w.Header().Set("Retry-After", "1")
+		utils.JsonError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer startDone()
+
+	gridStarter, ok := h.SessionService.Create(browser, user, requestID)
+	if !ok {
+		events.publish(lib.EventSessionFailed, "Requested grid is not available", nil)
+		utils.JsonError(w, "Requested grid is not available", http.StatusBadRequest)
 		return
 	}
 
+	// Apps are only fetched for the grids able to serve the session
+	body, err = h.AppService.Rewrite(startCtx, body)
+	if err != nil {
+		log.Errorf("Failed to cache app: %v", err)
+		events.publish(lib.EventSessionFailed, fmt.Sprintf("App could not be cached: %v", err), nil)
+		utils.WebDriverError(w, "session not created", fmt.Sprintf("App could not be cached: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	startedGrid, err := gridStarter.StartWithCancel(startCtx)
+	if err != nil {
+		log.Errorf("Failed to start grid: %v", err)
+		msg := fmt.Sprintf("Grid could not be started: %v", err)
+		if class := lib.ErrorClass(err); class != lib.ErrorUnknown {
+			msg = fmt.Sprintf("Grid could not be started (%s): %v", class, err)
+		}
+		events.publish(lib.EventSessionFailed, msg, nil)
+		utils.WebDriverError(w, "session not created", msg, http.StatusInternalServerError)
+		return
+	}
+	events.event.Grid = startedGrid.Grid.Key()
+	events.event.Engine = lib.EngineName(startedGrid.Grid.Grid.Engine)
+	events.event.Instance = startedGrid.Name
+	events.publish(lib.EventGridStarted, "", nil)
+
+	// New session attempts are retried as per the grid retry policy, and the
+	// grid is recreated once it proves broken
+	policy := startedGrid.Grid.Grid.RetryPolicy(h.Config)
+	cancelled := func() {
+		log.Warnf("Session creation cancelled - %.2fs", utils.SecondsSince(sessionStartTime))
+		events.publish(lib.EventSessionFailed, "Session creation cancelled", nil)
+		startedGrid.Cancel()
+	}
+	failed := func(msg string) {
+		log.Errorf("Session failed: %s", msg)
+		startedGrid.Cancel()
+		events.publish(lib.EventSessionFailed, msg, nil)
+		utils.WebDriverError(w, "session not created", msg, http.StatusInternalServerError)
+	}
 	var resp *http.Response
-	i := 1
-	for ; ; i++ {
-		r.URL.Host, r.URL.Path = startedGrid.URL.Hostname()+":"+startedGrid.URL.Port(), startedGrid.Grid.Grid.BaseURL+"/session"
-		log.Printf("Request URL: %s", r.URL.String())
-		req, _ := http.NewRequest(http.MethodPost, r.URL.String(), bytes.NewReader(body))
-		ctx, done := context.WithTimeout(r.Context(), 60*time.Second)
-		defer done()
-		log.Printf("Session attempted to %s for %d time{s)", startedGrid.URL.Hostname(), i)
-		rsp, err := httpClient.Do(req.WithContext(ctx))
-		select {
-		case <-ctx.Done():
-			if rsp != nil {
+	i, gridAttempts, recreated := 0, 0, 0
+	for {
+		i++
+		gridAttempts++
+		log = log.WithFields(logger.Fields{logger.Grid: startedGrid.Grid.Key(), logger.Instance: startedGrid.Name})
+		events.event.Instance = startedGrid.Name
+		rsp, class, err := newSessionAttempt(logger.NewContext(startCtx, log), startedGrid, body, i, policy)
+		if startCtx.Err() != nil {
+			if err == nil {
 				rsp.Body.Close()
 			}
-			switch ctx.Err() {
-			case context.DeadlineExceeded:
-				log.Printf("Session attempted timeout after %d times", conf.NewSessionAttemptTimeout)
-				if int32(i) < conf.RetryCount {
-					log.Printf("Retry count %d", conf.RetryCount)
-					continue
+			cancelled()
+			return
+		}
+		// Grids failing over, i.e. remote upstreams, fail over on any server
+		// error, retryable or not
+		if (err != nil || rsp.StatusCode >= http.StatusInternalServerError) && startedGrid.Failover != nil {
+			if next, ok := startedGrid.Failover(); ok {
+				log.Warnf("Session attempt %d failed: %s", i, attemptFailure(rsp, err))
+				if err == nil {
+					rsp.Body.Close()
 				}
-				err := fmt.Errorf("New session attempts retry count exceeded")
-				log.Printf("Session for %s failed: %s", startedGrid.URL.Hostname(), err)
-				utils.JsonError(w, err.Error(), http.StatusInternalServerError)
-			case context.Canceled:
-				log.Printf("Client disconnected %s - %s - %.2fs", user, remote, utils.SecondsSince(sessionStartTime))
+				startedGrid, gridAttempts = next, 0
+				continue
 			}
-			startedGrid.Cancel()
+		}
+		if err == nil && !policy.RetryStatus(rsp.StatusCode) {
+			resp = rsp
+			break
+		}
+		reason := attemptFailure(rsp, err)
+		if err == nil {
+			rsp.Body.Close()
+		}
+		log.Warnf("Session attempt %d failed: %s", i, reason)
+		if err != nil && !policy.RetryError(class) {
+			failed(reason)
 			return
-		default:
 		}
-		if err != nil {
-			if rsp != nil {
-				rsp.Body.Close()
+		if gridAttempts >= int(policy.MaxAttempts) {
+			if recreated >= policy.Recreate {
+				failed(fmt.Sprintf("Session could not be created after %d attempt(s): %s", i, reason))
+				return
 			}
-			log.Printf("Session failed %s", err)
+			recreated++
+			log.Warnf("Recreating grid after %d failed attempt(s)", gridAttempts)
 			startedGrid.Cancel()
-			utils.JsonError(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if rsp.StatusCode == http.StatusNotFound {
+			next, err := gridStarter.StartWithCancel(startCtx)
+			if err != nil {
+				if startCtx.Err() != nil {
+					log.Warnf("Session creation cancelled - %.2fs", utils.SecondsSince(sessionStartTime))
+					events.publish(lib.EventSessionFailed, "Session creation cancelled", nil)
+					return
+				}
+				msg := fmt.Sprintf("Grid could not be recreated: %v", err)
+				log.Errorf("Session failed: %s", msg)
+				events.publish(lib.EventSessionFailed, msg, nil)
+				utils.WebDriverError(w, "session not created", msg, http.StatusInternalServerError)
+				return
+			}
+			startedGrid, gridAttempts = next, 0
+			events.event.Instance = startedGrid.Name
+			events.publish(lib.EventGridStarted, "", nil)
 			continue
 		}
-		resp = rsp
-		break
+		delay := policy.Delay(gridAttempts)
+		log.Debugf("Retrying in %v", delay)
+		select {
+		case <-startCtx.Done():
+			cancelled()
+			return
+		case <-time.After(delay):
+		}
 	}
 	defer resp.Body.Close()
 	var reply map[string]interface{}
@@ -134,28 +266,37 @@ func (h SessionHandler) Create(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	log.Printf("Session ID: %s", sessionID)
+	log = log.With(logger.SessionID, sessionID)
+	span.SetAttribute("sersan.session_id", sessionID)
+	span.SetAttribute("sersan.attempts", i)
+	log.Debugf("Session ID: %s", sessionID)
+	gridHost, gridPort := lib.SplitHostPort(startedGrid.URL)
 	sessionInfo := &utils.SessionInfo{
 		SessionID:   sessionID,
 		ServiceName: startedGrid.Name,
-		Host:        startedGrid.URL.Hostname(),
-		Port:        startedGrid.URL.Port(),
+		ServiceUID:  startedGrid.UID,
+		Scheme:      startedGrid.URL.Scheme,
+		Host:        gridHost,
+		Port:        gridPort,
 		BaseURL:     startedGrid.Grid.Grid.BaseURL,
-		VNCPort:     fmt.Sprintf("%d", startedGrid.Grid.Grid.VNCPort),
+		VNCPort:     startedGrid.VNCPort,
 		Engine:      startedGrid.Grid.Grid.Engine,
-	}
-	proxy := &httputil.ReverseProxy{
-		Transport: h.TunedTransport,
+		Grid:        startedGrid.Grid.Key(),
+		Owner:       user,
+		RequestID:   requestID,
+		Created:     time.Now().Unix(),
+		Lifetime:    startedGrid.Grid.Lifetime(),
+		IdleTimeout: browser.Caps.NewCommandTimeout,
 	}
 	cacheInfo := &utils.CachedInfo{
 		Session: sessionInfo,
-		Proxy:   proxy,
 	}
 
-	formattedSessionID, err := utils.GenerateSessionID(sessionInfo)
+	formattedSessionID, err := utils.GenerateSessionID(sessionInfo, h.Config.SigningKey)
 	h.Cache.Set(formattedSessionID, cacheInfo, cache.DefaultExpiration)
 	if err != nil {
-		log.Printf("Failed to get formatted session id: %v", err)
+		log.Errorf("Failed to get formatted session id: %v", err)
+		events.publish(lib.EventSessionFailed, fmt.Sprintf("Failed to get formatted session id: %v", err), nil)
 		return
 	}
 	reply["sessionId"] = formattedSessionID
@@ -176,7 +317,7 @@ func (h SessionHandler) Create(w http.ResponseWriter, r *http.Request) {
 	location := resp.Header.Get("Location")
 	if location != "" {
 		l, err := url.Parse(location)
-		log.Printf("Location: %v", l)
+		log.Debugf("Location: %v", l)
 		if err == nil {
 			fragments := strings.Split(l.Path, slash)
 			s.ID = fragments[len(fragments)-1]
@@ -195,60 +336,300 @@ func (h SessionHandler) Create(w http.ResponseWriter, r *http.Request) {
 		if s.ID == "" {
 			s.ID = sessionID
 		}
-		log.Printf("Location empty %v", s.Value.ID)
+		log.Debugf("Location empty %v", s.Value.ID)
 	}
 	if s.ID == "" {
-		log.Printf("Session failed %s", resp.Status)
+		log.Errorf("Session failed %s", resp.Status)
 		startedGrid.Cancel()
+		events.publish(lib.EventSessionFailed, "Session failed "+resp.Status, nil)
 		return
 	}
+	events.event.SessionID = formattedSessionID
+	h.Sessions.Add(formattedSessionID, sessionInfo, remote, time.Duration(sessionInfo.Lifetime)*time.Second)
+	events.event.Attempts = i
+	events.publish(lib.EventSessionCreated, "", resolvedCaps(reply))
 
-	log.Printf("Session created with id %s %d in %.2fs", s.ID, i, utils.SecondsSince(sessionStartTime))
+	log.Infof("Session created after %d attempt(s) in %.2fs", i, utils.SecondsSince(sessionStartTime))
 }
 
-// Proxy Handler for all incoming request other than new session
+// Proxy Handler for all incoming request other than new session. Commands
+// are streamed to the grid of the session and fail with invalid session id
+// once the grid is gone.
 func (h SessionHandler) Proxy(w http.ResponseWriter, r *http.Request) {
-	done := make(chan func())
 	fragments := strings.Split(r.URL.Path, slash)
 	sessionID := fragments[2]
-	var sessionInfo *utils.SessionInfo
-	var proxy *httputil.ReverseProxy
-	cachedInfo, found := h.Cache.Get(sessionID)
-	if found {
-		log.Printf("Found cached session ID %s", sessionID)
-		sessionInfo = cachedInfo.(*utils.CachedInfo).Session
-		proxy = cachedInfo.(*utils.CachedInfo).Proxy
-	} else {
-		log.Printf("Parse session ID %s", sessionID)
-		s, err := utils.ParseSessionID(sessionID)
-		if err != nil {
-			log.Printf("Invalid session ID %s", sessionID)
-		}
-		sessionInfo = s
-		proxy = &httputil.ReverseProxy{
-			Transport: h.TunedTransport,
-		}
+	user, _ := utils.RequestInfo(r)
+	log := logger.With(logger.User, user)
+	ctx, span := tracing.StartKind(tracing.Extract(r), "Proxy", tracing.KindServer)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("webdriver.command", "/"+strings.Join(fragments[3:], slash))
+	if sc := span.Context; sc.Valid() {
+		log = log.With(logger.TraceID, sc.TraceIDString())
+	}
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	defer rec.endSpan(span)
+	if reason, ended := h.Sessions.Ended(sessionID); ended {
+		log.Warnf("Command of %s session refused", reason)
+		utils.WebDriverError(w, "invalid session id", fmt.Sprintf("Session is lost, it was %s", reason), http.StatusNotFound)
+		return
+	}
+	sessionInfo := h.sessionInfo(sessionID, log)
+	if sessionInfo == nil {
+		utils.WebDriverError(w, "invalid session id", "Session ID is invalid", http.StatusNotFound)
+		return
 	}
-	go func(w http.ResponseWriter, r *http.Request) {
-		cancel := func() {}
-		defer func() {
-			done <- cancel
-		}()
-		proxy.Director = func(r *http.Request) {
+	log = log.WithFields(logger.Fields{logger.SessionID: sessionInfo.SessionID, logger.Instance: sessionInfo.ServiceName})
+	span.SetAttribute("sersan.session_id", sessionInfo.SessionID)
+	span.SetAttribute("sersan.instance", sessionInfo.ServiceName)
+	// The address of a deleted grid may have been given to another grid
+	if h.SessionService.GridGone(ctx, sessionInfo) {
+		h.gridLost(w, sessionID, sessionInfo, log)
+		return
+	}
+	// Session IDs issued before the lifetime claim existed live as long as
+	// the default grid lifetime
+	lifetime := sessionInfo.Lifetime
+	if lifetime <= 0 {
+		lifetime = h.Config.GridTimeout
+	}
+	h.Sessions.Touch(sessionID, sessionInfo, time.Duration(lifetime)*time.Second)
+
+	clientCtx := ctx
+	if h.Config.CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(h.Config.CommandTimeout)*time.Millisecond)
+		defer cancel()
+	}
+	proxy := &httputil.ReverseProxy{
+		Transport:  h.TunedTransport,
+		BufferPool: proxyBuffers,
+		Director: func(r *http.Request) {
 			fragments[2] = sessionInfo.SessionID
 			r.URL.Path = path.Join(sessionInfo.BaseURL+slash, strings.Join(fragments, slash))
-			r.URL.Host = sessionInfo.Host + ":" + sessionInfo.Port
-		}
-		proxy.ServeHTTP(w, r)
-		if r.Method == http.MethodDelete && len(fragments) == 3 {
-			defer func() {
-				err := h.SessionService.Delete(sessionInfo.ServiceName, sessionInfo.Engine)
-				if err != nil {
-					log.Printf("Unable to delete pod %s", sessionInfo.ServiceName)
+			r.URL.Scheme = sessionInfo.Scheme
+			r.URL.Host = net.JoinHostPort(sessionInfo.Host, sessionInfo.Port)
+			r.Host = r.URL.Host
+			tracing.Inject(r.Context(), r.Header)
+			if sessionInfo.Engine == lib.RemoteType {
+				if upstreamUser := lib.UpstreamUser(r.URL.Host); upstreamUser != nil {
+					password, _ := upstreamUser.Password()
+					r.SetBasicAuth(upstreamUser.Username(), password)
 				}
-				log.Printf("Grid %s was deleted", sessionInfo.ServiceName)
-			}()
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			switch {
+			case clientCtx.Err() != nil:
+				log.Debugf("Command cancelled by the client: %v", err)
+			case ctx.Err() == context.DeadlineExceeded:
+				msg := fmt.Sprintf("Command timed out after %d ms", h.Config.CommandTimeout)
+				log.Warnf("%s", msg)
+				utils.WebDriverError(w, "timeout", msg, http.StatusInternalServerError)
+			case h.SessionService.Preempted(clientCtx, sessionInfo.ServiceName, sessionInfo.Engine):
+				log.Errorf("Proxy failed: %v", err)
+				h.Sessions.End(sessionID, "preempted")
+				h.SessionService.Delete(sessionInfo.ServiceName, sessionInfo.Engine)
+				h.EventBus.Publish(lib.EndedEvent(lib.EventSessionReaped, sessionID, sessionInfo, "preempted"))
+				msg := fmt.Sprintf("Session is lost, grid %s was preempted", sessionInfo.ServiceName)
+				utils.WebDriverError(w, "invalid session id", msg, http.StatusNotFound)
+			case h.SessionService.GridGone(clientCtx, sessionInfo):
+				log.Errorf("Proxy failed: %v", err)
+				h.gridLost(w, sessionID, sessionInfo, log)
+			default:
+				log.Errorf("Proxy failed: %v", err)
+				msg := fmt.Sprintf("Grid %s is unreachable: %v", sessionInfo.ServiceName, err)
+				utils.WebDriverError(w, "unknown error", msg, http.StatusBadGateway)
+			}
+		},
+	}
+	proxy.ServeHTTP(w, r.WithContext(ctx))
+	if r.Method == http.MethodDelete && len(fragments) == 3 {
+		h.Sessions.Remove(sessionID)
+		err := h.SessionService.Delete(sessionInfo.ServiceName, sessionInfo.Engine)
+		if err != nil {
+			log.Errorf("Unable to delete grid: %v", err)
 		}
-	}(w, r)
-	go (<-done)()
+		log.Infof("Grid was deleted")
+		h.EventBus.Publish(lib.EndedEvent(lib.EventSessionDeleted, sessionID, sessionInfo, ""))
+	}
+}
+
+// sessionInfo Grid of the session, from the cache or else from the signed
+// session ID. It is nil when the session ID is invalid.
+func (h SessionHandler) sessionInfo(sessionID string, log *logger.Entry) *utils.SessionInfo {
+	if cachedInfo, found := h.Cache.Get(sessionID); found {
+		log.Debugf("Found cached session ID %s", sessionID)
+		return cachedInfo.(*utils.CachedInfo).Session
+	}
+	log.Debugf("Parse session ID %s", sessionID)
+	sessionInfo, err := utils.ParseSessionID(sessionID, h.Config.SigningKey)
+	if err != nil {
+		log.Warnf("Invalid session ID %s", sessionID)
+		return nil
+	}
+	return sessionInfo
+}
+
+// gridLost Refuse the command of a session whose grid is gone. The grid is
+// not deleted, as its name may now belong to another grid.
+func (h SessionHandler) gridLost(w http.ResponseWriter, sessionID string, sessionInfo *utils.SessionInfo, log *logger.Entry) {
+	log.Warnf("Grid of the session is gone")
+	h.Sessions.End(sessionID, "deleted")
+	h.EventBus.Publish(lib.EndedEvent(lib.EventSessionReaped, sessionID, sessionInfo, "deleted"))
+	msg := fmt.Sprintf("Session is lost, grid %s is gone", sessionInfo.ServiceName)
+	utils.WebDriverError(w, "invalid session id", msg, http.StatusNotFound)
+}
+
+// sessionEvents Lifecycle events of a new session request
+type sessionEvents struct {
+	bus     *lib.EventBus
+	start   time.Time
+	timings *tracing.Timings
+	event   lib.Event
+}
+
+// publish Publish the event of the request so far, with the time since the
+// session was requested
+func (e *sessionEvents) publish(eventType string, reason string, caps json.RawMessage) {
+	event := e.event
+	event.Type = eventType
+	event.Reason = reason
+	event.Caps = caps
+	event.Duration = utils.SecondsSince(e.start)
+	if eventType != lib.EventSessionRequested {
+		event.Phases = e.timings.Seconds()
+	}
+	e.bus.Publish(event)
+}
+
+// requestedCaps Capabilities of a new session request body
+func requestedCaps(body []byte) json.RawMessage {
+	var request struct {
+		Capabilities        json.RawMessage `json:"capabilities"`
+		DesiredCapabilities json.RawMessage `json:"desiredCapabilities"`
+	}
+	json.Unmarshal(body, &request)
+	if len(request.Capabilities) > 0 {
+		return request.Capabilities
+	}
+	return request.DesiredCapabilities
+}
+
+// resolvedCaps Capabilities of a new session response
+func resolvedCaps(reply map[string]interface{}) json.RawMessage {
+	caps := reply["capabilities"]
+	if value, ok := reply["value"].(map[string]interface{}); ok && value["capabilities"] != nil {
+		caps = value["capabilities"]
+	}
+	if caps == nil {
+		return nil
+	}
+	buf, _ := json.Marshal(caps)
+	return buf
+}
+
+// statusRecorder Response writer remembering the response status, used to
+// end the request span
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// Flush Flush streamed responses to the client
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// endSpan End the request span, failed on server errors
+func (rec *statusRecorder) endSpan(span *tracing.Span) {
+	var err error
+	if rec.status != 0 {
+		span.SetAttribute("http.status_code", rec.status)
+	}
+	if rec.status >= http.StatusInternalServerError {
+		err = fmt.Errorf("%d %s", rec.status, http.StatusText(rec.status))
+	}
+	span.End(err)
+}
+
+// newSessionAttempt Post the new session request to the grid. The attempt
+// times out after the policy attempt timeout. Failed attempts return the
+// error class, and the response body must be closed otherwise.
+func newSessionAttempt(ctx context.Context, startedGrid *lib.StartedGrid, body []byte, attempt int, policy lib.RetryPolicy) (*http.Response, string, error) {
+	u := &url.URL{Scheme: startedGrid.URL.Scheme, Host: startedGrid.URL.Host, Path: startedGrid.Grid.Grid.BaseURL + "/session"}
+	logger.FromContext(ctx).Debugf("Request URL: %s", u)
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	if upstreamUser := startedGrid.URL.User; upstreamUser != nil {
+		password, _ := upstreamUser.Password()
+		req.SetBasicAuth(upstreamUser.Username(), password)
+	}
+	attemptCtx, span := tracing.StartKind(ctx, "NewSessionAttempt", tracing.KindClient)
+	span.SetAttribute("sersan.attempt", attempt)
+	span.SetAttribute("sersan.instance", startedGrid.Name)
+	tracing.Inject(attemptCtx, req.Header)
+	attemptCtx, cancel := context.WithTimeout(attemptCtx, time.Duration(policy.AttemptTimeout)*time.Millisecond)
+	logger.FromContext(ctx).Infof("Session attempt %d to %s", attempt, startedGrid.URL.Hostname())
+	rsp, err := httpClient.Do(req.WithContext(attemptCtx))
+	endAttempt(span, rsp, err)
+	if err != nil {
+		cancel()
+		if attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			return nil, lib.RetryTimeout, fmt.Errorf("Session attempt timed out after %d ms", policy.AttemptTimeout)
+		}
+		return nil, lib.RetryConnection, err
+	}
+	rsp.Body = &cancelBody{ReadCloser: rsp.Body, cancel: cancel}
+	return rsp, "", nil
+}
+
+// attemptFailure Reason why a new session attempt failed, either its error
+// or the status of the grid response
+func attemptFailure(rsp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return rsp.Status
+}
+
+// cancelBody Response body releasing the request context once closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// endAttempt End the span of a new session attempt
+func endAttempt(span *tracing.Span, rsp *http.Response, err error) {
+	if rsp != nil {
+		span.SetAttribute("http.status_code", rsp.StatusCode)
+		if err == nil && rsp.StatusCode >= http.StatusInternalServerError {
+			err = fmt.Errorf("%s", rsp.Status)
+		}
+	}
+	span.End(err)
 }
@@ -0,0 +1,401 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/domain/app"
+	"github.com/salestock/sersan/lib"
+	"github.com/salestock/sersan/utils"
+)
+
+// testHub Session handler running on fake grids
+type testHub struct {
+	*httptest.Server
+	Handler *SessionHandler
+}
+
+func newTestHub(fake *lib.FakeConfig, configure func(conf *config.Config)) *testHub {
+	conf := config.Get()
+	conf.SigningKey = "test_key"
+	conf.RetryCount = 3
+	if configure != nil {
+		configure(&conf)
+	}
+	gridConfig := &lib.GridConfig{Grids: map[string]lib.Versions{
+		"fake": {
+			Default: "1.0",
+			Versions: map[string]*lib.Grid{
+				"1.0": {Engine: lib.FakeType, BaseURL: "/wd/hub", EngineConfig: fake},
+			},
+		},
+	}}
+	handler := &SessionHandler{
+		Config:         &conf,
+		SessionService: &SessionService{GridConfig: gridConfig},
+		AppService:     &app.AppService{},
+		TunedTransport: &http.Transport{},
+		Cache:          cache.New(time.Minute, time.Minute),
+		StartTracker:   &lib.StartTracker{},
+		EventBus:       &lib.EventBus{},
+		Sessions:       &lib.SessionRegistry{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/session", handler.Create)
+	mux.HandleFunc("/session/", handler.Proxy)
+	return &testHub{Server: httptest.NewServer(mux), Handler: handler}
+}
+
+func (hub *testHub) do(t *testing.T, method string, path string, body string) (int, map[string]interface{}) {
+	req, err := http.NewRequest(method, hub.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var reply map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	return resp.StatusCode, reply
+}
+
+// newSession Create a session and return its Sersan session ID and grid
+func (hub *testHub) newSession(t *testing.T) (string, *lib.FakeGrid) {
+	status, reply := hub.do(t, http.MethodPost, "/session", `{"capabilities":{"alwaysMatch":{"browserName":"fake"}}}`)
+	if status != http.StatusOK {
+		t.Fatalf("New session returned %d: %v", status, reply)
+	}
+	sessionID, _ := reply["value"].(map[string]interface{})["sessionId"].(string)
+	info, err := utils.ParseSessionID(sessionID, hub.Handler.Config.SigningKey)
+	if err != nil {
+		t.Fatalf("Invalid session ID %s: %v", sessionID, err)
+	}
+	grid, ok := lib.GetFakeClient().Grid(info.ServiceName)
+	if !ok {
+		t.Fatalf("Grid %s of the session is not running", info.ServiceName)
+	}
+	return sessionID, grid
+}
+
+func TestCreateProxyDelete(t *testing.T) {
+	hub := newTestHub(&lib.FakeConfig{}, nil)
+	defer hub.Close()
+	sessionID, grid := hub.newSession(t)
+
+	status, _ := hub.do(t, http.MethodPost, "/session/"+sessionID+"/url", `{"url":"https://example.com"}`)
+	if status != http.StatusOK {
+		t.Fatalf("Command returned %d", status)
+	}
+	if commands := grid.Commands(); len(commands) != 1 || commands[0] != "POST /url" {
+		t.Errorf("Grid received %v, want [POST /url]", commands)
+	}
+
+	status, _ = hub.do(t, http.MethodDelete, "/session/"+sessionID, "")
+	if status != http.StatusOK {
+		t.Fatalf("Delete session returned %d", status)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := lib.GetFakeClient().Grid(grid.Name); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Grid %s was not deleted with the session", grid.Name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCreateKeepsNewCommandTimeout(t *testing.T) {
+	hub := newTestHub(&lib.FakeConfig{}, nil)
+	defer hub.Close()
+	status, _ := hub.do(t, http.MethodPost, "/session", `{"capabilities":{"alwaysMatch":{"browserName":"fake","appium:options":{"newCommandTimeout":120}}}}`)
+	if status != http.StatusOK {
+		t.Fatalf("New session returned %d", status)
+	}
+	// Sessions idle for longer are ended by the admin reaper
+	sessions := hub.Handler.Sessions.List()
+	for _, session := range sessions {
+		defer lib.GetFakeClient().DeleteGrid(session.Instance)
+	}
+	if len(sessions) != 1 || sessions[0].Info.IdleTimeout != 120 {
+		t.Errorf("Live sessions %+v, want one with an idle timeout of 120 seconds", sessions)
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+	hub := newTestHub(&lib.FakeConfig{}, nil)
+	defer hub.Close()
+	events, unsubscribe := hub.Handler.EventBus.Subscribe(10)
+	defer unsubscribe()
+	sessionID, _ := hub.newSession(t)
+	hub.do(t, http.MethodDelete, "/session/"+sessionID, "")
+
+	want := []string{lib.EventSessionRequested, lib.EventGridStarted, lib.EventSessionCreated, lib.EventSessionDeleted}
+	for _, eventType := range want {
+		select {
+		case event := <-events:
+			if event.Type != eventType {
+				t.Fatalf("Event %s, want %s", event.Type, eventType)
+			}
+			if eventType == lib.EventSessionDeleted && (event.SessionID != sessionID || event.Grid != "fake-1.0") {
+				t.Errorf("Unexpected deleted event %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Event %s was not published", eventType)
+		}
+	}
+}
+
+func TestEndedSessionRefusesCommands(t *testing.T) {
+	hub := newTestHub(&lib.FakeConfig{}, nil)
+	defer hub.Close()
+	sessionID, grid := hub.newSession(t)
+	defer lib.GetFakeClient().DeleteGrid(grid.Name)
+
+	hub.do(t, http.MethodGet, "/session/"+sessionID+"/title", "")
+	live, err := hub.Handler.Sessions.Find(sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live.Instance != grid.Name || live.Commands != 1 {
+		t.Errorf("Unexpected live session %+v", live)
+	}
+
+	hub.Handler.Sessions.End(sessionID, "terminated")
+	status, reply := hub.do(t, http.MethodGet, "/session/"+sessionID+"/title", "")
+	value, _ := reply["value"].(map[string]interface{})
+	if status != http.StatusNotFound || value["error"] != "invalid session id" {
+		t.Errorf("Command of terminated session returned %d: %v", status, reply)
+	}
+	if commands := grid.Commands(); len(commands) != 1 {
+		t.Errorf("Grid received %v after the session was terminated", commands)
+	}
+	if sessions := hub.Handler.Sessions.List(); len(sessions) != 0 {
+		t.Errorf("Terminated session still listed: %+v", sessions)
+	}
+}
+
+func TestProxyRoutesUncachedSessionID(t *testing.T) {
+	hub := newTestHub(&lib.FakeConfig{}, nil)
+	defer hub.Close()
+	sessionID, grid := hub.newSession(t)
+	defer lib.GetFakeClient().DeleteGrid(grid.Name)
+
+	// Another replica only has the signed session ID to route on
+	hub.Handler.Cache.Flush()
+	status, _ := hub.do(t, http.MethodGet, "/session/"+sessionID+"/title", "")
+	if status != http.StatusOK {
+		t.Fatalf("Command returned %d", status)
+	}
+	if commands := grid.Commands(); len(commands) != 1 || commands[0] != "GET /title" {
+		t.Errorf("Grid received %v, want [GET /title]", commands)
+	}
+}
+
+func TestProxyInvalidSessionID(t *testing.T) {
+	hub := newTestHub(&lib.FakeConfig{}, nil)
+	defer hub.Close()
+	status, reply := hub.do(t, http.MethodGet, "/session/not-a-session/title", "")
+	value, _ := reply["value"].(map[string]interface{})
+	if status != http.StatusNotFound || value["error"] != "invalid session id" {
+		t.Errorf("Command of invalid session returned %d: %v", status, reply)
+	}
+}
+
+func TestProxyGridGone(t *testing.T) {
+	hub := newTestHub(&lib.FakeConfig{}, nil)
+	defer hub.Close()
+	sessionID, grid := hub.newSession(t)
+	lib.GetFakeClient().DeleteGrid(grid.Name)
+
+	for _, want := range []string{"is gone", "it was deleted"} {
+		status, reply := hub.do(t, http.MethodGet, "/session/"+sessionID+"/title", "")
+		value, _ := reply["value"].(map[string]interface{})
+		message, _ := value["message"].(string)
+		if status != http.StatusNotFound || value["error"] != "invalid session id" || !strings.Contains(message, want) {
+			t.Errorf("Command of lost session returned %d: %v", status, reply)
+		}
+	}
+}
+
+func TestProxyCommandTimeout(t *testing.T) {
+	hub := newTestHub(&lib.FakeConfig{CommandDelay: 2000}, func(conf *config.Config) {
+		conf.CommandTimeout = 100
+	})
+	defer hub.Close()
+	sessionID, grid := hub.newSession(t)
+	defer lib.GetFakeClient().DeleteGrid(grid.Name)
+
+	status, reply := hub.do(t, http.MethodGet, "/session/"+sessionID+"/title", "")
+	value, _ := reply["value"].(map[string]interface{})
+	if status != http.StatusInternalServerError || value["error"] != "timeout" {
+		t.Errorf("Slow command returned %d: %v", status, reply)
+	}
+}
+
+func TestCreateRetriesSlowNewSession(t *testing.T) {
+	fake := &lib.FakeConfig{SlowNewSessions: 1, NewSessionDelay: 2000}
+	hub := newTestHub(fake, func(conf *config.Config) {
+		conf.NewSessionAttemptTimeout = 200
+	})
+	defer hub.Close()
+	start := time.Now()
+	_, grid := hub.newSession(t)
+	defer lib.GetFakeClient().DeleteGrid(grid.Name)
+	if elapsed := time.Since(start); elapsed >= 2*time.Second {
+		t.Errorf("New session took %v, the slow attempt was not retried", elapsed)
+	}
+}
+
+func TestCreateStartError(t *testing.T) {
+	hub := newTestHub(&lib.FakeConfig{StartError: lib.ErrorCapacity}, nil)
+	defer hub.Close()
+	status, reply := hub.do(t, http.MethodPost, "/session", `{"desiredCapabilities":{"browserName":"fake"}}`)
+	if status != http.StatusInternalServerError {
+		t.Fatalf("New session returned %d, want %d", status, http.StatusInternalServerError)
+	}
+	value, _ := reply["value"].(map[string]interface{})
+	if value["error"] != "session not created" || !strings.Contains(value["message"].(string), "(capacity)") {
+		t.Errorf("Unexpected error %v", value)
+	}
+}
+
+func TestCreateRoutesAppiumCaps(t *testing.T) {
+	hub := newTestHub(&lib.FakeConfig{}, nil)
+	defer hub.Close()
+	hub.Handler.SessionService.GridConfig.Grids["android"] = lib.Versions{
+		Default: "8.1",
+		Versions: map[string]*lib.Grid{
+			"8.1": {Engine: lib.FakeType, EngineConfig: &lib.FakeConfig{}},
+			"9.0": {Engine: lib.FakeType, EngineConfig: &lib.FakeConfig{}},
+		},
+	}
+	for _, request := range []string{
+		`{"capabilities":{"alwaysMatch":{"platformName":"Android","appium:platformVersion":"9"}}}`,
+		`{"capabilities":{"alwaysMatch":{"platformName":"Android"},"firstMatch":[{"appium:options":{"platformVersion":"9","deviceName":"Pixel 3"}}]}}`,
+		`{"capabilities":{"alwaysMatch":{"browserName":"chrome","appium:options":{"platformName":"Android","platformVersion":"9"}}}}`,
+	} {
+		status, reply := hub.do(t, http.MethodPost, "/session", request)
+		if status != http.StatusOK {
+			t.Errorf("New session %s returned %d: %v", request, status, reply)
+			continue
+		}
+		sessionID, _ := reply["value"].(map[string]interface{})["sessionId"].(string)
+		info, err := utils.ParseSessionID(sessionID, hub.Handler.Config.SigningKey)
+		if err != nil {
+			t.Fatalf("Invalid session ID %s: %v", sessionID, err)
+		}
+		lib.GetFakeClient().DeleteGrid(info.ServiceName)
+		if info.Grid != "android-9.0" {
+			t.Errorf("New session %s ran on %s, want android-9.0", request, info.Grid)
+		}
+	}
+}
+
+func TestCreateUnknownGrid(t *testing.T) {
+	hub := newTestHub(&lib.FakeConfig{}, nil)
+	defer hub.Close()
+	// Apps of sessions no grid can serve are not fetched, which would fail
+	// as CALLBACK_URL is unset
+	hub.Handler.AppService = &app.AppService{Config: hub.Handler.Config}
+	for _, request := range []string{
+		`{"desiredCapabilities":{"browserName":"opera"}}`,
+		`{"desiredCapabilities":{"browserName":"opera","app":"` + lib.AppScheme + strings.Repeat("0", 64) + `"}}`,
+	} {
+		status, _ := hub.do(t, http.MethodPost, "/session", request)
+		if status != http.StatusBadRequest {
+			t.Errorf("New session %s returned %d, want %d", request, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestCreateWhileDraining(t *testing.T) {
+	hub := newTestHub(&lib.FakeConfig{}, nil)
+	defer hub.Close()
+	hub.Handler.StartTracker.Close()
+	req, _ := http.NewRequest(http.MethodPost, hub.URL+"/session", bytes.NewBufferString(`{"desiredCapabilities":{"browserName":"fake"}}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("New session returned %d with Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestCreateGivesUpAfterMaxAttempts(t *testing.T) {
+	fake := &lib.FakeConfig{UnavailableGrids: 1}
+	hub := newTestHub(fake, nil)
+	defer hub.Close()
+	hub.Handler.SessionService.GridConfig.Grids["fake"].Versions["1.0"].Retry = &lib.RetryPolicy{MaxAttempts: 2, Backoff: 10}
+	status, reply := hub.do(t, http.MethodPost, "/session", `{"desiredCapabilities":{"browserName":"fake"}}`)
+	if status != http.StatusInternalServerError {
+		t.Fatalf("New session returned %d, want %d", status, http.StatusInternalServerError)
+	}
+	value, _ := reply["value"].(map[string]interface{})
+	if message, _ := value["message"].(string); !strings.Contains(message, "after 2 attempt(s)") {
+		t.Errorf("Unexpected error %v", value)
+	}
+}
+
+func TestCreateRecreatesBrokenGrid(t *testing.T) {
+	fake := &lib.FakeConfig{UnavailableGrids: 1}
+	hub := newTestHub(fake, nil)
+	defer hub.Close()
+	hub.Handler.SessionService.GridConfig.Grids["fake"].Versions["1.0"].Retry = &lib.RetryPolicy{MaxAttempts: 2, Backoff: 10, Recreate: 1}
+	_, grid := hub.newSession(t)
+	defer lib.GetFakeClient().DeleteGrid(grid.Name)
+	if grid.Sessions() != 1 {
+		t.Errorf("Recreated grid has %d sessions, want 1", grid.Sessions())
+	}
+}
+
+func TestCreateFailsOverServerError(t *testing.T) {
+	var broken int32
+	brokenUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&broken, 1)
+		utils.WebDriverError(w, "session not created", "Upstream failure", http.StatusInternalServerError)
+	}))
+	defer brokenUpstream.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"value": map[string]interface{}{"sessionId": "upstream-session"}})
+	}))
+	defer upstream.Close()
+
+	hub := newTestHub(&lib.FakeConfig{}, nil)
+	defer hub.Close()
+	hub.Handler.SessionService.GridConfig.Grids["remote"] = lib.Versions{
+		Default: "1.0",
+		Versions: map[string]*lib.Grid{"1.0": {Engine: lib.RemoteType, EngineConfig: &lib.RemoteConfig{Upstreams: []lib.Upstream{
+			{URL: brokenUpstream.URL + "/wd/hub"},
+			{URL: upstream.URL + "/wd/hub"},
+		}}}},
+	}
+	// Whichever upstream is chosen first, the broken one is failed over
+	for i := 0; i < 2; i++ {
+		status, reply := hub.do(t, http.MethodPost, "/session", `{"desiredCapabilities":{"browserName":"remote"}}`)
+		if status != http.StatusOK {
+			t.Fatalf("New session returned %d: %v", status, reply)
+		}
+		sessionID, _ := reply["value"].(map[string]interface{})["sessionId"].(string)
+		info, err := utils.ParseSessionID(sessionID, hub.Handler.Config.SigningKey)
+		if err != nil || info.SessionID != "upstream-session" {
+			t.Errorf("Session %+v (%v), want the session of the working upstream", info, err)
+		}
+	}
+	if broken := atomic.LoadInt32(&broken); broken != 1 {
+		t.Errorf("Broken upstream got %d requests, want 1 before it is skipped", broken)
+	}
+}
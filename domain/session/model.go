@@ -1,6 +1,7 @@
 package session
 
 import (
+	"encoding/json"
 	"net/url"
 
 	"github.com/salestock/sersan/lib"
@@ -15,7 +16,36 @@ type Session struct {
 // Browser browser
 type Browser struct {
 	Caps    lib.Caps `json:"desiredCapabilities"`
-	W3CCaps struct {
-		Caps lib.Caps `json:"alwaysMatch"`
-	} `json:"capabilities"`
+	W3CCaps W3CCaps  `json:"capabilities"`
+}
+
+// W3CCaps W3C capabilities. The first firstMatch entry, if any, is merged
+// into alwaysMatch.
+type W3CCaps struct {
+	Caps lib.Caps
+}
+
+// UnmarshalJSON Merge alwaysMatch and the first firstMatch entry
+func (w *W3CCaps) UnmarshalJSON(data []byte) error {
+	var caps struct {
+		AlwaysMatch map[string]json.RawMessage   `json:"alwaysMatch"`
+		FirstMatch  []map[string]json.RawMessage `json:"firstMatch"`
+	}
+	if err := json.Unmarshal(data, &caps); err != nil {
+		return err
+	}
+	merged := make(map[string]json.RawMessage)
+	for key, value := range caps.AlwaysMatch {
+		merged[key] = value
+	}
+	if len(caps.FirstMatch) > 0 {
+		for key, value := range caps.FirstMatch[0] {
+			merged[key] = value
+		}
+	}
+	buf, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, &w.Caps)
 }
@@ -1,24 +1,68 @@
 package session
 
 import (
+	"context"
+
 	"github.com/salestock/sersan/lib"
+	"github.com/salestock/sersan/logger"
+	"github.com/salestock/sersan/utils"
 )
 
 // SessionService Session service
 type SessionService struct {
+	GridConfig *lib.GridConfig `inject:""`
 }
 
 // Create Create session
-func (s SessionService) Create(browser *Browser) (lib.GridStarter, bool) {
-	gridConfig := lib.GetGridConfig()
-	manager := &lib.DefaultManager{GridConfig: gridConfig}
-	return manager.Find(browser.Caps)
+func (s SessionService) Create(browser *Browser, owner string, requestID string) (lib.GridStarter, bool) {
+	manager := &lib.DefaultManager{GridConfig: s.GridConfig}
+	return manager.Find(browser.Caps, owner, requestID)
+}
+
+// Preempted Whether the grid of the session was preempted
+func (s SessionService) Preempted(ctx context.Context, name string, engine string) bool {
+	client, err := lib.GetEngineClient(engine)
+	if err != nil {
+		return false
+	}
+	checker, ok := client.(lib.PreemptionChecker)
+	if !ok {
+		return false
+	}
+	preempted, err := checker.Preempted(ctx, name)
+	if err != nil {
+		logger.FromContext(ctx).With(logger.Instance, name).Warnf("Unable to check preemption: %v", err)
+		return false
+	}
+	return preempted
+}
+
+// GridGone Whether the grid of the session is gone, or its address now
+// belongs to another grid. Grids of engines unable to tell are never gone.
+func (s SessionService) GridGone(ctx context.Context, info *utils.SessionInfo) bool {
+	client, err := lib.GetEngineClient(info.Engine)
+	if err != nil {
+		return false
+	}
+	verifier, ok := client.(lib.GridVerifier)
+	if !ok {
+		return false
+	}
+	alive, err := verifier.VerifyGrid(info.ServiceName, info.ServiceUID, info.Host)
+	if err != nil {
+		logger.FromContext(ctx).With(logger.Instance, info.ServiceName).Warnf("Unable to verify grid: %v", err)
+		return false
+	}
+	return !alive
 }
 
 // Delete Delete session
 func (s SessionService) Delete(name string, engine string) error {
-	client := lib.GetEngineClient(engine)
-	err := client.DeleteGrid(name)
+	client, err := lib.GetEngineClient(engine)
+	if err != nil {
+		return err
+	}
+	err = client.DeleteGrid(name)
 	if err != nil {
 		return err
 	}
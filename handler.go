@@ -1,7 +1,12 @@
 package main
 
 import (
+    "github.com/salestock/sersan/domain/admin"
+    "github.com/salestock/sersan/domain/app"
+    "github.com/salestock/sersan/domain/dashboard"
+    "github.com/salestock/sersan/domain/event"
     "github.com/salestock/sersan/domain/health"
+    "github.com/salestock/sersan/domain/history"
     "github.com/salestock/sersan/domain/session"
 )
 
@@ -9,4 +14,9 @@ import (
 type RootHandler struct {
     *session.SessionHandler `inject:""`
     *health.HealthHandler   `inject:""`
+    *app.AppHandler         `inject:""`
+    *event.EventHandler     `inject:""`
+    *history.HistoryHandler `inject:""`
+    *admin.AdminHandler     `inject:""`
+    *dashboard.DashboardHandler `inject:""`
 }
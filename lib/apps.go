@@ -0,0 +1,413 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/logger"
+)
+
+const (
+	// AppScheme Scheme of app capabilities referring to an uploaded app,
+	// e.g. sersan://apps/<id>
+	AppScheme = "sersan://apps/"
+
+	appCleanupInterval = time.Hour
+	appFetchTimeout    = 10 * time.Minute
+	// appSourceTTL How long an app downloaded without ETag nor Last-Modified
+	// is reused for its URL before being downloaded again
+	appSourceTTL = time.Minute
+)
+
+// appExtensions Extensions kept on cached files, Appium tells the app type
+// from the file extension
+var appExtensions = map[string]bool{
+	".apk": true,
+	".aab": true,
+	".ipa": true,
+	".zip": true,
+}
+
+// ErrAppNotFound App is not in the cache
+var ErrAppNotFound = errors.New("App not found")
+
+// AppCache Content addressed cache of app binaries. Apps are stored once
+// under their SHA-256 and deleted when unused for longer than the retention,
+// or when the least recently used once the cache is larger than TotalSize.
+// Apps missing from the cache are copied from the replicas having them.
+type AppCache struct {
+	Dir       string
+	Retention time.Duration
+	MaxSize   int64
+	TotalSize int64
+	Client    *http.Client
+	Peers     *Peers
+	lock      sync.Mutex
+	sources   map[string]appSource
+	fetching  map[string]*appFetch
+}
+
+// appSource App downloaded from a URL, with the validators the origin
+// answered to tell whether it changed since
+type appSource struct {
+	file         string
+	etag         string
+	lastModified string
+	fetched      time.Time
+}
+
+// appFetch Download of an app, shared by the sessions asking for it
+type appFetch struct {
+	done chan struct{}
+	file string
+	err  error
+}
+
+var appCache *AppCache
+var appCacheOnce sync.Once
+
+// GetAppCache Get app cache
+func GetAppCache() *AppCache {
+	appCacheOnce.Do(func() {
+		conf := config.Get()
+		appCache = &AppCache{
+			Dir:       conf.AppCacheDir,
+			Retention: time.Duration(conf.AppRetention) * time.Second,
+			MaxSize:   conf.AppMaxSize,
+			TotalSize: conf.AppCacheSize,
+			Client:    &http.Client{Timeout: appFetchTimeout},
+			Peers:     GetPeers(),
+		}
+		if err := os.MkdirAll(appCache.Dir, 0755); err != nil {
+			logger.Errorf("Failed to create app cache directory %s: %v", appCache.Dir, err)
+		}
+	})
+	return appCache
+}
+
+// Store Store the app read from r. The name is only used for its
+// extension. It returns the cached file name.
+func (ac *AppCache) Store(r io.Reader, name string) (string, error) {
+	tmp, err := ioutil.TempFile(ac.Dir, ".upload-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r, ac.MaxSize+1))
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	if n > ac.MaxSize {
+		return "", fmt.Errorf("App is larger than %d bytes", ac.MaxSize)
+	}
+
+	file := hex.EncodeToString(hash.Sum(nil))
+	if ext := strings.ToLower(path.Ext(name)); appExtensions[ext] {
+		file += ext
+	}
+	target := filepath.Join(ac.Dir, file)
+	if _, err := os.Stat(target); err == nil {
+		ac.touch(file)
+		return file, nil
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return "", err
+	}
+	logger.Infof("App cached - %s (%d bytes)", file, n)
+	ac.trim(file)
+	return file, nil
+}
+
+// Fetch Download the app at rawURL unless it is cached already. Apps the
+// origin gave validators for are revalidated on every fetch, others are
+// downloaded again after appSourceTTL. Concurrent fetches of the same URL
+// share one download.
+func (ac *AppCache) Fetch(ctx context.Context, rawURL string) (string, error) {
+	ac.lock.Lock()
+	source, ok := ac.sources[rawURL]
+	if ok && ac.touch(source.file) != nil {
+		delete(ac.sources, rawURL)
+		ok = false
+	}
+	if ok && source.etag == "" && source.lastModified == "" && time.Since(source.fetched) < appSourceTTL {
+		ac.lock.Unlock()
+		return source.file, nil
+	}
+	ac.lock.Unlock()
+	var cached *appSource
+	if ok {
+		cached = &source
+	}
+	return ac.share(ctx, rawURL, func() (string, error) {
+		return ac.fetch(rawURL, cached)
+	})
+}
+
+func (ac *AppCache) fetch(rawURL string, cached *appSource) (string, error) {
+	logger.Infof("Fetching app %s", redactURL(rawURL))
+	source, err := ac.download(rawURL, cached)
+	if err != nil {
+		logger.Errorf("Failed to fetch app %s: %v", redactURL(rawURL), err)
+		return "", err
+	}
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	if ac.sources == nil {
+		ac.sources = make(map[string]appSource)
+	}
+	ac.sources[rawURL] = source
+	return source.file, nil
+}
+
+// share Run download once for the concurrent callers asking for the same key
+func (ac *AppCache) share(ctx context.Context, key string, download func() (string, error)) (string, error) {
+	ac.lock.Lock()
+	if ac.fetching == nil {
+		ac.fetching = make(map[string]*appFetch)
+	}
+	fetch, ok := ac.fetching[key]
+	if !ok {
+		fetch = &appFetch{done: make(chan struct{})}
+		ac.fetching[key] = fetch
+		go func() {
+			defer close(fetch.done)
+			fetch.file, fetch.err = download()
+			ac.lock.Lock()
+			defer ac.lock.Unlock()
+			delete(ac.fetching, key)
+		}()
+	}
+	ac.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-fetch.done:
+		return fetch.file, fetch.err
+	}
+}
+
+// download Download the app at rawURL. The cached app is only downloaded
+// again when the origin tells it changed.
+func (ac *AppCache) download(rawURL string, cached *appSource) (appSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return appSource{}, err
+	}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return appSource{}, err
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	resp, err := ac.Client.Do(req)
+	if err != nil {
+		return appSource{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		source := *cached
+		source.fetched = time.Now()
+		if ac.touch(source.file) != nil {
+			// Evicted since, download it again
+			return ac.download(rawURL, nil)
+		}
+		return source, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return appSource{}, fmt.Errorf("Fetching app returned status %d", resp.StatusCode)
+	}
+	file, err := ac.Store(resp.Body, u.Path)
+	if err != nil {
+		return appSource{}, err
+	}
+	return appSource{
+		file:         file,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		fetched:      time.Now(),
+	}, nil
+}
+
+// Find Cached file of the app id. Apps missing from the cache are copied
+// from the first replica having them.
+func (ac *AppCache) Find(ctx context.Context, id string) (string, error) {
+	file, err := ac.Local(id)
+	if err != ErrAppNotFound || ac.Peers == nil || ac.Peers.Resolve == nil || !validAppID(id) {
+		return file, err
+	}
+	return ac.share(ctx, AppScheme+id, func() (string, error) {
+		return ac.fromPeers(id)
+	})
+}
+
+// fromPeers Copy the app id from the first replica having it
+func (ac *AppCache) fromPeers(id string) (string, error) {
+	addrs, err := ac.Peers.Resolve()
+	if err != nil {
+		return "", fmt.Errorf("Unable to resolve replicas: %v", err)
+	}
+	for _, addr := range addrs {
+		req, err := ac.Peers.Request(context.Background(), http.MethodGet, addr, "/apps/"+id)
+		if err != nil {
+			return "", err
+		}
+		resp, err := ac.Client.Do(req)
+		if err != nil {
+			logger.Warnf("Unable to ask replica %s for app %s: %v", addr, id, err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			continue
+		}
+		_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+		file, err := ac.Store(resp.Body, params["filename"])
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(file, id) {
+			return "", fmt.Errorf("Replica %s sent another app than %s", addr, id)
+		}
+		logger.Infof("App copied from replica %s - %s", addr, file)
+		return file, nil
+	}
+	return "", ErrAppNotFound
+}
+
+// Local Cached file of the app id, without asking the replicas
+func (ac *AppCache) Local(id string) (string, error) {
+	if !validAppID(id) {
+		return "", ErrAppNotFound
+	}
+	matches, err := filepath.Glob(filepath.Join(ac.Dir, id+"*"))
+	if err != nil || len(matches) == 0 {
+		return "", ErrAppNotFound
+	}
+	file := filepath.Base(matches[0])
+	return file, ac.touch(file)
+}
+
+// Open Open a cached file for download
+func (ac *AppCache) Open(file string) (*os.File, error) {
+	if !validAppID(strings.TrimSuffix(file, path.Ext(file))) {
+		return nil, ErrAppNotFound
+	}
+	if err := ac.touch(file); err != nil {
+		return nil, ErrAppNotFound
+	}
+	return os.Open(filepath.Join(ac.Dir, file))
+}
+
+// touch Mark the file as used, postponing its expiry
+func (ac *AppCache) touch(file string) error {
+	now := time.Now()
+	return os.Chtimes(filepath.Join(ac.Dir, file), now, now)
+}
+
+// Run Delete apps unused for longer than the retention until ctx is done
+func (ac *AppCache) Run(ctx context.Context) {
+	tick := time.NewTicker(appCleanupInterval)
+	defer tick.Stop()
+	for {
+		ac.cleanup()
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (ac *AppCache) cleanup() {
+	files, err := ioutil.ReadDir(ac.Dir)
+	if err != nil {
+		logger.Errorf("Failed to list app cache: %v", err)
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || time.Since(file.ModTime()) < ac.Retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(ac.Dir, file.Name())); err != nil {
+			logger.Errorf("Failed to delete app %s: %v", file.Name(), err)
+			continue
+		}
+		logger.Infof("App expired - %s", file.Name())
+	}
+}
+
+// trim Delete the least recently used apps until the cache fits in
+// TotalSize, keeping the app just stored
+func (ac *AppCache) trim(keep string) {
+	if ac.TotalSize <= 0 {
+		return
+	}
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	files, err := ioutil.ReadDir(ac.Dir)
+	if err != nil {
+		logger.Errorf("Failed to list app cache: %v", err)
+		return
+	}
+	var total int64
+	apps := []os.FileInfo{}
+	for _, file := range files {
+		// Uploads in progress are hidden files
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		total += file.Size()
+		apps = append(apps, file)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].ModTime().Before(apps[j].ModTime()) })
+	for _, file := range apps {
+		if total <= ac.TotalSize {
+			return
+		}
+		if file.Name() == keep {
+			continue
+		}
+		if err := os.Remove(filepath.Join(ac.Dir, file.Name())); err != nil {
+			logger.Errorf("Failed to delete app %s: %v", file.Name(), err)
+			continue
+		}
+		total -= file.Size()
+		logger.Infof("App evicted - %s", file.Name())
+	}
+}
+
+// validAppID Whether id is a SHA-256 in hex
+func validAppID(id string) bool {
+	if len(id) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,237 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestAppCache(t *testing.T) *AppCache {
+	dir, err := ioutil.TempDir("", "sersan-apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &AppCache{Dir: dir, Retention: time.Hour, MaxSize: 1024, Client: &http.Client{}}
+}
+
+func appID(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAppStore(t *testing.T) {
+	ac := newTestAppCache(t)
+	defer os.RemoveAll(ac.Dir)
+
+	file, err := ac.Store(strings.NewReader("app"), "app-debug.APK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file != appID("app")+".apk" {
+		t.Errorf("Stored as %s, want the SHA-256 with the extension", file)
+	}
+	again, err := ac.Store(strings.NewReader("app"), "renamed.apk")
+	if err != nil || again != file {
+		t.Errorf("Stored again as %s (%v), want %s", again, err, file)
+	}
+	other, _ := ac.Store(strings.NewReader("app"), "app.exe")
+	if other != appID("app") {
+		t.Errorf("Stored as %s, want unknown extensions dropped", other)
+	}
+	files, _ := ioutil.ReadDir(ac.Dir)
+	if len(files) != 2 {
+		t.Errorf("Cache holds %d files, want 2 without the uploads", len(files))
+	}
+
+	if _, err := ac.Store(bytes.NewReader(make([]byte, ac.MaxSize+1)), "large.apk"); err == nil {
+		t.Error("Stored an app larger than MaxSize")
+	}
+	if _, err := ac.Store(bytes.NewReader(make([]byte, ac.MaxSize)), "max.apk"); err != nil {
+		t.Errorf("Failed to store an app of MaxSize: %v", err)
+	}
+}
+
+func TestAppStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	ac := newTestAppCache(t)
+	defer os.RemoveAll(ac.Dir)
+	ac.TotalSize = 25
+
+	old, _ := ac.Store(strings.NewReader("old app...."), "old.apk")
+	used, _ := ac.Store(strings.NewReader("used app..."), "used.apk")
+	past := time.Now().Add(-time.Minute)
+	os.Chtimes(filepath.Join(ac.Dir, used), past, past)
+	os.Chtimes(filepath.Join(ac.Dir, old), past.Add(time.Second), past.Add(time.Second))
+	if _, err := ac.Local(appID("used app...")); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := ac.Store(strings.NewReader("latest app."), "latest.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, kept := range map[string]bool{old: false, used: true, latest: true} {
+		if _, err := os.Stat(filepath.Join(ac.Dir, file)); (err == nil) != kept {
+			t.Errorf("App %s kept: %v, want %v", file, err == nil, kept)
+		}
+	}
+}
+
+func TestAppFetchSharesDownloads(t *testing.T) {
+	ac := newTestAppCache(t)
+	defer os.RemoveAll(ac.Dir)
+	var hits int32
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		if r.URL.Path != "/builds/app-debug.apk" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("app"))
+	}))
+	defer origin.Close()
+
+	var wg sync.WaitGroup
+	files := make([]string, 5)
+	for i := range files {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file, err := ac.Fetch(context.Background(), origin.URL+"/builds/app-debug.apk")
+			if err != nil {
+				t.Error(err)
+			}
+			files[i] = file
+		}(i)
+	}
+	// Fetches started while the origin answers share its download
+	for atomic.LoadInt32(&hits) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for _, file := range files {
+		if file != appID("app")+".apk" {
+			t.Errorf("Fetched %s, want the downloaded app", file)
+		}
+	}
+	if _, err := ac.Fetch(context.Background(), origin.URL+"/builds/app-debug.apk"); err != nil {
+		t.Error(err)
+	}
+	if hits := atomic.LoadInt32(&hits); hits != 1 {
+		t.Errorf("Origin got %d requests, want 1", hits)
+	}
+
+	if _, err := ac.Fetch(context.Background(), origin.URL+"/missing.apk"); err == nil {
+		t.Error("Fetched a missing app")
+	}
+}
+
+func TestAppFetchRevalidates(t *testing.T) {
+	ac := newTestAppCache(t)
+	defer os.RemoveAll(ac.Dir)
+	var lock sync.Mutex
+	content, downloads := "app v1", 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		etag := `"` + appID(content) + `"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Write([]byte(content))
+	}))
+	defer origin.Close()
+
+	fetch := func(want string) {
+		t.Helper()
+		file, err := ac.Fetch(context.Background(), origin.URL+"/app.apk")
+		if err != nil || file != appID(want)+".apk" {
+			t.Errorf("Fetched %s (%v), want %s", file, err, want)
+		}
+	}
+	fetch("app v1")
+	fetch("app v1")
+	lock.Lock()
+	content = "app v2"
+	lock.Unlock()
+	// The URL serves another build, e.g. a latest build link
+	fetch("app v2")
+	lock.Lock()
+	defer lock.Unlock()
+	if downloads != 2 {
+		t.Errorf("Origin sent the app %d times, want 2 as the first one was not modified", downloads)
+	}
+}
+
+func TestAppFetchCancelled(t *testing.T) {
+	ac := newTestAppCache(t)
+	defer os.RemoveAll(ac.Dir)
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := ac.Fetch(ctx, origin.URL+"/app.apk"); err != context.DeadlineExceeded {
+		t.Errorf("Got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestAppFindOnReplica(t *testing.T) {
+	peer := newTestAppCache(t)
+	defer os.RemoveAll(peer.Dir)
+	file, _ := peer.Store(strings.NewReader("app"), "app.apk")
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(PeerHeader) == "" {
+			t.Error("Replica asked without the peer header")
+		}
+		cached, err := peer.Local(strings.TrimPrefix(r.URL.Path, "/apps/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": cached}))
+		http.ServeFile(w, r, filepath.Join(peer.Dir, cached))
+	}))
+	defer replica.Close()
+
+	ac := newTestAppCache(t)
+	defer os.RemoveAll(ac.Dir)
+	ac.Peers = &Peers{Resolve: func() ([]string, error) {
+		return []string{strings.TrimPrefix(replica.URL, "http://")}, nil
+	}}
+	found, err := ac.Find(context.Background(), appID("app"))
+	if err != nil || found != file {
+		t.Errorf("Found %s (%v), want %s copied from the replica", found, err, file)
+	}
+	if _, err := ac.Local(appID("app")); err != nil {
+		t.Errorf("App not cached once copied: %v", err)
+	}
+	if _, err := ac.Find(context.Background(), appID("missing")); err != ErrAppNotFound {
+		t.Errorf("Got %v, want %v", err, ErrAppNotFound)
+	}
+	if _, err := ac.Find(context.Background(), "../app"); err != ErrAppNotFound {
+		t.Errorf("Got %v for an invalid id, want %v", err, ErrAppNotFound)
+	}
+}
@@ -1,26 +1,40 @@
 package lib
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/logger"
 	"github.com/salestock/sersan/utils"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 )
 
+// computeRetryBackoff Delay before the first retry of a transient failure
+const computeRetryBackoff = 2 * time.Second
+
+// computeExternalIPLabel Instance label telling whether the hub reaches the
+// instance on its external IP, as its grid asked when it was created
+const computeExternalIPLabel = "sersan-external-ip"
+
 type ComputeClient struct {
 	Clientset *http.Client
+	// BasePath Compute API projects endpoint, the public one when empty
+	BasePath string
 }
 
 type ComputeEngine struct {
@@ -28,96 +42,358 @@ type ComputeEngine struct {
 	Caps     Caps
 }
 
+// ComputeConfig Compute engine section of a grid
+type ComputeConfig struct {
+	ProjectID string `yaml:"projectID"`
+	// Zones Zones tried in order when an instance cannot be created
+	Zones            []string          `yaml:"zones"`
+	Preemptible      *bool             `yaml:"preemptible"`
+	OnDemandFallback bool              `yaml:"onDemandFallback"`
+	MachineType      string            `yaml:"machineType"`
+	BootDiskSizeGb   int64             `yaml:"bootDiskSizeGb"`
+	BootDiskType     string            `yaml:"bootDiskType"`
+	ImageFamily      string            `yaml:"imageFamily"`
+	Network          string            `yaml:"network"`
+	Subnetwork       string            `yaml:"subnetwork"`
+	Tags             []string          `yaml:"tags"`
+	ServiceAccount   string            `yaml:"serviceAccount"`
+	Scopes           []string          `yaml:"scopes"`
+	Metadata         map[string]string `yaml:"metadata"`
+	Labels           map[string]string `yaml:"labels"`
+	ExternalIP       *bool             `yaml:"externalIP"`
+	BucketName       string            `yaml:"bucketName"`
+	InsertRetries    int               `yaml:"insertRetries"`
+	// StartupScript Startup script template of the instances, rendered with
+	// StartupScriptData
+	StartupScript string                    `yaml:"startupScript"`
+	AVD           string                    `yaml:"avd"`
+	AppiumArgs    []string                  `yaml:"appiumArgs"`
+	EmulatorArgs  []string                  `yaml:"emulatorArgs"`
+	Devices       map[string]*DeviceProfile `yaml:"devices"`
+	DefaultDevice string                    `yaml:"defaultDevice"`
+
+	startupTemplate *template.Template
+}
+
 var computeClient ComputeClient
 var computeOnce sync.Once
 
+func init() {
+	RegisterEngine(ComputeEngineType, EngineFactory{
+		Client: func() (Engine, error) { return GetComputeClient(), nil },
+		Starter: func(gridBase GridBase, caps Caps) GridStarter {
+			return ComputeEngine{GridBase: gridBase, Caps: caps}
+		},
+		Config: func() interface{} { return newComputeConfig() },
+		Pool:   computePool{},
+	})
+}
+
+// newComputeConfig Compute engine section defaults, from the environment
+func newComputeConfig() *ComputeConfig {
+	conf := config.Get()
+	return &ComputeConfig{
+		ProjectID:     conf.ProjectID,
+		Zones:         []string{conf.Zone},
+		MachineType:   conf.MachineType,
+		Subnetwork:    conf.Subnetwork,
+		BucketName:    conf.BucketName,
+		InsertRetries: conf.ComputeInsertRetries,
+	}
+}
+
+// validate Check the zones and default device, and parse the startup script
+// template of the grid version
+func (cc *ComputeConfig) validate(grid string) (err error) {
+	if len(cc.Zones) == 0 {
+		return errors.New("No zone")
+	}
+	if _, ok := cc.Devices[cc.DefaultDevice]; cc.DefaultDevice != "" && !ok {
+		return fmt.Errorf("Default device %s is not a device profile", cc.DefaultDevice)
+	}
+	if cc.StartupScript == "" {
+		return nil
+	}
+	cc.startupTemplate, err = parseStartupScript(grid, cc.StartupScript)
+	if err != nil {
+		return fmt.Errorf("Invalid startup script: %v", err)
+	}
+	return nil
+}
+
+// computeConfig Compute engine section of the grid
+func computeConfig(grid *Grid) *ComputeConfig {
+	if cc, ok := grid.EngineConfig.(*ComputeConfig); ok {
+		return cc
+	}
+	return newComputeConfig()
+}
+
 func GetComputeClient() ComputeClient {
 	computeOnce.Do(func() {
 		client, err := google.DefaultClient(oauth2.NoContext, compute.ComputeScope)
 		if err != nil {
-			log.Printf("Failed to get compute client: %v", err)
+			logger.Errorf("Failed to get compute client: %v", err)
 		}
 		computeClient = ComputeClient{Clientset: client}
 	})
 	return computeClient
 }
 
-func (c ComputeClient) CreateGrid(gridBase *GridBase) (name string, err error) {
-	conf := config.Get()
+// service Compute API service of the client
+func (c ComputeClient) service() (*compute.Service, error) {
 	service, err := compute.New(c.Clientset)
 	if err != nil {
-		log.Printf("Failed to get service: %v", err)
+		return nil, err
+	}
+	if c.BasePath != "" {
+		service.BasePath = c.BasePath
+	}
+	return service, nil
+}
+
+// CreateGrid Create instance and wait for the insert operation. Transient
+// failures are retried with a new instance.
+func (c ComputeClient) CreateGrid(ctx context.Context, gridBase *GridBase) (name string, err error) {
+	ctx, end := traceStep(ctx, "CreateGrid")
+	defer func() { end(name, err) }()
+	service, err := c.service()
+	if err != nil {
+		logger.FromContext(ctx).Errorf("Failed to get service: %v", err)
+		return
 	}
 
-	prefix := "https://www.googleapis.com/compute/v1/projects/" + conf.ProjectID
-	startupScript := "gs://" + conf.BucketName + "/startup.sh"
+	// Zones are tried in order, first with the configured scheduling and then
+	// on demand when the grid allows falling back
+	cc := computeConfig(gridBase.Grid)
+	preemptible := cc.Preemptible == nil || *cc.Preemptible
+	schedules := []bool{preemptible}
+	if preemptible && cc.OnDemandFallback {
+		schedules = append(schedules, false)
+	}
+	for _, preemptible := range schedules {
+		for _, zone := range cc.Zones {
+			name, err = c.createInZone(ctx, service, gridBase, zone, preemptible)
+			class := ErrorClass(err)
+			if err == nil || (class != ErrorQuota && class != ErrorCapacity) {
+				return
+			}
+			logger.FromContext(ctx).With(logger.Instance, name).Warnf("Failed to create instance in %s (preemptible: %t), trying next zone: %v", zone, preemptible, err)
+			c.DeleteGrid(name)
+		}
+	}
+	return
+}
+
+func (c ComputeClient) createInZone(ctx context.Context, service *compute.Service, gridBase *GridBase, zone string, preemptible bool) (name string, err error) {
+	retries := computeConfig(gridBase.Grid).InsertRetries
+	backoff := computeRetryBackoff
+	for attempt := 1; ; attempt++ {
+		name, err = c.insert(ctx, service, gridBase, zone, preemptible)
+		if err == nil || ErrorClass(err) != ErrorTransient || attempt > retries {
+			return
+		}
+		logger.FromContext(ctx).With(logger.Instance, name).Warnf("Failed to create instance, retrying in %v: %v", backoff, err)
+		c.DeleteGrid(name)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// insert Insert instance and wait for the operation. The returned grid name
+// carries the zone of the instance.
+func (c ComputeClient) insert(ctx context.Context, service *compute.Service, gridBase *GridBase, zone string, preemptible bool) (name string, err error) {
+	conf := config.Get()
+	cc := computeConfig(gridBase.Grid)
+	project := cc.ProjectID
+	prefix := "https://www.googleapis.com/compute/v1/projects/" + project
 	computeName := "sersan-grid-" + conf.GridLabel + "-" + utils.GenerateUUID()
-	machineType := conf.MachineType
-	if gridBase.Grid.MachineType != "" {
-		machineType = gridBase.Grid.MachineType
+
+	sourceImage := gridBase.Grid.Image
+	if cc.ImageFamily != "" {
+		sourceImage = cc.ImageFamily
+		if !strings.Contains(sourceImage, "/") {
+			sourceImage = "projects/" + project + "/global/images/family/" + cc.ImageFamily
+		}
+	}
+	disk := &compute.AttachedDiskInitializeParams{
+		DiskName:    computeName,
+		SourceImage: sourceImage,
+		DiskSizeGb:  cc.BootDiskSizeGb,
+	}
+	if cc.BootDiskType != "" {
+		disk.DiskType = "zones/" + zone + "/diskTypes/" + cc.BootDiskType
 	}
+	networkInterface := &compute.NetworkInterface{
+		Network:    cc.Network,
+		Subnetwork: cc.Subnetwork,
+	}
+	if cc.ExternalIP == nil || *cc.ExternalIP {
+		networkInterface.AccessConfigs = []*compute.AccessConfig{
+			{
+				Type: "ONE_TO_ONE_NAT",
+				Name: "External NAT",
+			},
+		}
+	}
+
+	serviceAccount := &compute.ServiceAccount{
+		Email: "default",
+		Scopes: []string{
+			compute.DevstorageFullControlScope,
+			compute.ComputeScope,
+		},
+	}
+	if cc.ServiceAccount != "" {
+		serviceAccount.Email = cc.ServiceAccount
+	}
+	if len(cc.Scopes) > 0 {
+		serviceAccount.Scopes = cc.Scopes
+	}
+
+	tags := []string{"vnc-server", "appium"}
+	if len(cc.Tags) > 0 {
+		tags = cc.Tags
+	}
+
+	metadata := gridBase.deviceMetadata()
+	for key, value := range cc.Metadata {
+		metadata[key] = value
+	}
+	script, err := gridBase.StartupScript(zone)
+	if err != nil {
+		return "", err
+	}
+	if script != "" {
+		metadata["startup-script"] = script
+	} else {
+		metadata["startup-script-url"] = "gs://" + cc.BucketName + "/startup.sh"
+	}
+	metadata["sersan-grid-timeout"] = strconv.Itoa(gridBase.Lifetime())
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	metadataItems := []*compute.MetadataItems{}
+	for _, key := range keys {
+		value := metadata[key]
+		metadataItems = append(metadataItems, &compute.MetadataItems{Key: key, Value: &value})
+	}
+
+	labels := gridBase.InstanceLabels()
+	for key, value := range cc.Labels {
+		if _, ok := labels[key]; !ok {
+			labels[key] = labelValue(value)
+		}
+	}
+	labels["service-name"] = "sersan-grid"
+	labels[computeExternalIPLabel] = strconv.FormatBool(reachExternalIP(cc))
+
 	instance := &compute.Instance{
 		Name:        computeName,
 		Description: "Android Emulator Runner",
-		MachineType: prefix + "/zones/" + conf.Zone + "/machineTypes/" + machineType,
+		MachineType: prefix + "/zones/" + zone + "/machineTypes/" + cc.MachineType,
 		Disks: []*compute.AttachedDisk{
 			{
-				AutoDelete: true,
-				Boot:       true,
-				Type:       "PERSISTENT",
-				InitializeParams: &compute.AttachedDiskInitializeParams{
-					DiskName:    computeName,
-					SourceImage: gridBase.Grid.Image,
-				},
-			},
-		},
-		NetworkInterfaces: []*compute.NetworkInterface{
-			{
-				AccessConfigs: []*compute.AccessConfig{
-					{
-						Type: "ONE_TO_ONE_NAT",
-						Name: "External NAT",
-					},
-				},
-				Subnetwork: conf.Subnetwork,
+				AutoDelete:       true,
+				Boot:             true,
+				Type:             "PERSISTENT",
+				InitializeParams: disk,
 			},
 		},
+		NetworkInterfaces: []*compute.NetworkInterface{networkInterface},
 		Scheduling: &compute.Scheduling{
-			Preemptible: true,
-		},
-		ServiceAccounts: []*compute.ServiceAccount{
-			{
-				Email: "default",
-				Scopes: []string{
-					compute.DevstorageFullControlScope,
-					compute.ComputeScope,
-				},
-			},
+			Preemptible: preemptible,
 		},
+		ServiceAccounts: []*compute.ServiceAccount{serviceAccount},
 		Metadata: &compute.Metadata{
-			Items: []*compute.MetadataItems{
-				{
-					Key:   "startup-script-url",
-					Value: &startupScript,
-				},
-			},
-		},
-		Labels: map[string]string{
-			"service-name": "sersan-grid",
+			Items: metadataItems,
 		},
+		Labels: labels,
 		Tags: &compute.Tags{
-			Items: []string{"vnc-server", "appium"},
+			Items: tags,
 		},
 	}
 
-	log.Printf("%v", instance)
-	_, err = service.Instances.Insert(conf.ProjectID, conf.Zone, instance).Do()
+	name = joinGridName(computeName, zone, project)
+	log := logger.FromContext(ctx).With(logger.Instance, name)
+	if logger.Enabled(logger.DebugLevel) {
+		dump, _ := instance.MarshalJSON()
+		log.Debugf("Inserting instance %s", dump)
+	}
+	operation, err := service.Instances.Insert(project, zone, instance).Context(ctx).Do()
 	if err != nil {
-		log.Printf("%v", err)
-		return computeName, err
+		err = classifyComputeError(err)
+		log.Errorf("Failed to insert instance: %v", err)
+		return name, err
 	}
 
-	return computeName, nil
+	// Quota, capacity and image errors are only reported by the operation
+	for operation.Status != "DONE" {
+		operation, err = service.ZoneOperations.Wait(project, zone, operation.Name).Context(ctx).Do()
+		if err != nil {
+			err = classifyComputeError(err)
+			log.Errorf("Failed to wait for instance: %v", err)
+			return name, err
+		}
+	}
+	if operation.Error != nil && len(operation.Error.Errors) > 0 {
+		operationError := operation.Error.Errors[0]
+		err = &GridError{
+			Class:   classifyComputeCode(operationError.Code),
+			Code:    operationError.Code,
+			Message: operationError.Message,
+		}
+		log.Errorf("Failed to create instance: %v", err)
+		return name, err
+	}
+	log.Infof("Instance created")
+	return name, nil
+}
+
+// classifyComputeError Classify a Compute Engine API call error. Context
+// errors are returned as is.
+func classifyComputeError(err error) error {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return &GridError{Class: ErrorTransient, Code: "REQUEST_FAILED", Message: err.Error()}
+	}
+	reason := strconv.Itoa(apiErr.Code)
+	if len(apiErr.Errors) > 0 {
+		reason = apiErr.Errors[0].Reason
+	}
+	class := ErrorConfig
+	switch {
+	case reason == "quotaExceeded":
+		class = ErrorQuota
+	case reason == "rateLimitExceeded", reason == "userRateLimitExceeded",
+		apiErr.Code == http.StatusTooManyRequests, apiErr.Code >= 500:
+		class = ErrorTransient
+	}
+	return &GridError{Class: class, Code: reason, Message: apiErr.Message}
+}
+
+// classifyComputeCode Classify the error code of a failed operation
+func classifyComputeCode(code string) string {
+	switch {
+	case code == "QUOTA_EXCEEDED":
+		return ErrorQuota
+	case strings.HasPrefix(code, "ZONE_RESOURCE_POOL_EXHAUSTED"), code == "RESOURCE_POOL_EXHAUSTED":
+		return ErrorCapacity
+	case code == "INTERNAL_ERROR", code == "RESOURCE_OPERATION_RATE_EXCEEDED", code == "RATE_LIMIT_EXCEEDED",
+		code == "SERVICE_UNAVAILABLE", code == "RESOURCE_NOT_READY":
+		return ErrorTransient
+	default:
+		return ErrorConfig
+	}
 }
 
 func (c ComputeClient) DeleteGrid(name string) (err error) {
@@ -126,80 +402,191 @@ func (c ComputeClient) DeleteGrid(name string) (err error) {
 		return
 	}
 
-	conf := config.Get()
-	service, err := compute.New(c.Clientset)
+	service, err := c.service()
 	if err != nil {
 		return err
 	}
 
-	_, err = service.Instances.Delete(conf.ProjectID, conf.Zone, name).Do()
+	instance, zone, project := splitGridName(name)
+	_, err = service.Instances.Delete(project, zone, instance).Do()
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	logger.With(logger.Instance, name).Infof("Instance deleted")
 
 	return
 }
 
-func (c ComputeClient) WaitUntilReady(name string, timeout int32) (ip string, err error) {
-	conf := config.Get()
-	service, err := compute.New(c.Clientset)
+func (c ComputeClient) WaitUntilReady(ctx context.Context, name string, timeout int32) (ip string, err error) {
+	ctx, end := traceStep(ctx, "WaitUntilReady")
+	defer func() { end(name, err) }()
+	service, err := c.service()
 	if err != nil {
 		return
 	}
+	instanceName, zone, project := splitGridName(name)
 	waitTimeout := time.NewTimer(time.Duration(timeout) * time.Millisecond)
 	defer waitTimeout.Stop()
-	tick := time.Tick(200 * time.Millisecond)
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
 		case <-waitTimeout.C:
 			err = fmt.Errorf("Grid is not running until %d ms", timeout)
 			return
-		case <-tick:
-			instance, err := service.Instances.Get(conf.ProjectID, conf.Zone, name).Do()
+		case <-tick.C:
+			instance, err := service.Instances.Get(project, zone, instanceName).Context(ctx).Do()
 			if err != nil {
-				log.Printf("Failed to get instance: %v", err)
+				if ctx.Err() != nil {
+					return "", ctx.Err()
+				}
+				if !retryableComputeError(err) {
+					logger.FromContext(ctx).With(logger.Instance, name).Errorf("Failed to get instance: %v", err)
+					return "", err
+				}
+				logger.FromContext(ctx).With(logger.Instance, name).Warnf("Failed to get instance, retrying: %v", err)
+				continue
+			}
+			if instance == nil {
+				continue
 			}
 
-			if instance.Status == "RUNNING" {
-				if conf.ExternalIP {
-					if len(instance.NetworkInterfaces[0].AccessConfigs) > 0 {
-						return instance.NetworkInterfaces[0].AccessConfigs[0].NatIP, nil
-					}
-					err = fmt.Errorf("External IP not found")
+			switch instance.Status {
+			case "RUNNING":
+				ip, err = instanceIP(instance)
+				if err != nil {
 					return "", err
 				}
-
-				if instance.NetworkInterfaces[0].NetworkIP != "" {
-					return instance.NetworkInterfaces[0].NetworkIP, nil
+				if ip != "" {
+					return ip, nil
 				}
-				err = fmt.Errorf("External IP not found")
-				return "", err
+			case "STOPPING", "STOPPED", "SUSPENDING", "SUSPENDED", "TERMINATED":
+				return "", fmt.Errorf("Instance %s is %s: %s", name, instance.Status, instance.StatusMessage)
 			}
 		}
 	}
-	return
 }
 
-func (ce ComputeEngine) StartWithCancel() (grid *StartedGrid, err error) {
+// Preempted Whether the instance of the grid was preempted. Preempted
+// instances are stopped, not deleted.
+func (c ComputeClient) Preempted(ctx context.Context, name string) (bool, error) {
+	service, err := c.service()
+	if err != nil {
+		return false, err
+	}
+	instanceName, zone, project := splitGridName(name)
+	instance, err := service.Instances.Get(project, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return false, err
+	}
+	if instance.Scheduling == nil || !instance.Scheduling.Preemptible {
+		return false, nil
+	}
+	switch instance.Status {
+	case "STOPPING", "TERMINATED":
+		return true, nil
+	}
+	return false, nil
+}
+
+// joinGridName Grid name of an instance in zone of project. Instance and
+// zone names cannot contain dots, so the zone and project are appended after
+// one.
+func joinGridName(instance string, zone string, project string) string {
+	return instance + "." + zone + "." + project
+}
+
+// splitGridName Instance name, zone and project of a grid. Grids created
+// before zones or projects were configurable are in the default ones.
+func splitGridName(name string) (string, string, string) {
+	conf := config.Get()
+	parts := strings.SplitN(name, ".", 3)
+	switch len(parts) {
+	case 1:
+		return name, conf.Zone, conf.ProjectID
+	case 2:
+		return parts[0], parts[1], conf.ProjectID
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+// reachExternalIP Whether the hub reaches the instances of the grid on
+// their external IP. Grids not telling follow EXTERNAL_IP.
+func reachExternalIP(cc *ComputeConfig) bool {
+	if cc.ExternalIP != nil {
+		return *cc.ExternalIP
+	}
+	return config.Get().ExternalIP
+}
+
+// instanceIP Address of a running instance. It is empty while the network
+// interface is not set up yet. Instances without external IP are always
+// reached on their internal IP, and instances created before their grid
+// choice was labelled follow EXTERNAL_IP.
+func instanceIP(instance *compute.Instance) (string, error) {
+	if len(instance.NetworkInterfaces) == 0 {
+		return "", nil
+	}
+	external := config.Get().ExternalIP
+	if value, ok := instance.Labels[computeExternalIPLabel]; ok {
+		external = value == "true"
+	}
+	networkInterface := instance.NetworkInterfaces[0]
+	if !external || len(networkInterface.AccessConfigs) == 0 {
+		return networkInterface.NetworkIP, nil
+	}
+	return networkInterface.AccessConfigs[0].NatIP, nil
+}
+
+// retryableComputeError Whether polling may go on after err. The instance
+// may not be visible right after the insert, so not found is retried too.
+func retryableComputeError(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return true
+	}
+	switch {
+	case apiErr.Code == http.StatusNotFound, apiErr.Code == http.StatusTooManyRequests, apiErr.Code >= 500:
+		return true
+	}
+	return false
+}
+
+func (ce ComputeEngine) StartWithCancel(ctx context.Context) (grid *StartedGrid, err error) {
 	conf := config.Get()
+	if grid, ok := GetWarmPools().Claim(ctx, ce.GridBase); ok {
+		return grid, nil
+	}
+
 	computeClient := GetComputeClient()
-	name, err := computeClient.CreateGrid(&ce.GridBase)
+	name, err := computeClient.CreateGrid(ctx, &ce.GridBase)
 	if err != nil {
+		// The instance may exist even though its creation failed or was cancelled
+		if name != "" {
+			computeClient.DeleteGrid(name)
+		}
 		return nil, err
 	}
 
-	ip, err := computeClient.WaitUntilReady(name, conf.StartupTimeout)
+	ip, err := computeClient.WaitUntilReady(ctx, name, conf.StartupTimeout)
 	if err != nil {
 		computeClient.DeleteGrid(name)
 		return nil, err
 	}
 	u, err := url.Parse("http://" + ip + ":" + strconv.Itoa(int(ce.GridBase.Grid.Port)))
 	if err != nil {
+		computeClient.DeleteGrid(name)
 		return nil, err
 	}
 
 	if ce.GridBase.Grid.HealthCheck != "" {
-		err = utils.WaitUntilGridReady(u, ce.GridBase.Grid.HealthCheck)
+		err = utils.WaitUntilGridReady(ctx, u, ce.GridBase.Grid.HealthCheck)
 		if err != nil {
 			computeClient.DeleteGrid(name)
 			return nil, err
@@ -207,13 +594,148 @@ func (ce ComputeEngine) StartWithCancel() (grid *StartedGrid, err error) {
 	}
 
 	s := StartedGrid{
-		Name: name,
-		URL:  u,
-		Grid: ce.GridBase,
+		Name:    name,
+		URL:     u,
+		Grid:    ce.GridBase,
+		VNCPort: strconv.Itoa(int(ce.GridBase.Grid.VNCPort)),
 		Cancel: func() {
-			kubernetesClient.DeleteGrid(name)
+			computeClient.DeleteGrid(name)
 		},
 	}
 
 	return &s, nil
 }
+
+// computePool Warm pool of Android instances. Pool state is kept in the
+// instance labels, which are updated with their fingerprint so only one hub
+// replica can claim an instance.
+type computePool struct{}
+
+// List List pooled instances in all zones of the grid project
+func (computePool) List(ctx context.Context, gridBase GridBase) (members []PooledGrid, err error) {
+	conf := config.Get()
+	service, err := GetComputeClient().service()
+	if err != nil {
+		return
+	}
+	project := computeConfig(gridBase.Grid).ProjectID
+	filter := fmt.Sprintf("(labels.%s = %q) AND (labels.sersan-hub = %q)", PoolGridLabel, labelValue(gridBase.Key()), labelValue(conf.GridLabel))
+	err = service.Instances.AggregatedList(project).Filter(filter).Pages(ctx, func(list *compute.InstanceAggregatedList) error {
+		for _, scoped := range list.Items {
+			for _, instance := range scoped.Instances {
+				state := instance.Labels[PoolStateLabel]
+				if state == "" {
+					continue
+				}
+				switch instance.Status {
+				case "STOPPING", "STOPPED", "SUSPENDING", "SUSPENDED", "TERMINATED":
+					state = PoolStopped
+				}
+				ip, _ := instanceIP(instance)
+				created, _ := time.Parse(time.RFC3339, instance.CreationTimestamp)
+				members = append(members, PooledGrid{
+					Name:    joinGridName(instance.Name, path.Base(instance.Zone), project),
+					IP:      ip,
+					State:   state,
+					Created: created,
+				})
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Create Start a warming instance and mark it unclaimed once Appium is ready
+func (p computePool) Create(ctx context.Context, gridBase *GridBase) (name string, err error) {
+	conf := config.Get()
+	computeClient := GetComputeClient()
+	name, err = computeClient.CreateGrid(ctx, gridBase)
+	if err != nil {
+		if name != "" {
+			computeClient.DeleteGrid(name)
+		}
+		return
+	}
+	ip, err := computeClient.WaitUntilReady(ctx, name, conf.StartupTimeout)
+	if err != nil {
+		computeClient.DeleteGrid(name)
+		return
+	}
+	if gridBase.Grid.HealthCheck != "" {
+		u := &url.URL{Scheme: "http", Host: ip + ":" + strconv.Itoa(int(gridBase.Grid.Port))}
+		err = utils.WaitUntilGridReady(ctx, u, gridBase.Grid.HealthCheck)
+		if err != nil {
+			computeClient.DeleteGrid(name)
+			return
+		}
+	}
+
+	_, err = p.relabel(ctx, name, PoolWarming, PoolUnclaimed, nil)
+	if err != nil {
+		computeClient.DeleteGrid(name)
+	}
+	return
+}
+
+// Claim Relabel the instance as claimed by the session
+func (p computePool) Claim(ctx context.Context, member PooledGrid, labels map[string]string) (bool, error) {
+	return p.relabel(ctx, member.Name, PoolUnclaimed, PoolClaimed, labels)
+}
+
+// relabel Move the instance from one pool state to another, adding the
+// given labels in the same update. It returns false when the instance is
+// gone, not in the from state or its labels changed concurrently.
+func (computePool) relabel(ctx context.Context, name string, from string, to string, extra map[string]string) (bool, error) {
+	service, err := GetComputeClient().service()
+	if err != nil {
+		return false, err
+	}
+	instanceName, zone, project := splitGridName(name)
+	instance, err := service.Instances.Get(project, zone, instanceName).Context(ctx).Do()
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if instance.Labels[PoolStateLabel] != from || instance.Status != "RUNNING" {
+		return false, nil
+	}
+
+	labels := make(map[string]string, len(instance.Labels))
+	for key, value := range instance.Labels {
+		labels[key] = value
+	}
+	for key, value := range extra {
+		labels[key] = value
+	}
+	labels[PoolStateLabel] = to
+	request := &compute.InstancesSetLabelsRequest{Labels: labels, LabelFingerprint: instance.LabelFingerprint}
+	operation, err := service.Instances.SetLabels(project, zone, instanceName, request).Context(ctx).Do()
+	if apiErr, ok := err.(*googleapi.Error); ok && (apiErr.Code == http.StatusPreconditionFailed || apiErr.Code == http.StatusNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for operation.Status != "DONE" {
+		operation, err = service.ZoneOperations.Wait(project, zone, operation.Name).Context(ctx).Do()
+		if err != nil {
+			return false, err
+		}
+	}
+	if operation.Error != nil && len(operation.Error.Errors) > 0 {
+		operationError := operation.Error.Errors[0]
+		if operationError.Code == "CONDITION_NOT_MET" {
+			return false, nil
+		}
+		return false, fmt.Errorf("Failed to relabel %s: %s %s", name, operationError.Code, operationError.Message)
+	}
+	return true, nil
+}
+
+// Delete Delete pooled instance
+func (computePool) Delete(name string) error {
+	return GetComputeClient().DeleteGrid(name)
+}
@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// computeStub Compute API stub failing instance inserts with the operation
+// error code returned by fail, if any
+type computeStub struct {
+	fail    func(zone string, preemptible bool) string
+	lock    sync.Mutex
+	inserts []string
+	deletes []string
+}
+
+func (s *computeStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// /compute/v1/projects/<project>/zones/<zone>/instances[/<instance>]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/compute/v1"), "/")
+	if len(parts) < 6 || parts[5] != "instances" {
+		http.NotFound(w, r)
+		return
+	}
+	zone := parts[4]
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch r.Method {
+	case http.MethodPost:
+		var instance compute.Instance
+		json.NewDecoder(r.Body).Decode(&instance)
+		preemptible := instance.Scheduling != nil && instance.Scheduling.Preemptible
+		s.inserts = append(s.inserts, fmt.Sprintf("%s/%s/%t", parts[2], zone, preemptible))
+		operation := &compute.Operation{Name: "operation-" + instance.Name, Status: "DONE"}
+		if code := s.fail(zone, preemptible); code != "" {
+			operation.Error = &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Code: code, Message: "failed in " + zone}}}
+		}
+		json.NewEncoder(w).Encode(operation)
+	case http.MethodDelete:
+		s.deletes = append(s.deletes, zone)
+		json.NewEncoder(w).Encode(&compute.Operation{Name: "delete", Status: "DONE"})
+	}
+}
+
+func TestClassifyComputeErrors(t *testing.T) {
+	for code, want := range map[string]string{
+		"QUOTA_EXCEEDED":                            ErrorQuota,
+		"ZONE_RESOURCE_POOL_EXHAUSTED":              ErrorCapacity,
+		"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS": ErrorCapacity,
+		"RESOURCE_POOL_EXHAUSTED":                   ErrorCapacity,
+		"RESOURCE_OPERATION_RATE_EXCEEDED":          ErrorTransient,
+		"INTERNAL_ERROR":                            ErrorTransient,
+		"INVALID_IMAGE":                             ErrorConfig,
+	} {
+		if class := classifyComputeCode(code); class != want {
+			t.Errorf("Operation error %s classified %s, want %s", code, class, want)
+		}
+	}
+
+	for _, test := range []struct {
+		err  error
+		want string
+	}{
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}, ErrorQuota},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, ErrorTransient},
+		{&googleapi.Error{Code: 503}, ErrorTransient},
+		{&googleapi.Error{Code: 404, Errors: []googleapi.ErrorItem{{Reason: "notFound"}}}, ErrorConfig},
+		{fmt.Errorf("connection reset"), ErrorTransient},
+	} {
+		if class := ErrorClass(classifyComputeError(test.err)); class != test.want {
+			t.Errorf("Error %v classified %s, want %s", test.err, class, test.want)
+		}
+	}
+	if err := classifyComputeError(context.Canceled); err != context.Canceled {
+		t.Errorf("Cancelled insert classified %v", err)
+	}
+}
+
+func TestComputeZoneFallback(t *testing.T) {
+	tests := []struct {
+		name             string
+		onDemandFallback bool
+		fail             func(zone string, preemptible bool) string
+		inserts          []string
+		zone             string
+		class            string
+	}{
+		{
+			name: "capacity exhausted in the first zone",
+			fail: func(zone string, preemptible bool) string {
+				if zone == "zone-a" {
+					return "ZONE_RESOURCE_POOL_EXHAUSTED"
+				}
+				return ""
+			},
+			inserts: []string{"project/zone-a/true", "project/zone-b/true"},
+			zone:    "zone-b",
+		},
+		{
+			name:             "no preemptible capacity in any zone",
+			onDemandFallback: true,
+			fail: func(zone string, preemptible bool) string {
+				if preemptible {
+					return "QUOTA_EXCEEDED"
+				}
+				return ""
+			},
+			inserts: []string{"project/zone-a/true", "project/zone-b/true", "project/zone-a/false"},
+			zone:    "zone-a",
+		},
+		{
+			name: "no capacity without on demand fallback",
+			fail: func(zone string, preemptible bool) string {
+				return "ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS"
+			},
+			inserts: []string{"project/zone-a/true", "project/zone-b/true"},
+			class:   ErrorCapacity,
+		},
+		{
+			name: "invalid image",
+			fail: func(zone string, preemptible bool) string {
+				return "INVALID_IMAGE"
+			},
+			inserts: []string{"project/zone-a/true"},
+			class:   ErrorConfig,
+		},
+	}
+	for _, test := range tests {
+		stub := &computeStub{fail: test.fail}
+		server := httptest.NewServer(stub)
+		client := ComputeClient{Clientset: server.Client(), BasePath: server.URL + "/compute/v1/projects/"}
+		cc := &ComputeConfig{ProjectID: "project", Zones: []string{"zone-a", "zone-b"}, OnDemandFallback: test.onDemandFallback}
+		gridBase := &GridBase{Name: "android", Version: "9.0.0", Grid: &Grid{Engine: ComputeEngineType, EngineConfig: cc}}
+		name, err := client.CreateGrid(context.Background(), gridBase)
+		server.Close()
+
+		if !equalStrings(stub.inserts, test.inserts) {
+			t.Errorf("%s: inserted %v, want %v", test.name, stub.inserts, test.inserts)
+		}
+		if len(stub.deletes) != len(test.inserts)-1 && test.class == "" {
+			t.Errorf("%s: deleted %v, want the failed instances deleted", test.name, stub.deletes)
+		}
+		if test.class != "" {
+			if ErrorClass(err) != test.class {
+				t.Errorf("%s: got error %v, want %s error", test.name, err, test.class)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if instance, zone, project := splitGridName(name); !strings.HasPrefix(instance, "sersan-grid-") || zone != test.zone || project != "project" {
+			t.Errorf("%s: created %s, want an instance in %s of project", test.name, name, test.zone)
+		}
+	}
+}
+
+func TestInstanceIP(t *testing.T) {
+	instance := func(labels map[string]string) *compute.Instance {
+		return &compute.Instance{
+			Labels: labels,
+			NetworkInterfaces: []*compute.NetworkInterface{{
+				NetworkIP:     "10.0.0.2",
+				AccessConfigs: []*compute.AccessConfig{{NatIP: "34.0.0.2"}},
+			}},
+		}
+	}
+	external, internal := true, false
+	for _, test := range []struct {
+		name string
+		conf *ComputeConfig
+		want string
+	}{
+		{"grid asking for the external IP", &ComputeConfig{ExternalIP: &external}, "34.0.0.2"},
+		{"grid asking for the internal IP", &ComputeConfig{ExternalIP: &internal}, "10.0.0.2"},
+		{"grid following EXTERNAL_IP", &ComputeConfig{}, "10.0.0.2"},
+	} {
+		labels := map[string]string{computeExternalIPLabel: "false"}
+		if reachExternalIP(test.conf) {
+			labels[computeExternalIPLabel] = "true"
+		}
+		if ip, _ := instanceIP(instance(labels)); ip != test.want {
+			t.Errorf("Instance of the %s reached on %s, want %s", test.name, ip, test.want)
+		}
+	}
+	if ip, _ := instanceIP(instance(nil)); ip != "10.0.0.2" {
+		t.Errorf("Unlabelled instance reached on %s, want the internal IP as EXTERNAL_IP is unset", ip)
+	}
+	if ip, _ := instanceIP(&compute.Instance{}); ip != "" {
+		t.Errorf("Instance without network interface reached on %s", ip)
+	}
+}
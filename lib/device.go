@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"strconv"
+	"strings"
+)
+
+// DeviceProfile Android device emulated by a grid version
+type DeviceProfile struct {
+	AVD     string `yaml:"avd"`
+	Screen  string `yaml:"screen"`
+	Density int    `yaml:"density"`
+	RAM     int    `yaml:"ram"`
+}
+
+// Device Profile matching the requested device name, ignoring case, or the
+// default profile of the grid. The name is empty when the grid has no
+// matching nor default profile, as for grids of other engines than compute.
+func (g *Grid) Device(deviceName string) (string, *DeviceProfile) {
+	cc, ok := g.EngineConfig.(*ComputeConfig)
+	if !ok {
+		return "", nil
+	}
+	for name, profile := range cc.Devices {
+		if strings.EqualFold(name, deviceName) {
+			return name, profile
+		}
+	}
+	if profile, ok := cc.Devices[cc.DefaultDevice]; ok {
+		return cc.DefaultDevice, profile
+	}
+	return "", nil
+}
+
+// deviceMetadata Instance metadata describing the device profile, for
+// startup scripts which are not templates
+func (gb GridBase) deviceMetadata() map[string]string {
+	metadata := map[string]string{
+		"sersan-avd": gb.StartupScriptData("").AVD,
+	}
+	if gb.Device == nil {
+		return metadata
+	}
+	metadata["sersan-device"] = gb.DeviceProfile
+	if gb.Device.Screen != "" {
+		metadata["sersan-screen"] = gb.Device.Screen
+	}
+	if gb.Device.Density > 0 {
+		metadata["sersan-density"] = strconv.Itoa(gb.Device.Density)
+	}
+	if gb.Device.RAM > 0 {
+		metadata["sersan-ram"] = strconv.Itoa(gb.Device.RAM)
+	}
+	return metadata
+}
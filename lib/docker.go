@@ -0,0 +1,483 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/logger"
+	"github.com/salestock/sersan/utils"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const dockerAPIVersion = "v1.40"
+
+// Labels recording the docker section of the grid on its container
+const (
+	dockerNetworkLabel     = "sersan-docker-network"
+	dockerPublishHostLabel = "sersan-docker-publish-host"
+)
+
+// DockerClient Docker Engine API client
+type DockerClient struct {
+	Host   string
+	Client *http.Client
+}
+
+// DockerEngine Docker engine
+type DockerEngine struct {
+	GridBase GridBase
+	Caps     Caps
+}
+
+type dockerError struct {
+	Message string `json:"message"`
+}
+
+type dockerPortBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
+}
+
+type dockerContainer struct {
+	ID     string `json:"Id"`
+	Name   string `json:"Name"`
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	State struct {
+		Status   string `json:"Status"`
+		Running  bool   `json:"Running"`
+		ExitCode int    `json:"ExitCode"`
+		Error    string `json:"Error"`
+	} `json:"State"`
+	NetworkSettings struct {
+		IPAddress string                         `json:"IPAddress"`
+		Ports     map[string][]dockerPortBinding `json:"Ports"`
+		Networks  map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// DockerConfig Docker section of a grid
+type DockerConfig struct {
+	Network     string `yaml:"network"`
+	PublishHost string `yaml:"publishHost"`
+	ShmSize     string `yaml:"shmSize"`
+}
+
+var dockerClient *DockerClient
+var dockerOnce sync.Once
+
+func init() {
+	RegisterEngine(DockerType, EngineFactory{
+		Client: func() (Engine, error) { return GetDockerClient(), nil },
+		Starter: func(gridBase GridBase, caps Caps) GridStarter {
+			return DockerEngine{GridBase: gridBase, Caps: caps}
+		},
+		Config: func() interface{} { return newDockerConfig() },
+	})
+}
+
+// newDockerConfig Docker section defaults, from the environment
+func newDockerConfig() *DockerConfig {
+	conf := config.Get()
+	return &DockerConfig{Network: conf.DockerNetwork, PublishHost: conf.DockerPublishHost}
+}
+
+// dockerConfig Docker section of the grid
+func dockerConfig(grid *Grid) *DockerConfig {
+	if dc, ok := grid.EngineConfig.(*DockerConfig); ok {
+		return dc
+	}
+	return newDockerConfig()
+}
+
+// GetDockerClient Get docker client for DOCKER_HOST
+func GetDockerClient() *DockerClient {
+	dockerOnce.Do(func() {
+		conf := config.Get()
+		client, err := NewDockerClient(conf.DockerHost)
+		if err != nil {
+			logger.Errorf("Failed to get docker client: %v", err)
+			client = &DockerClient{Host: conf.DockerHost, Client: http.DefaultClient}
+		}
+		dockerClient = client
+	})
+	return dockerClient
+}
+
+// NewDockerClient Create docker client. The host is either a unix socket
+// (unix:///var/run/docker.sock) or a TCP address (tcp://host:2375 or http://host:2375).
+func NewDockerClient(host string) (*DockerClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &DockerClient{Host: "http://docker", Client: &http.Client{Transport: transport}}, nil
+	case "tcp", "http":
+		return &DockerClient{Host: "http://" + u.Host, Client: &http.Client{}}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported docker host %s", host)
+	}
+}
+
+func (c DockerClient) do(ctx context.Context, method string, path string, in interface{}, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, c.Host+"/"+dockerAPIVersion+path, body)
+	if err != nil {
+		return 0, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var dockerErr dockerError
+		json.NewDecoder(resp.Body).Decode(&dockerErr)
+		return resp.StatusCode, fmt.Errorf("Docker %s %s: %d %s", method, path, resp.StatusCode, dockerErr.Message)
+	}
+	if out != nil {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+func (c DockerClient) pull(ctx context.Context, image string) error {
+	name, tag := image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+	logger.FromContext(ctx).Infof("Pulling image %s", image)
+	_, err := c.do(ctx, http.MethodPost, "/images/create?fromImage="+url.QueryEscape(name)+"&tag="+url.QueryEscape(tag), nil, nil)
+	return err
+}
+
+// CreateGrid Create and start browser container
+func (c DockerClient) CreateGrid(ctx context.Context, gridBase *GridBase) (name string, err error) {
+	ctx, end := traceStep(ctx, "CreateGrid")
+	defer func() { end(name, err) }()
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	conf := config.Get()
+	dc := dockerConfig(gridBase.Grid)
+	entryPoint := "/opt/bin/entry_point.sh"
+	if gridBase.Grid.EntryPoint != "" {
+		entryPoint = gridBase.Grid.EntryPoint
+	}
+	gridTimeout := gridBase.Lifetime()
+	memoryLimit := conf.MemoryLimit
+	if gridBase.Grid.MemoryLimit != "" {
+		memoryLimit = gridBase.Grid.MemoryLimit
+	}
+	cpuLimit := conf.CPULimit
+	if gridBase.Grid.CPULimit != "" {
+		cpuLimit = gridBase.Grid.CPULimit
+	}
+	shmSize := "256Mi"
+	if dc.ShmSize != "" {
+		shmSize = dc.ShmSize
+	}
+	memory, err := resource.ParseQuantity(memoryLimit)
+	if err != nil {
+		return
+	}
+	cpu, err := resource.ParseQuantity(cpuLimit)
+	if err != nil {
+		return
+	}
+	shm, err := resource.ParseQuantity(shmSize)
+	if err != nil {
+		return
+	}
+
+	exposedPorts := map[string]struct{}{}
+	portBindings := map[string][]dockerPortBinding{}
+	for _, port := range []int32{gridBase.Grid.Port, gridBase.Grid.VNCPort} {
+		if port == 0 {
+			continue
+		}
+		key := fmt.Sprintf("%d/tcp", port)
+		exposedPorts[key] = struct{}{}
+		if dc.Network == "" {
+			portBindings[key] = []dockerPortBinding{{HostIP: dc.PublishHost}}
+		}
+	}
+	labels := gridBase.InstanceLabels()
+	labels["app"] = "sersan-grid-" + conf.GridLabel
+	labels[dockerNetworkLabel] = dc.Network
+	labels[dockerPublishHostLabel] = dc.PublishHost
+
+	spec := map[string]interface{}{
+		"Image":        gridBase.Grid.Image,
+		"Entrypoint":   []string{"/bin/sh"},
+		"Cmd":          []string{"-c", fmt.Sprintf("%s & sleep %d; exit 0", entryPoint, gridTimeout)},
+		"Labels":       labels,
+		"ExposedPorts": exposedPorts,
+		"HostConfig": map[string]interface{}{
+			"AutoRemove":   true,
+			"PortBindings": portBindings,
+			"NetworkMode":  dc.Network,
+			"ShmSize":      shm.Value(),
+			"Memory":       memory.Value(),
+			"NanoCpus":     cpu.MilliValue() * 1000000,
+		},
+	}
+
+	name = "sersan-grid-" + conf.GridLabel + "-" + utils.GenerateUUID()
+	log := logger.FromContext(ctx).With(logger.Instance, name)
+	log.Debugf("Creating container")
+	status, err := c.do(ctx, http.MethodPost, "/containers/create?name="+name, spec, nil)
+	if status == http.StatusNotFound {
+		if err = c.pull(ctx, gridBase.Grid.Image); err != nil {
+			return
+		}
+		_, err = c.do(ctx, http.MethodPost, "/containers/create?name="+name, spec, nil)
+	}
+	if err != nil {
+		log.Errorf("Failed to create container: %v", err)
+		// The container may exist even though its creation failed or was
+		// cancelled
+		c.DeleteGrid(name)
+		return
+	}
+
+	_, err = c.do(ctx, http.MethodPost, "/containers/"+name+"/start", nil, nil)
+	if err != nil {
+		log.Errorf("Failed to start container: %v", err)
+		c.DeleteGrid(name)
+		return
+	}
+	log.Infof("Container created")
+	return
+}
+
+// DeleteGrid Remove container
+func (c DockerClient) DeleteGrid(name string) (err error) {
+	if !strings.HasPrefix(name, "sersan-grid") {
+		err = errors.New("Grid name prefix must be sersan-grid")
+		return
+	}
+
+	status, err := c.do(context.Background(), http.MethodDelete, "/containers/"+name+"?force=true&v=true", nil, nil)
+	if err != nil && status != http.StatusNotFound {
+		return err
+	}
+
+	logger.With(logger.Instance, name).Infof("Container deleted")
+	return nil
+}
+
+// Logs Stream the stdout and stderr of the container
+func (c DockerClient) Logs(ctx context.Context, name string, tail int64, follow bool) (io.ReadCloser, error) {
+	if !strings.HasPrefix(name, "sersan-grid") {
+		return nil, errors.New("Grid name prefix must be sersan-grid")
+	}
+	path := fmt.Sprintf("/containers/%s/logs?stdout=1&stderr=1&tail=%d&follow=%t", name, tail, follow)
+	req, err := http.NewRequest(http.MethodGet, c.Host+"/"+dockerAPIVersion+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Docker GET %s: %d", path, resp.StatusCode)
+	}
+	return &dockerLogReader{body: resp.Body}, nil
+}
+
+// dockerLogReader Log stream of a container without TTY, whose frames are
+// prefixed by the stream and their size
+type dockerLogReader struct {
+	body  io.ReadCloser
+	frame int
+}
+
+func (r *dockerLogReader) Read(p []byte) (int, error) {
+	for r.frame == 0 {
+		var header [8]byte
+		if _, err := io.ReadFull(r.body, header[:]); err != nil {
+			return 0, err
+		}
+		r.frame = int(header[4])<<24 | int(header[5])<<16 | int(header[6])<<8 | int(header[7])
+	}
+	if len(p) > r.frame {
+		p = p[:r.frame]
+	}
+	n, err := r.body.Read(p)
+	r.frame -= n
+	return n, err
+}
+
+func (r *dockerLogReader) Close() error {
+	return r.body.Close()
+}
+
+func (c DockerClient) inspect(ctx context.Context, name string) (container dockerContainer, err error) {
+	_, err = c.do(ctx, http.MethodGet, "/containers/"+name+"/json", nil, &container)
+	return
+}
+
+// WaitUntilReady Wait until the container is running and return its
+// address, as per the docker section of the grid it was created for
+func (c DockerClient) WaitUntilReady(ctx context.Context, name string, timeout int32) (ip string, err error) {
+	ctx, end := traceStep(ctx, "WaitUntilReady")
+	defer func() { end(name, err) }()
+	container, err := c.inspect(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return c.waitRunning(ctx, name, timeout, containerDockerConfig(container))
+}
+
+// containerDockerConfig Docker section of the grid of the container, from
+// its labels. Containers created without them get the defaults.
+func containerDockerConfig(container dockerContainer) *DockerConfig {
+	labels := container.Config.Labels
+	if _, ok := labels[dockerNetworkLabel]; !ok {
+		return newDockerConfig()
+	}
+	return &DockerConfig{Network: labels[dockerNetworkLabel], PublishHost: labels[dockerPublishHostLabel]}
+}
+
+func (c DockerClient) waitRunning(ctx context.Context, name string, timeout int32, dc *DockerConfig) (ip string, err error) {
+	waitTimeout := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+	defer waitTimeout.Stop()
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-waitTimeout.C:
+			return "", fmt.Errorf("Container is not running until %d ms", timeout)
+		case <-tick.C:
+			container, err := c.inspect(ctx, name)
+			if err != nil {
+				logger.FromContext(ctx).With(logger.Instance, name).Errorf("Failed to inspect container: %v", err)
+				return "", err
+			}
+			if container.State.Status == "exited" || container.State.Status == "dead" {
+				return "", fmt.Errorf("Container %s %s with code %d: %s", name, container.State.Status, container.State.ExitCode, container.State.Error)
+			}
+			if !container.State.Running {
+				continue
+			}
+			logger.FromContext(ctx).With(logger.Instance, name).Infof("Container is ready")
+			if dc.Network == "" {
+				return dc.PublishHost, nil
+			}
+			if network, ok := container.NetworkSettings.Networks[dc.Network]; ok && network.IPAddress != "" {
+				return network.IPAddress, nil
+			}
+			return "", fmt.Errorf("Container %s has no address in network %s", name, dc.Network)
+		}
+	}
+}
+
+// Port Host port reaching the container port. It is the container port
+// itself when containers share a network with Sersan.
+func (c DockerClient) Port(ctx context.Context, name string, port int32, dc *DockerConfig) (string, error) {
+	if dc.Network != "" || port == 0 {
+		return strconv.Itoa(int(port)), nil
+	}
+	container, err := c.inspect(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	bindings := container.NetworkSettings.Ports[fmt.Sprintf("%d/tcp", port)]
+	if len(bindings) == 0 || bindings[0].HostPort == "" {
+		return "", fmt.Errorf("Port %d of container %s is not published", port, name)
+	}
+	return bindings[0].HostPort, nil
+}
+
+// StartWithCancel Start container with cancel
+func (d DockerEngine) StartWithCancel(ctx context.Context) (*StartedGrid, error) {
+	conf := config.Get()
+	dc := dockerConfig(d.GridBase.Grid)
+	dockerClient := GetDockerClient()
+	name, err := dockerClient.CreateGrid(ctx, &d.GridBase)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := dockerClient.waitRunning(ctx, name, conf.StartupTimeout, dc)
+	if err != nil {
+		dockerClient.DeleteGrid(name)
+		return nil, err
+	}
+	port, err := dockerClient.Port(ctx, name, d.GridBase.Grid.Port, dc)
+	if err != nil {
+		dockerClient.DeleteGrid(name)
+		return nil, err
+	}
+	vncPort, err := dockerClient.Port(ctx, name, d.GridBase.Grid.VNCPort, dc)
+	if err != nil {
+		dockerClient.DeleteGrid(name)
+		return nil, err
+	}
+	u, err := url.Parse("http://" + ip + ":" + port)
+	if err != nil {
+		dockerClient.DeleteGrid(name)
+		return nil, err
+	}
+
+	if d.GridBase.Grid.HealthCheck != "" {
+		err = utils.WaitUntilGridReady(ctx, u, d.GridBase.Grid.HealthCheck)
+		if err != nil {
+			dockerClient.DeleteGrid(name)
+			return nil, err
+		}
+	}
+
+	s := StartedGrid{
+		Name:    name,
+		URL:     u,
+		Grid:    d.GridBase,
+		VNCPort: vncPort,
+		Cancel: func() {
+			dockerClient.DeleteGrid(name)
+		},
+	}
+
+	return &s, nil
+}
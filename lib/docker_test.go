@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// dockerStub Docker Engine API stub knowing a single container, whose image
+// must be pulled before it is created
+type dockerStub struct {
+	lock    sync.Mutex
+	pulled  bool
+	labels  map[string]string
+	running bool
+	calls   []string
+}
+
+func (d *dockerStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/"+dockerAPIVersion)
+	d.calls = append(d.calls, r.Method+" "+p)
+	reply := func(status int, value interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(value)
+	}
+	switch {
+	case r.Method == http.MethodPost && p == "/images/create":
+		if r.URL.Query().Get("fromImage") != "selenium/standalone-chrome" || r.URL.Query().Get("tag") != "83.0" {
+			reply(http.StatusBadRequest, dockerError{Message: "unexpected image " + r.URL.RawQuery})
+			return
+		}
+		d.pulled = true
+		reply(http.StatusOK, nil)
+	case r.Method == http.MethodPost && p == "/containers/create":
+		if !d.pulled {
+			reply(http.StatusNotFound, dockerError{Message: "No such image"})
+			return
+		}
+		var spec struct {
+			Labels map[string]string
+		}
+		json.NewDecoder(r.Body).Decode(&spec)
+		d.labels = spec.Labels
+		reply(http.StatusCreated, map[string]string{"Id": "c1"})
+	case d.labels == nil:
+		reply(http.StatusNotFound, dockerError{Message: "No such container"})
+	case r.Method == http.MethodPost && strings.HasSuffix(p, "/start"):
+		d.running = true
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && strings.HasSuffix(p, "/json"):
+		var container dockerContainer
+		container.Config.Labels = d.labels
+		container.State.Running = d.running
+		container.NetworkSettings.Ports = map[string][]dockerPortBinding{"4444/tcp": {{HostIP: "127.0.0.1", HostPort: "32768"}}}
+		reply(http.StatusOK, container)
+	case r.Method == http.MethodDelete:
+		d.labels = nil
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		reply(http.StatusNotFound, dockerError{Message: "page not found"})
+	}
+}
+
+func TestDockerGridLifecycle(t *testing.T) {
+	stub := &dockerStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	client := DockerClient{Host: server.URL, Client: server.Client()}
+	gridBase := &GridBase{Name: "chrome", Version: "83.0", Grid: &Grid{
+		Image:        "selenium/standalone-chrome:83.0",
+		Port:         4444,
+		EngineConfig: &DockerConfig{PublishHost: "10.0.0.1"},
+	}}
+	ctx := context.Background()
+
+	name, err := client.CreateGrid(ctx, gridBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"POST /containers/create", "POST /images/create", "POST /containers/create", "POST /containers/" + name + "/start"}
+	if strings.Join(stub.calls, ",") != strings.Join(want, ",") {
+		t.Errorf("Docker calls %v, want %v", stub.calls, want)
+	}
+
+	ip, err := client.WaitUntilReady(ctx, name, 5000)
+	if err != nil || ip != "10.0.0.1" {
+		t.Errorf("Container address %q (%v), want the publish host of the grid", ip, err)
+	}
+	port, err := client.Port(ctx, name, 4444, dockerConfig(gridBase.Grid))
+	if err != nil || port != "32768" {
+		t.Errorf("Container port %q (%v), want 32768", port, err)
+	}
+
+	if err := client.DeleteGrid(name); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+	// The container is gone already, e.g. auto removed
+	if err := client.DeleteGrid(name); err != nil {
+		t.Errorf("Delete of a missing container failed: %v", err)
+	}
+}
+
+func TestDockerCreateCancelled(t *testing.T) {
+	stub := &dockerStub{pulled: true}
+	created := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stub.ServeHTTP(httptest.NewRecorder(), r)
+		if strings.HasSuffix(r.URL.Path, "/containers/create") {
+			// Docker creates the container, but the hub gives up before the answer
+			close(created)
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	client := DockerClient{Host: server.URL, Client: server.Client()}
+	gridBase := &GridBase{Name: "chrome", Version: "83.0", Grid: &Grid{Image: "selenium/standalone-chrome:83.0", Port: 4444}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-created
+		cancel()
+	}()
+	if _, err := client.CreateGrid(ctx, gridBase); err == nil {
+		t.Fatal("Created a grid once cancelled")
+	}
+	stub.lock.Lock()
+	defer stub.lock.Unlock()
+	if stub.labels != nil {
+		t.Errorf("Container left behind, Docker calls %v", stub.calls)
+	}
+}
+
+func TestDockerLogReader(t *testing.T) {
+	var stream bytes.Buffer
+	for _, frame := range []struct {
+		stream byte
+		line   string
+	}{{1, "started\n"}, {2, "warning\n"}, {1, "ready\n"}} {
+		stream.Write([]byte{frame.stream, 0, 0, 0, 0, 0, 0, byte(len(frame.line))})
+		stream.WriteString(frame.line)
+	}
+	logs, err := ioutil.ReadAll(&dockerLogReader{body: ioutil.NopCloser(&stream)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(logs) != "started\nwarning\nready\n" {
+		t.Errorf("Logs %q", logs)
+	}
+}
@@ -1,54 +1,113 @@
 package lib
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"io"
 	"strings"
+	"sync"
 )
 
 const (
 	KubernetesType    = "kubernetes"
 	ComputeEngineType = "compute"
+	DockerType        = "docker"
+	RemoteType        = "remote"
+	FakeType          = "fake"
 )
 
+// Engine Engine client. CreateGrid and WaitUntilReady must abort as soon as
+// the given context is done.
 type Engine interface {
-	CreateGrid(gridBase *GridBase) (string, error)
+	CreateGrid(ctx context.Context, gridBase *GridBase) (string, error)
 	DeleteGrid(name string) error
-	WaitUntilReady(name string, timeout int32) (string, error)
-}
-
-func GetEngineClient(engineType string) (engine Engine) {
-	switch strings.ToLower(engineType) {
-	case KubernetesType:
-		log.Printf("Get kubernetes client")
-		return GetKubernetesClient()
-	case ComputeEngineType:
-		log.Printf("Get compute engine client")
-		return GetComputeClient()
-	default:
-		log.Printf("Get default kubernetes client")
-		return GetKubernetesClient()
+	WaitUntilReady(ctx context.Context, name string, timeout int32) (string, error)
+}
+
+// PreemptionChecker Engine client whose grids may be preempted
+type PreemptionChecker interface {
+	Preempted(ctx context.Context, name string) (bool, error)
+}
+
+// GridVerifier Engine client able to tell whether a grid is still the
+// instance a session was created on
+type GridVerifier interface {
+	// VerifyGrid Whether the grid named name with the given UID still runs
+	// on host. It answers false once the grid is gone, or when its address
+	// was reused by another grid.
+	VerifyGrid(name string, uid string, host string) (bool, error)
+}
+
+// LogStreamer Engine client able to stream the logs of its grids
+type LogStreamer interface {
+	// Logs Last tail lines of the grid logs, followed until ctx is done when
+	// follow is set
+	Logs(ctx context.Context, name string, tail int64, follow bool) (io.ReadCloser, error)
+}
+
+// EngineFactory Registration of an engine
+type EngineFactory struct {
+	// Client Engine client, used to delete grids and check their state. It
+	// fails when the engine cannot be reached from this hub.
+	Client func() (Engine, error)
+	// Starter Grid starter of a new session
+	Starter func(gridBase GridBase, caps Caps) GridStarter
+	// Config New engine config section with its defaults, into which the grid
+	// block named after the engine is decoded. Nil when the engine has no
+	// config section.
+	Config func() interface{}
+	// Pool Warm pool backend, nil when the engine has no warm pool
+	Pool PoolBackend
+}
+
+var engineLock sync.RWMutex
+var engineFactories = make(map[string]EngineFactory)
+
+// RegisterEngine Register an engine under name. Engines register from the
+// init function of their file.
+func RegisterEngine(name string, factory EngineFactory) {
+	engineLock.Lock()
+	defer engineLock.Unlock()
+	name = EngineName(name)
+	if _, ok := engineFactories[name]; ok {
+		panic("Engine " + name + " is registered twice")
+	}
+	engineFactories[name] = factory
+}
+
+// EngineName Normalized engine name. Grids without engine run on Kubernetes.
+func EngineName(engineType string) string {
+	if engineType == "" {
+		return KubernetesType
+	}
+	return strings.ToLower(engineType)
+}
+
+// LookupEngine Get registered engine
+func LookupEngine(engineType string) (EngineFactory, error) {
+	engineLock.RLock()
+	defer engineLock.RUnlock()
+	factory, ok := engineFactories[EngineName(engineType)]
+	if !ok {
+		return EngineFactory{}, fmt.Errorf("Unknown engine %s", engineType)
+	}
+	return factory, nil
+}
+
+// GetEngineClient Get client of the engine
+func GetEngineClient(engineType string) (Engine, error) {
+	factory, err := LookupEngine(engineType)
+	if err != nil {
+		return nil, err
 	}
+	return factory.Client()
 }
 
-func GetGridStarter(engineType string, gridBase GridBase, caps Caps) (grid GridStarter) {
-	switch strings.ToLower(engineType) {
-	case KubernetesType:
-		log.Printf("Get kubernetes")
-		return Kubernetes{
-			GridBase: gridBase,
-			Caps:     caps,
-		}
-	case ComputeEngineType:
-		log.Printf("Get compute engine")
-		return ComputeEngine{
-			GridBase: gridBase,
-			Caps:     caps,
-		}
-	default:
-		log.Printf("Get default engine")
-		return Kubernetes{
-			GridBase: gridBase,
-			Caps:     caps,
-		}
+// GetGridStarter Get grid starter of the engine
+func GetGridStarter(engineType string, gridBase GridBase, caps Caps) (GridStarter, error) {
+	factory, err := LookupEngine(engineType)
+	if err != nil {
+		return nil, err
 	}
+	return factory.Starter(gridBase, caps), nil
 }
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegisterEngine(t *testing.T) {
+	// Engines stay registered when the test is run again
+	if _, err := LookupEngine("test-registry"); err != nil {
+		RegisterEngine("Test-Registry", EngineFactory{
+			Starter: func(gridBase GridBase, caps Caps) GridStarter { return FakeEngine{GridBase: gridBase, Caps: caps} },
+		})
+	}
+	factory, err := LookupEngine("test-registry")
+	if err != nil || factory.Config != nil || factory.Pool != nil {
+		t.Errorf("Got %+v and %v, want the registered engine", factory, err)
+	}
+	if _, err := GetGridStarter("TEST-REGISTRY", GridBase{}, Caps{}); err != nil {
+		t.Errorf("No starter of the registered engine: %v", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Engine registered twice")
+			}
+		}()
+		RegisterEngine("test-registry", EngineFactory{})
+	}()
+
+	if _, err := LookupEngine("kubernets"); err == nil || err.Error() != "Unknown engine kubernets" {
+		t.Errorf("Got %v, want unknown engine error", err)
+	}
+	if _, err := GetEngineClient("kubernets"); err == nil {
+		t.Error("Got client of an unknown engine")
+	}
+	if name := EngineName(""); name != KubernetesType {
+		t.Errorf("Grids without engine run on %s, want %s", name, KubernetesType)
+	}
+	for _, name := range []string{KubernetesType, ComputeEngineType, DockerType, RemoteType, FakeType} {
+		if factory, err := LookupEngine(name); err != nil || factory.Config == nil {
+			t.Errorf("Engine %s not registered with a config section: %v", name, err)
+		}
+	}
+}
+
+func TestLoadEngineSections(t *testing.T) {
+	if _, err := LookupEngine("test-sections"); err != nil {
+		RegisterEngine("test-sections", EngineFactory{})
+	}
+	gc, err := loadTestGrids(t, `
+chrome:
+  versions:
+    70.0:
+      kubernetes:
+        nodeSelector:
+          pool: "browsers"
+    71.0:
+      engine: "docker"
+      docker:
+        shmSize: "1Gi"
+    72.0:
+      engine: "remote"
+      remote:
+        balance: "weighted"
+        upstreams:
+          - url: "http://hub:4444/wd/hub"
+            weight: 2
+    73.0:
+      engine: "compute"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grid, _, _ := gc.Find("chrome", "70.0")
+	if kc, ok := grid.EngineConfig.(*KubernetesConfig); !ok || kc.NodeSelector["pool"] != "browsers" {
+		t.Errorf("Unexpected kubernetes config %+v", grid.EngineConfig)
+	}
+	grid, _, _ = gc.Find("chrome", "71.0")
+	if dc := dockerConfig(grid); dc.ShmSize != "1Gi" || dc.Network != newDockerConfig().Network {
+		t.Errorf("Unexpected docker config %+v, want the block over the defaults", dc)
+	}
+	grid, _, _ = gc.Find("chrome", "72.0")
+	if rc := remoteConfig(grid); rc.Balance != Weighted || len(rc.Upstreams) != 1 || rc.Upstreams[0].Weight != 2 {
+		t.Errorf("Unexpected remote config %+v", rc)
+	}
+	grid, _, _ = gc.Find("chrome", "73.0")
+	if cc, ok := grid.EngineConfig.(*ComputeConfig); !ok || cc.InsertRetries != newComputeConfig().InsertRetries || len(cc.Zones) != 1 {
+		t.Errorf("Unexpected compute config %+v, want the defaults without block", grid.EngineConfig)
+	}
+
+	for grids, want := range map[string]string{
+		`
+      engine: "test-sections"
+      test-sections:
+        option: true`: "The test-sections engine has no options",
+		`
+      engine: "docker"
+      docker:
+        shmsize: "1Gi"`: "field shmsize not found",
+		`
+      engine: "remote"
+      remote: "http://hub:4444/wd/hub"`: "cannot unmarshal",
+	} {
+		_, err := loadTestGrids(t, `
+chrome:
+  versions:
+    70.0:`+grids+`
+`)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", grids, err, want)
+		}
+	}
+}
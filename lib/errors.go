@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+
+	"github.com/salestock/sersan/tracing"
+)
+
+// Grid start error classes
+const (
+	ErrorQuota     = "quota"
+	ErrorCapacity  = "capacity"
+	ErrorConfig    = "config"
+	ErrorTransient = "transient"
+	ErrorCancelled = "cancelled"
+	ErrorUnknown   = "unknown"
+)
+
+// gridStartErrors Failed grid starts by engine and error class, served
+// with the other expvars on /debug/vars
+var gridStartErrors = expvar.NewMap("grid_start_errors")
+
+// GridError Classified failure to start a grid
+type GridError struct {
+	Class   string
+	Code    string
+	Message string
+}
+
+func (e *GridError) Error() string {
+	return fmt.Sprintf("%s error %s: %s", e.Class, e.Code, e.Message)
+}
+
+// ErrorClass Class of a grid start error
+func ErrorClass(err error) string {
+	switch e := err.(type) {
+	case *GridError:
+		return e.Class
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return ErrorCancelled
+	}
+	return ErrorUnknown
+}
+
+// countingStarter Count the failures of a grid starter. The grid start is
+// logged with the fields of the grid base and traced as the StartGrid span.
+type countingStarter struct {
+	GridStarter
+	engine   string
+	gridBase GridBase
+}
+
+func (s countingStarter) StartWithCancel(ctx context.Context) (*StartedGrid, error) {
+	ctx, span := tracing.Start(s.gridBase.LogContext(ctx), "StartGrid")
+	span.SetAttribute("sersan.grid", s.gridBase.Key())
+	span.SetAttribute("sersan.engine", EngineName(s.engine))
+	if s.gridBase.DeviceProfile != "" {
+		span.SetAttribute("sersan.device_profile", s.gridBase.DeviceProfile)
+	}
+	grid, err := s.GridStarter.StartWithCancel(ctx)
+	if err != nil {
+		gridStartErrors.Add(EngineName(s.engine)+"."+ErrorClass(err), 1)
+		span.SetAttribute("sersan.error_class", ErrorClass(err))
+	} else {
+		span.SetAttribute("sersan.instance", grid.Name)
+	}
+	span.End(err)
+	return grid, err
+}
+
+// traceStep Start the span of a grid start step. The returned function ends
+// it with the grid instance name and the error of the step.
+func traceStep(ctx context.Context, step string) (context.Context, func(instance string, err error)) {
+	ctx, span := tracing.Start(ctx, step)
+	return ctx, func(instance string, err error) {
+		if instance != "" {
+			span.SetAttribute("sersan.instance", instance)
+		}
+		span.End(err)
+	}
+}
@@ -0,0 +1,298 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/logger"
+	"github.com/salestock/sersan/utils"
+)
+
+// Session lifecycle event types
+const (
+	EventSessionRequested = "session.requested"
+	EventGridStarted      = "grid.started"
+	EventSessionCreated   = "session.created"
+	EventSessionFailed    = "session.failed"
+	EventSessionDeleted   = "session.deleted"
+	EventSessionReaped    = "session.reaped"
+)
+
+const (
+	// SignatureHeader HMAC-SHA256 of the webhook body, as sha256=<hex>
+	SignatureHeader = "X-Sersan-Signature"
+
+	webhookMaxBackoff   = 30 * time.Second
+	webhookFlushTimeout = 5 * time.Second
+)
+
+// droppedEvents Webhook events dropped because the sink queue was full,
+// served with the other expvars on /debug/vars
+var droppedEvents = expvar.NewMap("webhook_events_dropped")
+
+// Event Session lifecycle event. Duration is the time since the session
+// was requested, or the session lifetime for ended sessions, in seconds.
+// Caps are the requested capabilities of session.requested events and the
+// capabilities returned by the grid for session.created events. Phases are
+// the seconds spent in each startup phase so far, by span name.
+type Event struct {
+	ID        string             `json:"id"`
+	Type      string             `json:"type"`
+	Time      time.Time          `json:"time"`
+	RequestID string             `json:"requestId,omitempty"`
+	SessionID string             `json:"sessionId,omitempty"`
+	User      string             `json:"user,omitempty"`
+	Remote    string             `json:"remote,omitempty"`
+	Grid      string             `json:"grid,omitempty"`
+	Engine    string             `json:"engine,omitempty"`
+	Instance  string             `json:"instance,omitempty"`
+	Browser   string             `json:"browser,omitempty"`
+	Version   string             `json:"version,omitempty"`
+	Caps      json.RawMessage    `json:"caps,omitempty"`
+	Duration  float64            `json:"duration,omitempty"`
+	Phases    map[string]float64 `json:"phases,omitempty"`
+	Attempts  int                `json:"attempts,omitempty"`
+	Reason    string             `json:"reason,omitempty"`
+}
+
+// EventBus Fan out of session lifecycle events to observers, webhook sinks
+// and live subscribers. Observers are called with every event. Publishing
+// never blocks on sinks and subscribers, events are dropped for those which
+// do not keep up.
+type EventBus struct {
+	lock        sync.Mutex
+	subscribers map[chan Event]bool
+	observers   []func(Event)
+	Sinks       []*WebhookSink
+}
+
+// WebhookSink Webhook receiving the events, delivered in order with
+// retries from a bounded queue
+type WebhookSink struct {
+	URL     string
+	Secret  string
+	Events  map[string]bool
+	Retries int
+	Client  *http.Client
+	queue   chan Event
+}
+
+var eventBus *EventBus
+var eventBusOnce sync.Once
+
+// GetEventBus Get event bus, with a sink for each of WEBHOOK_URLS
+func GetEventBus() *EventBus {
+	eventBusOnce.Do(func() {
+		conf := config.Get()
+		eventBus = &EventBus{subscribers: make(map[chan Event]bool)}
+		var events map[string]bool
+		if len(conf.WebhookEvents) > 0 {
+			events = make(map[string]bool)
+			for _, event := range conf.WebhookEvents {
+				events[event] = true
+			}
+		}
+		for _, url := range conf.WebhookURLs {
+			eventBus.Sinks = append(eventBus.Sinks, &WebhookSink{
+				URL:     url,
+				Secret:  conf.WebhookSecret,
+				Events:  events,
+				Retries: conf.WebhookRetries,
+				Client:  &http.Client{Timeout: time.Duration(conf.WebhookTimeout) * time.Millisecond},
+				queue:   make(chan Event, conf.WebhookQueueSize),
+			})
+		}
+	})
+	return eventBus
+}
+
+// Publish Send the event to the sinks and subscribers
+func (b *EventBus) Publish(event Event) {
+	event.ID = utils.GenerateUUID()
+	event.Time = time.Now().UTC()
+	b.lock.Lock()
+	observers := b.observers
+	b.lock.Unlock()
+	for _, observer := range observers {
+		observer(event)
+	}
+	for _, sink := range b.Sinks {
+		sink.enqueue(event)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// Observe Call observer with every event published from now on, before it
+// is published to sinks and subscribers. Observers never miss events and
+// must not block for long.
+func (b *EventBus) Observe(observer func(Event)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.observers = append(b.observers, observer)
+}
+
+// Subscribe Receive the events published from now on, until unsubscribed
+func (b *EventBus) Subscribe(size int) (<-chan Event, func()) {
+	subscriber := make(chan Event, size)
+	b.lock.Lock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Event]bool)
+	}
+	b.subscribers[subscriber] = true
+	b.lock.Unlock()
+	return subscriber, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		delete(b.subscribers, subscriber)
+	}
+}
+
+// EndedEvent Event of an ended session, with the session lifetime
+func EndedEvent(eventType string, sessionID string, sessionInfo *utils.SessionInfo, reason string) Event {
+	event := Event{
+		Type:      eventType,
+		RequestID: sessionInfo.RequestID,
+		SessionID: sessionID,
+		User:      sessionInfo.Owner,
+		Grid:      sessionInfo.Grid,
+		Engine:    EngineName(sessionInfo.Engine),
+		Instance:  sessionInfo.ServiceName,
+		Reason:    reason,
+	}
+	if sessionInfo.Created > 0 {
+		event.Duration = time.Since(time.Unix(sessionInfo.Created, 0)).Seconds()
+	}
+	return event
+}
+
+// Run Deliver webhooks until ctx is done. Queued events are then delivered
+// once more without retries.
+func (b *EventBus) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, sink := range b.Sinks {
+		wg.Add(1)
+		go func(sink *WebhookSink) {
+			defer wg.Done()
+			sink.Run(ctx)
+		}(sink)
+	}
+	wg.Wait()
+}
+
+func (s *WebhookSink) enqueue(event Event) {
+	if s.Events != nil && !s.Events[event.Type] {
+		return
+	}
+	select {
+	case s.queue <- event:
+	default:
+		droppedEvents.Add(redactURL(s.URL), 1)
+	}
+}
+
+// Run Deliver queued events until ctx is done
+func (s *WebhookSink) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			s.flush()
+			return
+		case event := <-s.queue:
+			s.deliver(ctx, event)
+		}
+	}
+}
+
+func (s *WebhookSink) flush() {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookFlushTimeout)
+	defer cancel()
+	for {
+		select {
+		case event := <-s.queue:
+			if _, err := s.post(ctx, event); err != nil {
+				logger.Warnf("Failed to deliver %s event %s to %s: %v", event.Type, event.ID, redactURL(s.URL), err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// deliver Post the event, retrying with exponential backoff on network
+// errors, 429 and 5xx
+func (s *WebhookSink) deliver(ctx context.Context, event Event) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retryable, err := s.post(ctx, event)
+		if err == nil {
+			return
+		}
+		if !retryable || attempt >= s.Retries {
+			logger.Errorf("Failed to deliver %s event %s to %s: %v", event.Type, event.ID, redactURL(s.URL), err)
+			return
+		}
+		logger.Debugf("Failed to deliver %s event %s to %s, retrying in %v: %v", event.Type, event.ID, redactURL(s.URL), backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+func (s *WebhookSink) post(ctx context.Context, event Event) (bool, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sersan-Event", event.Type)
+	req.Header.Set("X-Sersan-Delivery", event.ID)
+	if s.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(s.Secret, body))
+	}
+	resp, err := s.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("Webhook returned status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("Webhook returned status %d", resp.StatusCode)
+	}
+}
+
+// Sign Webhook signature of body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookRetriesAndSigns(t *testing.T) {
+	received := make(chan Event, 1)
+	calls := 0
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if got, want := r.Header.Get(SignatureHeader), Sign("secret", body); got != want {
+			t.Errorf("Signature %s, want %s", got, want)
+		}
+		var event Event
+		json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer webhook.Close()
+
+	sink := &WebhookSink{
+		URL:     webhook.URL,
+		Secret:  "secret",
+		Events:  map[string]bool{EventSessionCreated: true},
+		Retries: 1,
+		Client:  webhook.Client(),
+		queue:   make(chan Event, 2),
+	}
+	bus := &EventBus{Sinks: []*WebhookSink{sink}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Run(ctx)
+
+	bus.Publish(Event{Type: EventSessionRequested})
+	bus.Publish(Event{Type: EventSessionCreated, SessionID: "s1"})
+	select {
+	case event := <-received:
+		if event.Type != EventSessionCreated || event.SessionID != "s1" || event.ID == "" {
+			t.Errorf("Unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook was not retried")
+	}
+}
@@ -0,0 +1,281 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/salestock/sersan/logger"
+	"github.com/salestock/sersan/utils"
+)
+
+// FakeConfig Fake section of a grid
+type FakeConfig struct {
+	// StartError Class of the error failing every grid start, e.g. capacity
+	StartError string `yaml:"startError"`
+	// SlowNewSessions Number of first new session requests answered only
+	// after NewSessionDelay milliseconds
+	SlowNewSessions int `yaml:"slowNewSessions"`
+	NewSessionDelay int `yaml:"newSessionDelay"`
+	// UnavailableGrids Number of first grids of the section answering every
+	// new session request with 503
+	UnavailableGrids int `yaml:"unavailableGrids"`
+	// CommandDelay Milliseconds before every command is answered
+	CommandDelay int `yaml:"commandDelay"`
+}
+
+// FakeClient Fake engine client. Fake grids are stub WebDriver servers
+// running in process, for tests and local development without a cluster.
+type FakeClient struct {
+	lock    sync.Mutex
+	grids   map[string]*FakeGrid
+	created map[*FakeConfig]int
+}
+
+// FakeEngine Fake engine
+type FakeEngine struct {
+	GridBase GridBase
+	Caps     Caps
+}
+
+// FakeGrid Stub WebDriver server of a fake grid
+type FakeGrid struct {
+	Name        string
+	UID         string
+	URL         *url.URL
+	config      FakeConfig
+	baseURL     string
+	server      *http.Server
+	lock        sync.Mutex
+	requests    int
+	unavailable bool
+	sessions    map[string]bool
+	commands    []string
+}
+
+var fakeClient *FakeClient
+var fakeOnce sync.Once
+
+func init() {
+	RegisterEngine(FakeType, EngineFactory{
+		Client: func() (Engine, error) { return GetFakeClient(), nil },
+		Starter: func(gridBase GridBase, caps Caps) GridStarter {
+			return FakeEngine{GridBase: gridBase, Caps: caps}
+		},
+		Config: func() interface{} { return &FakeConfig{} },
+	})
+}
+
+// GetFakeClient Get fake client
+func GetFakeClient() *FakeClient {
+	fakeOnce.Do(func() {
+		fakeClient = &FakeClient{grids: make(map[string]*FakeGrid), created: make(map[*FakeConfig]int)}
+	})
+	return fakeClient
+}
+
+// fakeConfig Fake section of the grid
+func fakeConfig(grid *Grid) FakeConfig {
+	if fc, ok := grid.EngineConfig.(*FakeConfig); ok {
+		return *fc
+	}
+	return FakeConfig{}
+}
+
+// CreateGrid Start a stub WebDriver server on a random local port
+func (c *FakeClient) CreateGrid(ctx context.Context, gridBase *GridBase) (name string, err error) {
+	ctx, end := traceStep(ctx, "CreateGrid")
+	defer func() { end(name, err) }()
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	grid := &FakeGrid{
+		Name:     "sersan-grid-fake-" + utils.GenerateUUID(),
+		UID:      utils.GenerateUUID(),
+		URL:      &url.URL{Scheme: "http", Host: listener.Addr().String()},
+		config:   fakeConfig(gridBase.Grid),
+		baseURL:  gridBase.Grid.BaseURL,
+		sessions: make(map[string]bool),
+	}
+	if fc, ok := gridBase.Grid.EngineConfig.(*FakeConfig); ok {
+		c.lock.Lock()
+		c.created[fc]++
+		grid.unavailable = c.created[fc] <= fc.UnavailableGrids
+		c.lock.Unlock()
+	}
+	grid.server = &http.Server{Handler: grid}
+	go grid.server.Serve(listener)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.grids[grid.Name] = grid
+	logger.FromContext(ctx).With(logger.Instance, grid.Name).Infof("Fake grid created")
+	return grid.Name, nil
+}
+
+// DeleteGrid Stop the stub server
+func (c *FakeClient) DeleteGrid(name string) error {
+	c.lock.Lock()
+	grid, ok := c.grids[name]
+	delete(c.grids, name)
+	c.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	logger.With(logger.Instance, name).Infof("Fake grid deleted")
+	return grid.server.Close()
+}
+
+// WaitUntilReady Fake grids are ready as soon as they are created
+func (c *FakeClient) WaitUntilReady(ctx context.Context, name string, timeout int32) (string, error) {
+	grid, ok := c.Grid(name)
+	if !ok {
+		return "", fmt.Errorf("Fake grid %s not found", name)
+	}
+	return grid.URL.Hostname(), nil
+}
+
+// VerifyGrid Whether the fake grid is still running on host
+func (c *FakeClient) VerifyGrid(name string, uid string, host string) (bool, error) {
+	grid, ok := c.Grid(name)
+	return ok && (uid == "" || grid.UID == uid) && grid.URL.Hostname() == host, nil
+}
+
+// Grid Running fake grid
+func (c *FakeClient) Grid(name string) (*FakeGrid, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	grid, ok := c.grids[name]
+	return grid, ok
+}
+
+// Sessions Number of open sessions
+func (g *FakeGrid) Sessions() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return len(g.sessions)
+}
+
+// Commands Commands received, as method and path below the session
+func (g *FakeGrid) Commands() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return append([]string(nil), g.commands...)
+}
+
+func (g *FakeGrid) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, g.baseURL)
+	switch {
+	case p == "/status":
+		g.reply(w, map[string]interface{}{"ready": true, "message": "fake grid"})
+	case p == "/session" && r.Method == http.MethodPost:
+		g.newSession(w, r)
+	case strings.HasPrefix(p, "/session/"):
+		g.command(w, r, strings.TrimPrefix(p, "/session/"))
+	default:
+		utils.WebDriverError(w, "unknown command", p, http.StatusNotFound)
+	}
+}
+
+func (g *FakeGrid) newSession(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Capabilities struct {
+			AlwaysMatch map[string]interface{} `json:"alwaysMatch"`
+		} `json:"capabilities"`
+		DesiredCapabilities map[string]interface{} `json:"desiredCapabilities"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.WebDriverError(w, "invalid argument", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if g.unavailable {
+		utils.WebDriverError(w, "session not created", "Fake grid unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	g.lock.Lock()
+	g.requests++
+	slow := g.requests <= g.config.SlowNewSessions
+	g.lock.Unlock()
+	if slow {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(time.Duration(g.config.NewSessionDelay) * time.Millisecond):
+		}
+	}
+
+	id := utils.GenerateUUID()
+	g.lock.Lock()
+	g.sessions[id] = true
+	g.lock.Unlock()
+	caps := body.Capabilities.AlwaysMatch
+	if caps == nil {
+		caps = body.DesiredCapabilities
+	}
+	g.reply(w, map[string]interface{}{"sessionId": id, "capabilities": caps})
+}
+
+func (g *FakeGrid) command(w http.ResponseWriter, r *http.Request, p string) {
+	select {
+	case <-r.Context().Done():
+		return
+	case <-time.After(time.Duration(g.config.CommandDelay) * time.Millisecond):
+	}
+	id := strings.SplitN(p, "/", 2)[0]
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.sessions[id] {
+		utils.WebDriverError(w, "invalid session id", "Unknown session "+id, http.StatusNotFound)
+		return
+	}
+	command := strings.TrimPrefix(p, id)
+	g.commands = append(g.commands, r.Method+" "+command)
+	if r.Method == http.MethodDelete && command == "" {
+		delete(g.sessions, id)
+	}
+	g.reply(w, nil)
+}
+
+func (g *FakeGrid) reply(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"value": value})
+}
+
+// StartWithCancel Start fake grid
+func (f FakeEngine) StartWithCancel(ctx context.Context) (*StartedGrid, error) {
+	if class := fakeConfig(f.GridBase.Grid).StartError; class != "" {
+		return nil, &GridError{Class: class, Code: "FAKE", Message: "Fake grid start failure"}
+	}
+	fakeClient := GetFakeClient()
+	name, err := fakeClient.CreateGrid(ctx, &f.GridBase)
+	if err != nil {
+		return nil, err
+	}
+	grid, ok := fakeClient.Grid(name)
+	if !ok {
+		return nil, errors.New("Fake grid deleted while starting")
+	}
+	u := *grid.URL
+	return &StartedGrid{
+		Name:    name,
+		UID:     grid.UID,
+		URL:     &u,
+		Grid:    f.GridBase,
+		VNCPort: "0",
+		Cancel: func() {
+			fakeClient.DeleteGrid(name)
+		},
+	}, nil
+}
@@ -1,29 +1,134 @@
 package lib
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/url"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/logger"
 	yaml "gopkg.in/yaml.v2"
 )
 
 type Grid struct {
-	Image         string `yaml:"image"`
-	Port          int32  `yaml:"port"`
-	BaseURL       string `yaml:"baseURL"`
-	HealthCheck   string `yaml:"healthCheck"`
-	EntryPoint    string `yaml:"entryPoint"`
-	VNCPort       int32  `yaml:"vncPort"`
-	Engine        string `yaml:"engine"`
-	MachineType   string `yaml:"machineType"`
-	CPURequest    string `yaml:"cpuRequest"`
-	MemoryRequest string `yaml:"memoryRequest"`
-	CPULimit      string `yaml:"cpuLimit"`
-	MemoryLimit   string `yaml:"memoryLimit"`
+	Image         string       `yaml:"image"`
+	Port          int32        `yaml:"port"`
+	BaseURL       string       `yaml:"baseURL"`
+	HealthCheck   string       `yaml:"healthCheck"`
+	EntryPoint    string       `yaml:"entryPoint"`
+	VNCPort       int32        `yaml:"vncPort"`
+	Engine        string       `yaml:"engine"`
+	CPURequest    string       `yaml:"cpuRequest"`
+	MemoryRequest string       `yaml:"memoryRequest"`
+	CPULimit      string       `yaml:"cpuLimit"`
+	MemoryLimit   string       `yaml:"memoryLimit"`
+	WarmPool      *WarmPool    `yaml:"warmPool"`
+	Retry         *RetryPolicy `yaml:"retry"`
+	// VideoPath Path of the live session recording served by the grid, shown
+	// on the dashboard
+	VideoPath string `yaml:"videoPath"`
+	// VNCPassword Password of the grid VNC server, sent by Sersan so that
+	// dashboard viewers never need it
+	VNCPassword string `yaml:"vncPassword"`
+	// EngineConfig Engine config section, decoded from the block named after
+	// the engine, e.g. compute
+	EngineConfig interface{} `yaml:"-"`
+}
+
+// engineConfigValidator Engine config section checked once its grid version
+// is loaded
+type engineConfigValidator interface {
+	validate(grid string) error
+}
+
+// UnmarshalYAML Decode the grid and its engine config section. Unknown
+// engines, unknown options and the blocks of other engines are errors.
+func (g *Grid) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Grid
+	if err := unmarshal((*plain)(g)); err != nil {
+		return err
+	}
+	factory, err := LookupEngine(g.Engine)
+	if err != nil {
+		return err
+	}
+	var blocks map[string]interface{}
+	if err := unmarshal(&blocks); err != nil {
+		return err
+	}
+	engine := EngineName(g.Engine)
+	known := yamlKeys(reflect.TypeOf(plain{}))
+	for key := range blocks {
+		if known[key] || (key == engine && factory.Config != nil) {
+			continue
+		}
+		if key == engine {
+			return fmt.Errorf("The %s engine has no options", engine)
+		}
+		if _, err := LookupEngine(key); err == nil {
+			return fmt.Errorf("Options of the %s engine are not used by the %s engine", key, engine)
+		}
+		if owner := engineOption(key); owner != "" {
+			return fmt.Errorf("Option %s is an option of the %s engine, set in its %s block", key, owner, owner)
+		}
+		return fmt.Errorf("Unknown grid option %s", key)
+	}
+	if factory.Config == nil {
+		return nil
+	}
+	g.EngineConfig = factory.Config()
+	block, ok := blocks[engine]
+	if !ok {
+		return nil
+	}
+	buf, err := yaml.Marshal(block)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(buf, g.EngineConfig); err != nil {
+		return fmt.Errorf("Invalid %s config: %v", EngineName(g.Engine), err)
+	}
+	return nil
+}
+
+// yamlKeys Keys of the YAML fields of the struct type t
+func yamlKeys(t reflect.Type) map[string]bool {
+	keys := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key != "" && key != "-" {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// engineOption Engine whose config section has the option key, empty when
+// none has
+func engineOption(key string) string {
+	engineLock.RLock()
+	defer engineLock.RUnlock()
+	names := make([]string, 0, len(engineFactories))
+	for name := range engineFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		factory := engineFactories[name]
+		if factory.Config == nil {
+			continue
+		}
+		if yamlKeys(reflect.TypeOf(factory.Config()).Elem())[key] {
+			return name
+		}
+	}
+	return ""
 }
 
 type Versions struct {
@@ -35,6 +140,9 @@ type GridConfig struct {
 	lock           sync.RWMutex
 	LastReloadTime time.Time
 	Grids          map[string]Versions
+	// drained Grid versions accepting no new session, by key, kept across
+	// reloads
+	drained map[string]bool
 }
 
 var gridConfig *GridConfig
@@ -57,18 +165,35 @@ func loadGridYAML(filename string, v interface{}) error {
 }
 
 func (gc *GridConfig) Load(grids string) error {
-	log.Printf("INIT - Loading grid configuration file")
+	logger.Infof("INIT - Loading grid configuration file")
 	grid := make(map[string]Versions)
 	err := loadGridYAML(grids, &grid)
 	if err != nil {
 		return err
 	}
+	for name, versions := range grid {
+		for version, g := range versions.Versions {
+			if g == nil {
+				continue
+			}
+			if g.Retry != nil {
+				if err := g.Retry.validate(); err != nil {
+					return fmt.Errorf("Invalid retry policy of %s-%s: %v", name, version, err)
+				}
+			}
+			if validator, ok := g.EngineConfig.(engineConfigValidator); ok {
+				if err := validator.validate(name + "-" + version); err != nil {
+					return fmt.Errorf("Invalid %s config of %s-%s: %v", EngineName(g.Engine), name, version, err)
+				}
+			}
+		}
+	}
 
 	gc.lock.Lock()
 	defer gc.lock.Unlock()
 	gc.Grids = grid
 	gc.LastReloadTime = time.Now()
-	log.Printf("INIT - Loaded grid configuration from %s", grids)
+	logger.Infof("INIT - Loaded grid configuration from %s", grids)
 	return nil
 }
 
@@ -81,10 +206,10 @@ func (gc *GridConfig) Find(name string, version string) (*Grid, string, bool) {
 	}
 
 	if version == "" || version == "ANY" {
-		log.Printf("Using default version %s", grid.Default)
+		logger.Debugf("Using default version %s of %s", grid.Default, name)
 		version = grid.Default
 		if version == "" {
-			log.Printf("Default version of %s is not found", name)
+			logger.Warnf("Default version of %s is not found", name)
 			return nil, "", false
 		}
 	}
@@ -98,28 +223,169 @@ func (gc *GridConfig) Find(name string, version string) (*Grid, string, bool) {
 	return nil, version, false
 }
 
+// Has Whether a grid is configured under name
+func (gc *GridConfig) Has(name string) bool {
+	gc.lock.RLock()
+	defer gc.lock.RUnlock()
+	_, ok := gc.Grids[name]
+	return ok
+}
+
+// SetDrained Drain or undrain the grid version of key. Returns false when
+// no such grid version is configured.
+func (gc *GridConfig) SetDrained(key string, drained bool) bool {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	found := false
+	for name, versions := range gc.Grids {
+		for version := range versions.Versions {
+			found = found || name+"-"+version == key
+		}
+	}
+	if !found {
+		return false
+	}
+	if gc.drained == nil {
+		gc.drained = make(map[string]bool)
+	}
+	if drained {
+		gc.drained[key] = true
+	} else {
+		delete(gc.drained, key)
+	}
+	return true
+}
+
+// Drained Whether the grid version of key accepts no new session
+func (gc *GridConfig) Drained(key string) bool {
+	gc.lock.RLock()
+	defer gc.lock.RUnlock()
+	return gc.drained[key]
+}
+
+// Lookup Grid version of key, e.g. chrome-78.0
+func (gc *GridConfig) Lookup(key string) (*Grid, bool) {
+	gc.lock.RLock()
+	defer gc.lock.RUnlock()
+	for name, versions := range gc.Grids {
+		for version, grid := range versions.Versions {
+			if name+"-"+version == key && grid != nil {
+				return grid, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Each Call fn for every configured grid version
+func (gc *GridConfig) Each(fn func(name string, version string, grid *Grid)) {
+	gc.lock.RLock()
+	defer gc.lock.RUnlock()
+	for name, versions := range gc.Grids {
+		for version, grid := range versions.Versions {
+			fn(name, version, grid)
+		}
+	}
+}
+
 // GridBase Grid base
 type GridBase struct {
-	Grid    *Grid
-	Timeout int
+	Name      string
+	Version   string
+	Grid      *Grid
+	Timeout   int
+	Labels    map[string]string
+	Owner     string
+	RequestID string
+	// DeviceName Device requested by the session capabilities
+	DeviceName string
+	// DeviceProfile Name of the device profile selected for DeviceName
+	DeviceProfile string
+	Device        *DeviceProfile
+}
+
+// Key Grid name and version, used to label the grid instances
+func (gb GridBase) Key() string {
+	return gb.Name + "-" + gb.Version
+}
+
+// Log Logger of ctx carrying the grid, owner and request of the grid base
+func (gb GridBase) Log(ctx context.Context) *logger.Entry {
+	fields := logger.Fields{logger.Grid: gb.Key()}
+	if gb.Owner != "" {
+		fields[logger.User] = gb.Owner
+	}
+	if gb.RequestID != "" {
+		fields[logger.RequestID] = gb.RequestID
+	}
+	return logger.FromContext(ctx).WithFields(fields)
 }
 
-// StartedGrid Started grid
+// LogContext Context whose logger carries the fields of the grid base
+func (gb GridBase) LogContext(ctx context.Context) context.Context {
+	return logger.NewContext(ctx, gb.Log(ctx))
+}
+
+// Lifetime Seconds after which the grid deletes itself
+func (gb GridBase) Lifetime() int {
+	if gb.Timeout > 0 {
+		return gb.Timeout
+	}
+	return config.Get().GridTimeout
+}
+
+// InstanceLabels Labels identifying the hub, owner and request of a grid
+// instance, together with the grid specific labels
+func (gb GridBase) InstanceLabels() map[string]string {
+	labels := map[string]string{
+		"sersan-hub":     labelValue(config.Get().GridLabel),
+		"sersan-owner":   labelValue(gb.Owner),
+		"sersan-session": labelValue(gb.RequestID),
+	}
+	for key, value := range gb.Labels {
+		labels[key] = labelValue(value)
+	}
+	return labels
+}
+
+// labelValue Sanitize value to be valid as both Kubernetes and Compute
+// Engine label value
+func labelValue(value string) string {
+	sanitized := []rune(strings.ToLower(value))
+	for i, r := range sanitized {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			sanitized[i] = '_'
+		}
+	}
+	if len(sanitized) > 63 {
+		sanitized = sanitized[:63]
+	}
+	return strings.Trim(string(sanitized), "_-")
+}
+
+// StartedGrid Started grid. Failover, when set, returns the next grid to
+// try after the new session request to this one failed.
 type StartedGrid struct {
-	Name   string
-	URL    *url.URL
-	Grid   GridBase
-	Cancel func()
+	Name string
+	// UID Unique ID of the grid instance, telling it apart from a later
+	// instance with the same name. Empty when the engine has none.
+	UID      string
+	URL      *url.URL
+	Grid     GridBase
+	VNCPort  string
+	Cancel   func()
+	Failover func() (*StartedGrid, bool)
 }
 
-// GridStarter Grid starter
+// GridStarter Grid starter. When ctx is done before the grid is ready, the
+// half-started grid is deleted and the context error is returned.
 type GridStarter interface {
-	StartWithCancel() (*StartedGrid, error)
+	StartWithCancel(ctx context.Context) (*StartedGrid, error)
 }
 
 // Manager Grid manager
 type Manager interface {
-	Find(caps Caps, requestID uint64) (GridStarter, bool)
+	Find(caps Caps, owner string, requestID string) (GridStarter, bool)
 }
 
 // DefaultManager Grid default manager
@@ -127,25 +393,54 @@ type DefaultManager struct {
 	GridConfig *GridConfig
 }
 
-// Find Find grid matching capabilities
-func (m *DefaultManager) Find(caps Caps) (GridStarter, bool) {
+// Find Find grid matching capabilities. Owner and request ID are used to
+// label the started grid.
+func (m *DefaultManager) Find(caps Caps, owner string, requestID string) (GridStarter, bool) {
 	gridName := strings.ToLower(caps.Name)
 	version := strings.ToLower(caps.Version)
-	if gridName == "" {
-		gridName = strings.ToLower(caps.PlatformName)
+	if version == "" {
+		version = strings.ToLower(caps.W3CVersion)
 	}
 
-	if version == "" {
-		version = strings.ToLower(caps.PlatformVersion)
+	// Appium sessions, including mobile web ones naming a browser, run on the
+	// grid of their platform
+	platform := strings.ToLower(caps.PlatformName)
+	if gridName == "" || m.GridConfig.Has(platform) {
+		if caps.PlatformVersion != "" || gridName != "" {
+			version = strings.ToLower(caps.PlatformVersion)
+		}
+		gridName = platform
 	}
 
-	log.Printf("Locating grid %s-%s", gridName, version)
+	log := logger.WithFields(logger.Fields{logger.User: owner, logger.RequestID: requestID})
+	log.Debugf("Locating grid %s-%s", gridName, version)
 	grid, version, ok := m.GridConfig.Find(gridName, version)
-	gridBase := GridBase{Grid: grid, Timeout: caps.GridTimeout}
+	gridBase := GridBase{
+		Name:       gridName,
+		Version:    version,
+		Grid:       grid,
+		Timeout:    caps.GridTimeout,
+		Owner:      owner,
+		RequestID:  requestID,
+		DeviceName: caps.DeviceName,
+	}
 	if !ok {
-		log.Printf("Grid %s-%s not found", gridName, version)
+		log.Warnf("Grid %s-%s not found", gridName, version)
 		return nil, false
 	}
+	if m.GridConfig.Drained(gridBase.Key()) {
+		log.Warnf("Grid %s is drained", gridBase.Key())
+		return nil, false
+	}
+	gridBase.DeviceProfile, gridBase.Device = grid.Device(caps.DeviceName)
+	if gridBase.Device != nil {
+		log.Infof("Using device profile %s for %s", gridBase.DeviceProfile, caps.DeviceName)
+	}
 
-	return GetGridStarter(grid.Engine, gridBase, caps), true
+	starter, err := GetGridStarter(grid.Engine, gridBase, caps)
+	if err != nil {
+		log.Errorf("Grid %s-%s: %v", gridName, version, err)
+		return nil, false
+	}
+	return countingStarter{starter, grid.Engine, gridBase}, true
 }
@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadTestGrids(t *testing.T, grids string) (*GridConfig, error) {
+	dir, err := ioutil.TempDir("", "grids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "grids.yaml")
+	if err := ioutil.WriteFile(file, []byte(grids), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gc := &GridConfig{}
+	return gc, gc.Load(file)
+}
+
+func TestLoadEngineConfig(t *testing.T) {
+	gc, err := loadTestGrids(t, `
+android:
+  default: "9.0.0"
+  versions:
+    9.0.0:
+      engine: "compute"
+      compute:
+        zones: ["asia-southeast1-b", "asia-southeast1-c"]
+        insertRetries: 5
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grid, _, ok := gc.Find("android", "9")
+	if !ok {
+		t.Fatal("Grid android-9 not found")
+	}
+	cc := computeConfig(grid)
+	if len(cc.Zones) != 2 || cc.Zones[0] != "asia-southeast1-b" || cc.InsertRetries != 5 {
+		t.Errorf("Unexpected compute config %+v", cc)
+	}
+}
+
+func TestLoadUnknownEngine(t *testing.T) {
+	_, err := loadTestGrids(t, `
+chrome:
+  versions:
+    70.0:
+      engine: "kubernets"
+`)
+	if err == nil || !strings.Contains(err.Error(), "Unknown engine kubernets") {
+		t.Errorf("Got %v, want unknown engine error", err)
+	}
+}
+
+func TestLoadRejectsOptionsOfOtherEngines(t *testing.T) {
+	tests := []struct {
+		grid string
+		want string
+	}{
+		{`
+      engine: "compute"
+      zones: ["asia-southeast1-b"]`, "Option zones is an option of the compute engine, set in its compute block"},
+		{`
+      engine: "compute"
+      docker:
+        shmSize: "1Gi"`, "Options of the docker engine are not used by the compute engine"},
+		{`
+      shmSize: "1Gi"`, "Option shmSize is an option of the docker engine"},
+		{`
+      engine: "compute"
+      compute:
+        zone: "asia-southeast1-b"`, "field zone not found"},
+		{`
+      engine: "compute"
+      compute:
+        zones: []`, "No zone"},
+		{`
+      engine: "compute"
+      compute:
+        defaultDevice: "pixel 3"`, "Default device pixel 3 is not a device profile"},
+		{`
+      engine: "remote"
+      balanced: "weighted"`, "Unknown grid option balanced"},
+	}
+	for _, test := range tests {
+		_, err := loadTestGrids(t, `
+chrome:
+  versions:
+    70.0:`+test.grid+`
+`)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want %q", test.grid, err, test.want)
+		}
+	}
+}
+
+func TestFindPlatformGrid(t *testing.T) {
+	gc, err := loadTestGrids(t, `
+chrome:
+  default: "70.0"
+  versions:
+    70.0:
+      engine: "fake"
+android:
+  default: "9.0.0"
+  versions:
+    9.0.0:
+      engine: "compute"
+      compute:
+        defaultDevice: "pixel 3"
+        devices:
+          pixel 3:
+            avd: "pixel_3"
+          nexus 9:
+            avd: "nexus_9"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := &DefaultManager{GridConfig: gc}
+	tests := []struct {
+		caps    Caps
+		grid    string
+		version string
+		device  string
+	}{
+		{Caps{Name: "chrome"}, "chrome", "70.0", ""},
+		{Caps{PlatformName: "Android", PlatformVersion: "9", DeviceName: "Nexus 9"}, "android", "9.0.0", "nexus 9"},
+		{Caps{Name: "chrome", Version: "70", PlatformName: "Android", DeviceName: "Galaxy"}, "android", "9.0.0", "pixel 3"},
+	}
+	for _, test := range tests {
+		starter, ok := manager.Find(test.caps, "owner", "request")
+		if !ok {
+			t.Errorf("No grid found for %+v", test.caps)
+			continue
+		}
+		gridBase := starter.(countingStarter).gridBase
+		if gridBase.Name != test.grid || gridBase.Version != test.version || gridBase.DeviceProfile != test.device {
+			t.Errorf("%+v: got %s-%s %q, want %s-%s %q", test.caps, gridBase.Name, gridBase.Version, gridBase.DeviceProfile, test.grid, test.version, test.device)
+		}
+	}
+}
+
+func TestFindDrainedGrid(t *testing.T) {
+	gc, err := loadTestGrids(t, `
+chrome:
+  default: "70.0"
+  versions:
+    70.0:
+      engine: "fake"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := &DefaultManager{GridConfig: gc}
+	if gc.SetDrained("chrome-71.0", true) {
+		t.Error("Unknown grid version drained")
+	}
+	if !gc.SetDrained("chrome-70.0", true) {
+		t.Fatal("Grid version not drained")
+	}
+	if _, ok := manager.Find(Caps{Name: "chrome"}, "owner", "request"); ok {
+		t.Error("Drained grid found")
+	}
+	gc.SetDrained("chrome-70.0", false)
+	if _, ok := manager.Find(Caps{Name: "chrome"}, "owner", "request"); !ok {
+		t.Error("Undrained grid not found")
+	}
+}
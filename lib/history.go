@@ -0,0 +1,452 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Session outcomes
+const (
+	OutcomePending = "pending"
+	OutcomeCreated = "created"
+	OutcomeFailed  = "failed"
+)
+
+const (
+	historyCleanupInterval = time.Hour
+	historyEventBuffer     = 4096
+	historyOpenTimeout     = time.Second
+)
+
+// HistoryMaxResults Most sessions returned by a query
+const HistoryMaxResults = 1000
+
+var (
+	historySessions = []byte("sessions")
+	historyByTime   = []byte("by-time")
+
+	// droppedRecords Events which could not be recorded because the history
+	// store was closed, served with the other expvars on /debug/vars
+	droppedRecords = expvar.NewInt("history_events_dropped")
+)
+
+// ErrSessionRecordNotFound Session is not in the history
+var ErrSessionRecordNotFound = errors.New("Session not found in history")
+
+// SessionRecord History of one new session request. Phases are the seconds
+// spent in each startup phase, by span name, and Duration the session
+// lifetime in seconds once it ended.
+type SessionRecord struct {
+	RequestID     string             `json:"requestId"`
+	SessionID     string             `json:"sessionId,omitempty"`
+	User          string             `json:"user,omitempty"`
+	Remote        string             `json:"remote,omitempty"`
+	Browser       string             `json:"browser,omitempty"`
+	Version       string             `json:"version,omitempty"`
+	RequestedCaps json.RawMessage    `json:"requestedCaps,omitempty"`
+	ResolvedCaps  json.RawMessage    `json:"resolvedCaps,omitempty"`
+	Grid          string             `json:"grid,omitempty"`
+	Engine        string             `json:"engine,omitempty"`
+	Instance      string             `json:"instance,omitempty"`
+	RequestedAt   time.Time          `json:"requestedAt"`
+	CreatedAt     *time.Time         `json:"createdAt,omitempty"`
+	EndedAt       *time.Time         `json:"endedAt,omitempty"`
+	Phases        map[string]float64 `json:"phases,omitempty"`
+	Attempts      int                `json:"attempts,omitempty"`
+	Outcome       string             `json:"outcome"`
+	FailureReason string             `json:"failureReason,omitempty"`
+	EndCause      string             `json:"endCause,omitempty"`
+	Duration      float64            `json:"duration,omitempty"`
+}
+
+// HistoryQuery Filters of a history query. Empty filters match every
+// session, and at most Limit sessions are returned, newest first.
+type HistoryQuery struct {
+	User    string
+	Browser string
+	Outcome string
+	From    time.Time
+	To      time.Time
+	Limit   int
+}
+
+// HistoryStore Sessions recorded from the lifecycle events in an embedded
+// database, kept for the retention. Events are queued for recording, and
+// the queue blocks rather than losing audit records.
+type HistoryStore struct {
+	Path      string
+	Retention time.Duration
+	db        *bolt.DB
+	queue     chan Event
+	done      chan struct{}
+}
+
+var historyStore *HistoryStore
+var historyOnce sync.Once
+
+// GetHistoryStore Get history store. History is disabled when HISTORY_DB is
+// empty or the database cannot be opened.
+func GetHistoryStore() *HistoryStore {
+	historyOnce.Do(func() {
+		conf := config.Get()
+		historyStore = &HistoryStore{
+			Path:      conf.HistoryDB,
+			Retention: time.Duration(conf.HistoryRetention) * time.Second,
+			queue:     make(chan Event, historyEventBuffer),
+			done:      make(chan struct{}),
+		}
+		if historyStore.Path == "" {
+			return
+		}
+		if err := historyStore.Open(); err != nil {
+			logger.Errorf("Failed to open session history %s: %v", historyStore.Path, err)
+		}
+	})
+	return historyStore
+}
+
+// Open Open the database at Path
+func (hs *HistoryStore) Open() error {
+	db, err := bolt.Open(hs.Path, 0600, &bolt.Options{Timeout: historyOpenTimeout})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{historySessions, historyByTime} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	hs.db = db
+	return nil
+}
+
+// Enabled Whether sessions are recorded
+func (hs *HistoryStore) Enabled() bool {
+	return hs.db != nil
+}
+
+// Enqueue Queue the event for recording, waiting while the queue is full.
+// Events are only dropped once the store is closed.
+func (hs *HistoryStore) Enqueue(event Event) {
+	if !hs.Enabled() {
+		return
+	}
+	select {
+	case <-hs.done:
+		droppedRecords.Add(1)
+		return
+	default:
+	}
+	select {
+	case hs.queue <- event:
+	case <-hs.done:
+		droppedRecords.Add(1)
+	}
+}
+
+// Run Record the queued events and delete expired sessions until ctx is
+// done, then close the database
+func (hs *HistoryStore) Run(ctx context.Context) {
+	if !hs.Enabled() {
+		return
+	}
+	defer hs.db.Close()
+	tick := time.NewTicker(historyCleanupInterval)
+	defer tick.Stop()
+	hs.cleanup()
+	for {
+		select {
+		case <-ctx.Done():
+			close(hs.done)
+			for {
+				select {
+				case event := <-hs.queue:
+					hs.record(event)
+				default:
+					return
+				}
+			}
+		case event := <-hs.queue:
+			hs.record(event)
+		case <-tick.C:
+			hs.cleanup()
+		}
+	}
+}
+
+func (hs *HistoryStore) record(event Event) {
+	if err := hs.Record(event); err != nil {
+		logger.With(logger.RequestID, event.RequestID).Errorf("Failed to record %s event: %v", event.Type, err)
+	}
+}
+
+// Record Update the session of the event
+func (hs *HistoryStore) Record(event Event) error {
+	key := event.RequestID
+	if key == "" {
+		key = event.SessionID
+	}
+	if key == "" {
+		return nil
+	}
+	return hs.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(historySessions)
+		record := &SessionRecord{RequestID: key, Outcome: OutcomePending}
+		if buf := sessions.Get([]byte(key)); buf != nil {
+			if err := json.Unmarshal(buf, record); err != nil {
+				return err
+			}
+		} else {
+			// Sessions may end on another replica than the one which created them
+			record.RequestedAt = event.Time.Add(-time.Duration(event.Duration * float64(time.Second)))
+			if err := tx.Bucket(historyByTime).Put(historyTimeKey(record.RequestedAt, key), nil); err != nil {
+				return err
+			}
+		}
+		applyEvent(record, event)
+		buf, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return sessions.Put([]byte(key), buf)
+	})
+}
+
+func applyEvent(record *SessionRecord, event Event) {
+	setIfEmpty := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	setIfEmpty(&record.SessionID, event.SessionID)
+	setIfEmpty(&record.User, event.User)
+	setIfEmpty(&record.Remote, event.Remote)
+	setIfEmpty(&record.Browser, event.Browser)
+	setIfEmpty(&record.Version, event.Version)
+	setIfEmpty(&record.Grid, event.Grid)
+	setIfEmpty(&record.Engine, event.Engine)
+	if event.Instance != "" {
+		record.Instance = event.Instance
+	}
+	if event.Phases != nil {
+		record.Phases = event.Phases
+	}
+	end := event.Time
+	switch event.Type {
+	case EventSessionRequested:
+		record.RequestedCaps = event.Caps
+	case EventSessionCreated:
+		record.ResolvedCaps = event.Caps
+		record.CreatedAt = &end
+		record.Attempts = event.Attempts
+		record.Outcome = OutcomeCreated
+	case EventSessionFailed:
+		record.Outcome = OutcomeFailed
+		record.FailureReason = event.Reason
+	case EventSessionDeleted, EventSessionReaped:
+		record.EndedAt = &end
+		record.Duration = event.Duration
+		record.EndCause = "deleted"
+		if event.Type == EventSessionReaped {
+			record.EndCause = event.Reason
+		}
+		if record.Outcome == OutcomePending {
+			record.Outcome = OutcomeCreated
+		}
+	}
+}
+
+// MergeRecords Sessions recorded by several replicas, once each and newest
+// first, at most limit. The records of a session created by one replica and
+// ended through another are merged.
+func MergeRecords(limit int, lists ...[]*SessionRecord) []*SessionRecord {
+	merged := map[string]*SessionRecord{}
+	records := []*SessionRecord{}
+	for _, list := range lists {
+		for _, record := range list {
+			into, ok := merged[record.RequestID]
+			if !ok {
+				copied := *record
+				merged[record.RequestID] = &copied
+				records = append(records, &copied)
+				continue
+			}
+			mergeRecord(into, record)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].RequestedAt.After(records[j].RequestedAt)
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records
+}
+
+func mergeRecord(into *SessionRecord, from *SessionRecord) {
+	for _, field := range []struct{ into, from *string }{
+		{&into.SessionID, &from.SessionID}, {&into.User, &from.User}, {&into.Remote, &from.Remote},
+		{&into.Browser, &from.Browser}, {&into.Version, &from.Version}, {&into.Grid, &from.Grid},
+		{&into.Engine, &from.Engine}, {&into.Instance, &from.Instance},
+		{&into.FailureReason, &from.FailureReason}, {&into.EndCause, &from.EndCause},
+	} {
+		if *field.into == "" {
+			*field.into = *field.from
+		}
+	}
+	if into.RequestedCaps == nil {
+		into.RequestedCaps = from.RequestedCaps
+	}
+	if into.ResolvedCaps == nil {
+		into.ResolvedCaps = from.ResolvedCaps
+	}
+	// Replicas ending a session they did not create only know when it was
+	// created, the creating replica knows when it was requested
+	if from.RequestedAt.Before(into.RequestedAt) {
+		into.RequestedAt = from.RequestedAt
+	}
+	if into.CreatedAt == nil {
+		into.CreatedAt = from.CreatedAt
+	}
+	if into.EndedAt == nil {
+		into.EndedAt, into.Duration = from.EndedAt, from.Duration
+	}
+	if into.Phases == nil {
+		into.Phases = from.Phases
+	}
+	if into.Attempts == 0 {
+		into.Attempts = from.Attempts
+	}
+	if into.Outcome == OutcomePending {
+		into.Outcome = from.Outcome
+	}
+}
+
+// Get Session of the new session request ID
+func (hs *HistoryStore) Get(requestID string) (*SessionRecord, error) {
+	var record *SessionRecord
+	err := hs.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(historySessions).Get([]byte(requestID))
+		if buf == nil {
+			return ErrSessionRecordNotFound
+		}
+		record = &SessionRecord{}
+		return json.Unmarshal(buf, record)
+	})
+	return record, err
+}
+
+// Query Sessions matching the query, newest first
+func (hs *HistoryStore) Query(q HistoryQuery) ([]*SessionRecord, error) {
+	if q.Limit <= 0 || q.Limit > HistoryMaxResults {
+		q.Limit = HistoryMaxResults
+	}
+	records := []*SessionRecord{}
+	err := hs.db.View(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(historySessions)
+		c := tx.Bucket(historyByTime).Cursor()
+		var k []byte
+		if q.To.IsZero() {
+			k, _ = c.Last()
+		} else {
+			to := historyTimeKey(q.To, "")
+			k, _ = c.Seek(to)
+			if k == nil {
+				k, _ = c.Last()
+			}
+			for k != nil && bytes.Compare(k, to) >= 0 {
+				k, _ = c.Prev()
+			}
+		}
+		for ; k != nil && len(records) < q.Limit; k, _ = c.Prev() {
+			requestedAt, requestID := parseHistoryTimeKey(k)
+			if !q.From.IsZero() && requestedAt.Before(q.From) {
+				break
+			}
+			buf := sessions.Get([]byte(requestID))
+			if buf == nil {
+				continue
+			}
+			record := &SessionRecord{}
+			if err := json.Unmarshal(buf, record); err != nil {
+				return err
+			}
+			if q.matches(record) {
+				records = append(records, record)
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+func (q HistoryQuery) matches(record *SessionRecord) bool {
+	if q.User != "" && record.User != q.User {
+		return false
+	}
+	if q.Browser != "" && !strings.EqualFold(record.Browser, q.Browser) {
+		return false
+	}
+	if q.Outcome != "" && record.Outcome != q.Outcome {
+		return false
+	}
+	return true
+}
+
+// cleanup Delete sessions requested before the retention
+func (hs *HistoryStore) cleanup() {
+	cutoff := historyTimeKey(time.Now().Add(-hs.Retention), "")
+	deleted := 0
+	err := hs.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(historySessions)
+		c := tx.Bucket(historyByTime).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = c.Next() {
+			_, requestID := parseHistoryTimeKey(k)
+			if err := sessions.Delete([]byte(requestID)); err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("Failed to delete expired session history: %v", err)
+		return
+	}
+	if deleted > 0 {
+		logger.Infof("Deleted %d expired session(s) from history", deleted)
+	}
+}
+
+// historyTimeKey Time index key, ordered by request time
+func historyTimeKey(t time.Time, requestID string) []byte {
+	key := make([]byte, 8, 8+len(requestID))
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return append(key, requestID...)
+}
+
+func parseHistoryTimeKey(key []byte) (time.Time, string) {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:8]))), string(key[8:])
+}
@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryRecordAndQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sersan-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hs := &HistoryStore{Path: filepath.Join(dir, "history.db"), Retention: time.Hour}
+	if err := hs.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer hs.db.Close()
+
+	start := time.Now().Add(-time.Minute)
+	events := []Event{
+		{Type: EventSessionRequested, Time: start, RequestID: "a", User: "alice", Browser: "chrome"},
+		{Type: EventGridStarted, Time: start.Add(time.Second), RequestID: "a", Grid: "chrome-80", Instance: "pod-a"},
+		{Type: EventSessionCreated, Time: start.Add(2 * time.Second), RequestID: "a", SessionID: "s", Attempts: 1,
+			Phases: map[string]float64{"CreateGrid": 1}},
+		{Type: EventSessionReaped, Time: start.Add(time.Minute), RequestID: "a", Duration: 58, Reason: "preempted"},
+		{Type: EventSessionRequested, Time: start.Add(3 * time.Second), RequestID: "b", User: "bob", Browser: "firefox"},
+		{Type: EventSessionFailed, Time: start.Add(4 * time.Second), RequestID: "b", Reason: "Grid is not ready"},
+		// Expired
+		{Type: EventSessionRequested, Time: start.Add(-2 * time.Hour), RequestID: "c", User: "alice", Browser: "chrome"},
+	}
+	for _, event := range events {
+		if err := hs.Record(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record, err := hs.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Outcome != OutcomeCreated || record.EndCause != "preempted" || record.Instance != "pod-a" ||
+		record.SessionID != "s" || record.Phases["CreateGrid"] != 1 || record.EndedAt == nil {
+		t.Errorf("Unexpected record %+v", record)
+	}
+
+	hs.cleanup()
+	if _, err := hs.Get("c"); err != ErrSessionRecordNotFound {
+		t.Errorf("Expired session not deleted: %v", err)
+	}
+
+	tests := []struct {
+		q    HistoryQuery
+		want []string
+	}{
+		{HistoryQuery{}, []string{"b", "a"}},
+		{HistoryQuery{User: "alice"}, []string{"a"}},
+		{HistoryQuery{Browser: "Firefox"}, []string{"b"}},
+		{HistoryQuery{Outcome: OutcomeFailed}, []string{"b"}},
+		{HistoryQuery{From: start.Add(time.Second)}, []string{"b"}},
+		{HistoryQuery{To: start.Add(time.Second)}, []string{"a"}},
+		{HistoryQuery{Limit: 1}, []string{"b"}},
+	}
+	for _, test := range tests {
+		records, err := hs.Query(test.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, record := range records {
+			got = append(got, record.RequestID)
+		}
+		if len(got) != len(test.want) || (len(got) > 0 && got[0] != test.want[0]) {
+			t.Errorf("Query %+v returned %v, want %v", test.q, got, test.want)
+		}
+	}
+}
+
+func TestHistoryRecordsEveryEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sersan-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.db")
+	hs := &HistoryStore{Path: path, Retention: time.Hour, queue: make(chan Event, 1), done: make(chan struct{})}
+	if err := hs.Open(); err != nil {
+		t.Fatal(err)
+	}
+	bus := &EventBus{}
+	bus.Observe(hs.Enqueue)
+	// A subscriber which never reads must not cost records
+	bus.Subscribe(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		hs.Run(ctx)
+		close(stopped)
+	}()
+	for i := 0; i < 200; i++ {
+		bus.Publish(Event{Type: EventSessionRequested, RequestID: fmt.Sprintf("r%d", i)})
+	}
+	cancel()
+	<-stopped
+
+	reopened := &HistoryStore{Path: path, Retention: time.Hour}
+	if err := reopened.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.db.Close()
+	records, err := reopened.Query(HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 200 {
+		t.Errorf("%d sessions recorded, want 200", len(records))
+	}
+}
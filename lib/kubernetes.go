@@ -1,9 +1,10 @@
 package lib
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/url"
 	"strconv"
 	"strings"
@@ -11,10 +12,13 @@ import (
 	"time"
 
 	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/logger"
 	"github.com/salestock/sersan/utils"
 	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -22,6 +26,7 @@ import (
 // KubernetesClient Kubernetes client
 type KubernetesClient struct {
 	Clientset *kubernetes.Clientset
+	Pods      *PodWatcher
 }
 
 // Kubernetes kubernetes
@@ -30,27 +35,77 @@ type Kubernetes struct {
 	Caps     Caps
 }
 
+// KubernetesConfig Kubernetes section of a grid
+type KubernetesConfig struct {
+	NodeSelector map[string]string `yaml:"nodeSelector"`
+}
+
 var kubernetesClient *KubernetesClient
+var kubernetesErr error
 var once sync.Once
 
-// GetKubernetesClient Get kubernetes client
-func GetKubernetesClient() *KubernetesClient {
+func init() {
+	RegisterEngine(KubernetesType, EngineFactory{
+		Client: func() (Engine, error) { return GetKubernetesClient() },
+		Starter: func(gridBase GridBase, caps Caps) GridStarter {
+			return Kubernetes{GridBase: gridBase, Caps: caps}
+		},
+		Config: func() interface{} { return newKubernetesConfig() },
+		Pool:   kubernetesPool{},
+	})
+}
+
+// newKubernetesConfig Kubernetes section defaults, from the environment
+func newKubernetesConfig() *KubernetesConfig {
+	conf := config.Get()
+	kc := &KubernetesConfig{}
+	if conf.NodeSelectorKey != "" && conf.NodeSelectorValue != "" {
+		kc.NodeSelector = map[string]string{conf.NodeSelectorKey: conf.NodeSelectorValue}
+	}
+	return kc
+}
+
+// kubernetesConfig Kubernetes section of the grid
+func kubernetesConfig(grid *Grid) *KubernetesConfig {
+	if kc, ok := grid.EngineConfig.(*KubernetesConfig); ok {
+		return kc
+	}
+	return newKubernetesConfig()
+}
+
+// GetKubernetesClient Get kubernetes client. It fails for good when the hub
+// does not run in a cluster.
+func GetKubernetesClient() (*KubernetesClient, error) {
 	once.Do(func() {
-		config, err := rest.InClusterConfig()
+		conf := config.Get()
+		restConfig, err := rest.InClusterConfig()
 		if err != nil {
-			log.Printf("Failed to get in cluster config %v", err)
+			logger.Errorf("Failed to get in cluster config %v", err)
+			kubernetesErr = fmt.Errorf("Kubernetes is not available: %v", err)
+			return
 		}
-		clientset, err := kubernetes.NewForConfig(config)
+		restConfig.QPS = conf.KubernetesQPS
+		restConfig.Burst = conf.KubernetesBurst
+		clientset, err := kubernetes.NewForConfig(restConfig)
 		if err != nil {
-			log.Printf("Failed to parse config %v", err)
+			logger.Errorf("Failed to parse config %v", err)
+			kubernetesErr = fmt.Errorf("Kubernetes is not available: %v", err)
+			return
 		}
-		kubernetesClient = &KubernetesClient{Clientset: clientset}
+		pods := NewPodWatcher(clientset, apiv1.NamespaceDefault, "app=sersan-grid-"+conf.GridLabel)
+		go pods.Run(make(chan struct{}))
+		kubernetesClient = &KubernetesClient{Clientset: clientset, Pods: pods}
 	})
-	return kubernetesClient
+	return kubernetesClient, kubernetesErr
 }
 
 // CreateGrid Create browsers pod
-func (k KubernetesClient) CreateGrid(gridBase *GridBase) (podName string, err error) {
+func (k KubernetesClient) CreateGrid(ctx context.Context, gridBase *GridBase) (podName string, err error) {
+	ctx, end := traceStep(ctx, "CreateGrid")
+	defer func() { end(podName, err) }()
+	if err = ctx.Err(); err != nil {
+		return
+	}
 	entryPoint := "/opt/bin/entry_point.sh"
 	if gridBase.Grid.EntryPoint != "" {
 		entryPoint = gridBase.Grid.EntryPoint
@@ -72,11 +127,7 @@ func (k KubernetesClient) CreateGrid(gridBase *GridBase) (podName string, err er
 		})
 	}
 
-	gridTimeout := conf.GridTimeout
-	log.Printf("Caps: %v", gridBase.Timeout)
-	if gridBase.Timeout > 0 {
-		gridTimeout = gridBase.Timeout
-	}
+	gridTimeout := gridBase.Lifetime()
 	cpuRequest := conf.CPURequest
 	if gridBase.Grid.CPURequest != "" {
 		cpuRequest = gridBase.Grid.CPURequest
@@ -94,12 +145,13 @@ func (k KubernetesClient) CreateGrid(gridBase *GridBase) (podName string, err er
 		memoryLimit = gridBase.Grid.MemoryLimit
 	}
 
+	labels := gridBase.InstanceLabels()
+	labels["app"] = "sersan-grid-" + conf.GridLabel
+
 	spec := &apiv1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			GenerateName: "sersan-grid-" + conf.GridLabel,
-			Labels: map[string]string{
-				"app": "sersan-grid-" + conf.GridLabel,
-			},
+			Labels:       labels,
 		},
 		Spec: apiv1.PodSpec{
 			Containers: []apiv1.Container{
@@ -141,20 +193,19 @@ func (k KubernetesClient) CreateGrid(gridBase *GridBase) (podName string, err er
 		},
 	}
 
-	if conf.NodeSelectorKey != "" && conf.NodeSelectorValue != "" {
-		spec.Spec.NodeSelector = map[string]string{
-			conf.NodeSelectorKey: conf.NodeSelectorValue,
-		}
+	if nodeSelector := kubernetesConfig(gridBase.Grid).NodeSelector; len(nodeSelector) > 0 {
+		spec.Spec.NodeSelector = nodeSelector
 	}
 
-	log.Print("Creating pod")
+	log := logger.FromContext(ctx)
+	log.Debugf("Creating pod")
 	pod, err := podsClient.Create(spec)
 	if err != nil {
-		log.Print("%v", err)
+		log.Errorf("Failed to create pod: %v", err)
 		return
 	}
 	podName = pod.GetObjectMeta().GetName()
-	log.Printf("Pod created - %s", podName)
+	log.With(logger.Instance, podName).Infof("Pod created")
 	return
 }
 
@@ -171,58 +222,129 @@ func (k KubernetesClient) DeleteGrid(name string) (err error) {
 		return err
 	}
 
-	log.Printf("Pod deleted - %s", name)
+	logger.With(logger.Instance, name).Infof("Pod deleted")
 	return nil
 }
 
-// WaitUntilReady Wait until grid ready
-func (k KubernetesClient) WaitUntilReady(name string, timeout int32) (ip string, err error) {
-	podsClient := k.Clientset.CoreV1().Pods(apiv1.NamespaceDefault)
+// VerifyGrid Whether the pod still runs on host, from the informer cache. A
+// pod with the same name but another UID is a different grid.
+func (k KubernetesClient) VerifyGrid(name string, uid string, host string) (bool, error) {
+	if !k.Pods.HasSynced() {
+		return false, errors.New("Pod informer has not synced yet")
+	}
+	pod, err := k.Pods.Get(apiv1.NamespaceDefault, name)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if uid != "" && string(pod.UID) != uid {
+		return false, nil
+	}
+	return pod.Status.Phase == apiv1.PodRunning && pod.Status.PodIP == host, nil
+}
+
+// podUID UID of the pod from the informer cache, empty when not cached
+func (k KubernetesClient) podUID(name string) string {
+	pod, err := k.Pods.Get(apiv1.NamespaceDefault, name)
+	if err != nil {
+		return ""
+	}
+	return string(pod.UID)
+}
+
+// Logs Stream the logs of the grid pod
+func (k KubernetesClient) Logs(ctx context.Context, name string, tail int64, follow bool) (io.ReadCloser, error) {
+	if !strings.HasPrefix(name, "sersan-grid") {
+		return nil, errors.New("Grid name prefix must be sersan-grid")
+	}
+	opts := &apiv1.PodLogOptions{Follow: follow, TailLines: &tail}
+	return k.Clientset.CoreV1().Pods(apiv1.NamespaceDefault).GetLogs(name, opts).Context(ctx).Stream()
+}
+
+// WaitUntilReady Wait until grid ready. Pod changes are received from the
+// shared informer, and pods which will never run fail immediately.
+func (k KubernetesClient) WaitUntilReady(ctx context.Context, name string, timeout int32) (ip string, err error) {
+	ctx, end := traceStep(ctx, "WaitUntilReady")
+	defer func() { end(name, err) }()
+	conf := config.Get()
+	updates, unsubscribe := k.Pods.Subscribe(name)
+	defer unsubscribe()
 	waitTimeout := time.NewTimer(time.Duration(timeout) * time.Millisecond)
 	defer waitTimeout.Stop()
-	tick := time.Tick(200 * time.Millisecond)
+	unschedulableTimeout := time.Duration(conf.PodUnschedulableTimeout) * time.Millisecond
+	seen := false
+	log := logger.FromContext(ctx).With(logger.Instance, name)
 	for {
-		select {
-		case <-waitTimeout.C:
-			err = errors.New(fmt.Sprintf("Pod is not running until %d ms", timeout))
-			return
-		case <-tick:
-			pod, err := podsClient.Get(name, metav1.GetOptions{})
+		var recheck <-chan time.Time
+		pod, err := k.Pods.Get(apiv1.NamespaceDefault, name)
+		switch {
+		case err == nil:
+			seen = true
+			if pod.Status.Phase == apiv1.PodRunning && pod.Status.PodIP != "" {
+				log.Infof("Pod is ready")
+				return pod.Status.PodIP, nil
+			}
+			after, err := podFailure(pod, unschedulableTimeout)
 			if err != nil {
-				log.Printf("%v", err)
+				log.Errorf("%v", err)
 				return "", err
 			}
-			if pod.Status.Phase == apiv1.PodRunning {
-				log.Printf("Pod is ready - %s", name)
-				ip = pod.Status.PodIP
-				return ip, nil
+			if after > 0 {
+				recheck = time.After(after)
+			}
+		case apierrors.IsNotFound(err):
+			if seen {
+				err = fmt.Errorf("Pod %s was deleted before it was ready", name)
+				log.Errorf("%v", err)
+				return "", err
 			}
+		default:
+			log.Errorf("%v", err)
+			return "", err
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-waitTimeout.C:
+			return "", fmt.Errorf("Pod is not running until %d ms", timeout)
+		case <-updates:
+		case <-recheck:
 		}
 	}
-	return
 }
 
 // StartWithCancel Start pod with cancel
-func (k Kubernetes) StartWithCancel() (*StartedGrid, error) {
+func (k Kubernetes) StartWithCancel(ctx context.Context) (*StartedGrid, error) {
 	conf := config.Get()
-	kubernetesClient := GetKubernetesClient()
-	name, err := kubernetesClient.CreateGrid(&k.GridBase)
+	if grid, ok := GetWarmPools().Claim(ctx, k.GridBase); ok {
+		return grid, nil
+	}
+
+	kubernetesClient, err := GetKubernetesClient()
+	if err != nil {
+		return nil, &GridError{Class: ErrorConfig, Message: err.Error()}
+	}
+	name, err := kubernetesClient.CreateGrid(ctx, &k.GridBase)
 	if err != nil {
 		return nil, err
 	}
 
-	ip, err := kubernetesClient.WaitUntilReady(name, conf.StartupTimeout)
+	ip, err := kubernetesClient.WaitUntilReady(ctx, name, conf.StartupTimeout)
 	if err != nil {
 		kubernetesClient.DeleteGrid(name)
 		return nil, err
 	}
 	u, err := url.Parse("http://" + ip + ":" + strconv.Itoa(int(k.GridBase.Grid.Port)))
 	if err != nil {
+		kubernetesClient.DeleteGrid(name)
 		return nil, err
 	}
 
 	if k.GridBase.Grid.HealthCheck != "" {
-		err = utils.WaitUntilGridReady(u, k.GridBase.Grid.HealthCheck)
+		err = utils.WaitUntilGridReady(ctx, u, k.GridBase.Grid.HealthCheck)
 		if err != nil {
 			kubernetesClient.DeleteGrid(name)
 			return nil, err
@@ -230,9 +352,11 @@ func (k Kubernetes) StartWithCancel() (*StartedGrid, error) {
 	}
 
 	s := StartedGrid{
-		Name: name,
-		URL:  u,
-		Grid: k.GridBase,
+		Name:    name,
+		UID:     kubernetesClient.podUID(name),
+		URL:     u,
+		Grid:    k.GridBase,
+		VNCPort: strconv.Itoa(int(k.GridBase.Grid.VNCPort)),
 		Cancel: func() {
 			kubernetesClient.DeleteGrid(name)
 		},
@@ -240,3 +364,111 @@ func (k Kubernetes) StartWithCancel() (*StartedGrid, error) {
 
 	return &s, nil
 }
+
+// kubernetesPool Warm pool of browser pods
+type kubernetesPool struct{}
+
+// List List pooled pods from the informer cache
+func (kubernetesPool) List(ctx context.Context, gridBase GridBase) (members []PooledGrid, err error) {
+	kubernetesClient, err := GetKubernetesClient()
+	if err != nil {
+		return
+	}
+	pods, err := kubernetesClient.Pods.List(apiv1.NamespaceDefault)
+	if err != nil {
+		return
+	}
+	for _, pod := range pods {
+		state := pod.Labels[PoolStateLabel]
+		if state == "" || pod.Labels[PoolGridLabel] != labelValue(gridBase.Key()) || pod.DeletionTimestamp != nil {
+			continue
+		}
+		members = append(members, PooledGrid{
+			Name:    pod.Name,
+			UID:     string(pod.UID),
+			IP:      pod.Status.PodIP,
+			State:   state,
+			Created: pod.CreationTimestamp.Time,
+		})
+	}
+	return
+}
+
+// Create Start a warming pod and mark it unclaimed once selenium is ready
+func (kubernetesPool) Create(ctx context.Context, gridBase *GridBase) (name string, err error) {
+	conf := config.Get()
+	kubernetesClient, err := GetKubernetesClient()
+	if err != nil {
+		return
+	}
+	name, err = kubernetesClient.CreateGrid(ctx, gridBase)
+	if err != nil {
+		return
+	}
+	ip, err := kubernetesClient.WaitUntilReady(ctx, name, conf.StartupTimeout)
+	if err != nil {
+		kubernetesClient.DeleteGrid(name)
+		return
+	}
+	if gridBase.Grid.HealthCheck != "" {
+		u := &url.URL{Scheme: "http", Host: ip + ":" + strconv.Itoa(int(gridBase.Grid.Port))}
+		err = utils.WaitUntilGridReady(ctx, u, gridBase.Grid.HealthCheck)
+		if err != nil {
+			kubernetesClient.DeleteGrid(name)
+			return
+		}
+	}
+
+	patch := fmt.Sprintf(`{"metadata":{"labels":{%q:%q}}}`, PoolStateLabel, PoolUnclaimed)
+	podsClient := kubernetesClient.Clientset.CoreV1().Pods(apiv1.NamespaceDefault)
+	_, err = podsClient.Patch(name, types.StrategicMergePatchType, []byte(patch))
+	if err != nil {
+		kubernetesClient.DeleteGrid(name)
+	}
+	return
+}
+
+// Claim Relabel the pod as claimed by the session. The update carries the
+// cached resource version, so only one replica can win the pod.
+func (kubernetesPool) Claim(ctx context.Context, member PooledGrid, labels map[string]string) (bool, error) {
+	kubernetesClient, err := GetKubernetesClient()
+	if err != nil {
+		return false, err
+	}
+	cached, err := kubernetesClient.Pods.Get(apiv1.NamespaceDefault, member.Name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if cached.Labels[PoolStateLabel] != PoolUnclaimed {
+		return false, nil
+	}
+	if err = ctx.Err(); err != nil {
+		return false, err
+	}
+	pod := cached.DeepCopy()
+	for key, value := range labels {
+		pod.Labels[key] = value
+	}
+	pod.Labels[PoolStateLabel] = PoolClaimed
+	podsClient := kubernetesClient.Clientset.CoreV1().Pods(apiv1.NamespaceDefault)
+	_, err = podsClient.Update(pod)
+	if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Delete Delete pooled pod
+func (kubernetesPool) Delete(name string) error {
+	kubernetesClient, err := GetKubernetesClient()
+	if err != nil {
+		return err
+	}
+	return kubernetesClient.DeleteGrid(name)
+}
@@ -1,5 +1,18 @@
 package lib
 
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+const (
+	// appiumPrefix Vendor prefix of Appium capabilities
+	appiumPrefix = "appium:"
+	// appiumOptions Capability nesting Appium capabilities
+	appiumOptions = "appium:options"
+)
+
 // Caps Browser capabilities
 type Caps struct {
 	Name                   string `json:"browserName"`
@@ -14,5 +27,83 @@ type Caps struct {
 	App                    string `json:"app"`
 	DisableAndroidWatchers string `json:"disableAndroidWatchers"`
 	GridTimeout            int    `json:"gridTimeout"`
-	NewCommandTimeout      string `json:"newCommandTimeout"`
+	NewCommandTimeout      int    `json:"newCommandTimeout"`
+}
+
+// UnmarshalJSON Read capabilities given unprefixed, with the appium: prefix
+// or nested in appium:options, in increasing order of precedence. Appium
+// clients send numbers and booleans where older clients send strings, so
+// both are accepted.
+func (c *Caps) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	caps := make(map[string]json.RawMessage)
+	prefixed := make(map[string]json.RawMessage)
+	for key, value := range raw {
+		switch {
+		case key == appiumOptions:
+		case strings.HasPrefix(key, appiumPrefix):
+			prefixed[strings.TrimPrefix(key, appiumPrefix)] = value
+		default:
+			caps[key] = value
+		}
+	}
+	for key, value := range prefixed {
+		caps[key] = value
+	}
+	if options, ok := raw[appiumOptions]; ok {
+		var nested map[string]json.RawMessage
+		if err := json.Unmarshal(options, &nested); err != nil {
+			return err
+		}
+		for key, value := range nested {
+			caps[strings.TrimPrefix(key, appiumPrefix)] = value
+		}
+	}
+
+	*c = Caps{
+		Name:                   capString(caps["browserName"]),
+		Version:                capString(caps["version"]),
+		W3CVersion:             capString(caps["browserVersion"]),
+		ScreenResolution:       capString(caps["screenResolution"]),
+		TestName:               capString(caps["name"]),
+		TimeZone:               capString(caps["timeZone"]),
+		PlatformName:           capString(caps["platformName"]),
+		PlatformVersion:        capString(caps["platformVersion"]),
+		DeviceName:             capString(caps["deviceName"]),
+		App:                    capString(caps["app"]),
+		DisableAndroidWatchers: capString(caps["disableAndroidWatchers"]),
+		GridTimeout:            capInt(caps["gridTimeout"]),
+		NewCommandTimeout:      capInt(caps["newCommandTimeout"]),
+	}
+	return nil
+}
+
+// capString Capability as string. Numbers and booleans are formatted, other
+// values are ignored.
+func capString(value json.RawMessage) string {
+	var v interface{}
+	if json.Unmarshal(value, &v) != nil {
+		return ""
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// capInt Capability as integer, given either as number or string
+func capInt(value json.RawMessage) int {
+	n, err := strconv.ParseFloat(capString(value), 64)
+	if err != nil {
+		return 0
+	}
+	return int(n)
 }
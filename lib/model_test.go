@@ -0,0 +1,32 @@
+package lib
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCapsAppium(t *testing.T) {
+	var caps Caps
+	err := json.Unmarshal([]byte(`{
+		"platformName": "Android",
+		"platformVersion": "8.0",
+		"appium:platformVersion": "9.0",
+		"appium:deviceName": "Pixel 3",
+		"appium:options": {"app": "app.apk", "appium:newCommandTimeout": 120},
+		"gridTimeout": "600"
+	}`), &caps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Caps{
+		PlatformName:      "Android",
+		PlatformVersion:   "9.0",
+		DeviceName:        "Pixel 3",
+		App:               "app.apk",
+		NewCommandTimeout: 120,
+		GridTimeout:       600,
+	}
+	if caps != want {
+		t.Errorf("Got %+v, want %+v", caps, want)
+	}
+}
@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/salestock/sersan/config"
+)
+
+// PeerHeader Header of the requests sent by a replica to its peers, which
+// serve them locally instead of fanning them out again
+const PeerHeader = "X-Sersan-Peer"
+
+const peerTimeout = 10 * time.Second
+
+var (
+	peersOnce  sync.Once
+	peers      *Peers
+	peerClient = &http.Client{Timeout: peerTimeout}
+)
+
+// Peers Replicas of the hub, this one included, resolved from the DNS name of
+// their headless service. Admin requests are fanned out to every replica, so
+// that any of them answers for the whole hub. Without PEER_DNS each replica
+// only answers for itself.
+type Peers struct {
+	// Resolve Addresses of the replicas, nil when replicas are not known
+	Resolve func() ([]string, error)
+	// Token Admin token sent to the replicas
+	Token string
+}
+
+// PeerResponse Response of one replica to a fanned out request. Err is set
+// when the replica could not be reached.
+type PeerResponse struct {
+	Addr   string
+	Status int
+	Body   []byte
+	Err    error
+}
+
+// GetPeers Get the replicas of the hub
+func GetPeers() *Peers {
+	peersOnce.Do(func() {
+		conf := config.Get()
+		peers = &Peers{Token: conf.AdminToken}
+		if conf.PeerDNS != "" {
+			peers.Resolve = func() ([]string, error) {
+				hosts, err := net.LookupHost(conf.PeerDNS)
+				if err != nil {
+					return nil, err
+				}
+				addrs := make([]string, len(hosts))
+				for i, host := range hosts {
+					addrs[i] = net.JoinHostPort(host, conf.Port)
+				}
+				return addrs, nil
+			}
+		}
+	})
+	return peers
+}
+
+// Fanned Whether r is to be fanned out to the replicas, rather than served
+// locally because replicas are not known or r comes from a replica
+func (p *Peers) Fanned(r *http.Request) bool {
+	return p != nil && p.Resolve != nil && r.Header.Get(PeerHeader) == ""
+}
+
+// Fanout Send a request without body to every replica, this one included.
+// It fails only when the replicas cannot be resolved.
+func (p *Peers) Fanout(ctx context.Context, method string, uri string) ([]PeerResponse, error) {
+	addrs, err := p.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve replicas: %v", err)
+	}
+	responses := make([]PeerResponse, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(response *PeerResponse, addr string) {
+			defer wg.Done()
+			*response = p.send(ctx, method, addr, uri)
+		}(&responses[i], addr)
+	}
+	wg.Wait()
+	return responses, nil
+}
+
+// Owner Address of the replica answering 200 to a GET of uri, e.g. the
+// replica where a session is live. It is empty when no replica does.
+func (p *Peers) Owner(ctx context.Context, uri string) (string, error) {
+	responses, err := p.Fanout(ctx, http.MethodGet, uri)
+	if err != nil {
+		return "", err
+	}
+	for _, response := range responses {
+		if response.Err == nil && response.Status == http.StatusOK {
+			return response.Addr, nil
+		}
+	}
+	for _, response := range responses {
+		if response.Err != nil {
+			return "", response.Err
+		}
+	}
+	return "", nil
+}
+
+// Forward Serve r by the replica at addr. Streams and websockets are relayed
+// as they go.
+func (p *Peers) Forward(w http.ResponseWriter, r *http.Request, addr string) {
+	proxy := &httputil.ReverseProxy{
+		FlushInterval: -1,
+		Director: func(r *http.Request) {
+			r.URL.Scheme, r.URL.Host = "http", addr
+			r.Host = addr
+			r.Header.Set(PeerHeader, "true")
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// Request Request without body to the replica at addr, served locally by
+// the replica
+func (p *Peers) Request(ctx context.Context, method string, addr string, uri string) (*http.Request, error) {
+	req, err := http.NewRequest(method, "http://"+addr+uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+	req.Header.Set(PeerHeader, "true")
+	return req.WithContext(ctx), nil
+}
+
+func (p *Peers) send(ctx context.Context, method string, addr string, uri string) PeerResponse {
+	response := PeerResponse{Addr: addr}
+	req, err := p.Request(ctx, method, addr, uri)
+	if err != nil {
+		response.Err = err
+		return response
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		response.Err = fmt.Errorf("Replica %s: %v", addr, err)
+		return response
+	}
+	defer resp.Body.Close()
+	response.Status = resp.StatusCode
+	response.Body, response.Err = ioutil.ReadAll(resp.Body)
+	return response
+}
+
+// Decode Read the data of a successful response of the replica
+func (pr PeerResponse) Decode(v interface{}) error {
+	if pr.Err != nil {
+		return pr.Err
+	}
+	if pr.Status != http.StatusOK {
+		return fmt.Errorf("Replica %s answered %d: %s", pr.Addr, pr.Status, pr.Body)
+	}
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(pr.Body, &envelope); err != nil {
+		return fmt.Errorf("Replica %s: %v", pr.Addr, err)
+	}
+	return json.Unmarshal(envelope.Data, v)
+}
@@ -0,0 +1,336 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/logger"
+)
+
+const (
+	// PoolStateLabel Label holding the warm pool state of a grid instance
+	PoolStateLabel = "sersan-pool"
+	// PoolGridLabel Label holding the grid name and version of a pooled instance
+	PoolGridLabel = "sersan-grid"
+
+	PoolWarming   = "warming"
+	PoolUnclaimed = "unclaimed"
+	PoolClaimed   = "claimed"
+	// PoolStopped State reported for pooled instances which stopped before
+	// being claimed, e.g. preempted
+	PoolStopped = "stopped"
+
+	warmPoolInterval = 10 * time.Second
+)
+
+// WarmPool Warm pool settings of a grid version
+type WarmPool struct {
+	MinIdle  int              `yaml:"minIdle"`
+	MaxIdle  int              `yaml:"maxIdle"`
+	MaxAge   int              `yaml:"maxAge"`
+	Schedule []WarmPoolWindow `yaml:"schedule"`
+}
+
+// WarmPoolWindow Pool size override during a time of day window, e.g. from
+// "08:00" to "20:00". Windows may wrap around midnight.
+type WarmPoolWindow struct {
+	From    string `yaml:"from"`
+	To      string `yaml:"to"`
+	MinIdle int    `yaml:"minIdle"`
+	MaxIdle int    `yaml:"maxIdle"`
+}
+
+// Limits Pool size at the given time
+func (wp *WarmPool) Limits(now time.Time) (minIdle int, maxIdle int) {
+	minIdle, maxIdle = wp.MinIdle, wp.MaxIdle
+	minute := now.Hour()*60 + now.Minute()
+	for _, window := range wp.Schedule {
+		from, errFrom := minuteOfDay(window.From)
+		to, errTo := minuteOfDay(window.To)
+		if errFrom != nil || errTo != nil {
+			continue
+		}
+		inside := from <= minute && minute < to
+		if from > to {
+			inside = minute >= from || minute < to
+		}
+		if inside {
+			minIdle, maxIdle = window.MinIdle, window.MaxIdle
+			break
+		}
+	}
+	if maxIdle < minIdle {
+		maxIdle = minIdle
+	}
+	return
+}
+
+// Lifetime Maximum age in seconds of an unclaimed instance
+func (wp *WarmPool) Lifetime() int {
+	if wp.MaxAge > 0 {
+		return wp.MaxAge
+	}
+	return 600
+}
+
+func minuteOfDay(clock string) (int, error) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Invalid time of day %s", clock)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, err
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, err
+	}
+	return hour*60 + minute, nil
+}
+
+// PooledGrid Grid instance belonging to a warm pool
+type PooledGrid struct {
+	Name    string
+	UID     string
+	IP      string
+	State   string
+	Created time.Time
+}
+
+// PoolBackend Engine specific operations of a warm pool
+type PoolBackend interface {
+	// List List the pool members of the grid version
+	List(ctx context.Context, gridBase GridBase) ([]PooledGrid, error)
+	// Create Start a grid labelled as warming and mark it unclaimed once ready
+	Create(ctx context.Context, gridBase *GridBase) (string, error)
+	// Claim Atomically mark an unclaimed grid as claimed and set the labels of
+	// the session claiming it. It returns false when another hub replica
+	// claimed it first.
+	Claim(ctx context.Context, grid PooledGrid, labels map[string]string) (bool, error)
+	Delete(name string) error
+}
+
+func getPoolBackend(engineType string) (PoolBackend, bool) {
+	factory, err := LookupEngine(engineType)
+	if err != nil || factory.Pool == nil {
+		return nil, false
+	}
+	return factory.Pool, true
+}
+
+// PoolStats Warm pool size as of its last reconciliation
+type PoolStats struct {
+	Idle    int `json:"idle"`
+	Warming int `json:"warming"`
+	MinIdle int `json:"minIdle"`
+	MaxIdle int `json:"maxIdle"`
+}
+
+// WarmPools Keep pre-started grids for the grids having a warm pool
+type WarmPools struct {
+	GridConfig *GridConfig
+	lock       sync.Mutex
+	inflight   map[string]int
+	stats      map[string]PoolStats
+	wake       chan struct{}
+}
+
+var warmPools *WarmPools
+var warmPoolsOnce sync.Once
+
+// GetWarmPools Get warm pools
+func GetWarmPools() *WarmPools {
+	warmPoolsOnce.Do(func() {
+		warmPools = &WarmPools{
+			GridConfig: GetGridConfig(),
+			inflight:   make(map[string]int),
+			stats:      make(map[string]PoolStats),
+			wake:       make(chan struct{}, 1),
+		}
+	})
+	return warmPools
+}
+
+// Claim Claim a ready grid from the warm pool of the grid. It returns false
+// when the grid has no warm pool or no idle instance.
+func (p *WarmPools) Claim(ctx context.Context, gridBase GridBase) (*StartedGrid, bool) {
+	conf := config.Get()
+	pool := gridBase.Grid.WarmPool
+	if pool == nil || gridBase.Timeout > conf.GridTimeout {
+		return nil, false
+	}
+	// Pooled instances emulate the default device
+	if defaultDevice, _ := gridBase.Grid.Device(""); gridBase.DeviceProfile != defaultDevice {
+		return nil, false
+	}
+	backend, ok := getPoolBackend(gridBase.Grid.Engine)
+	if !ok {
+		return nil, false
+	}
+	log := logger.FromContext(ctx)
+	members, err := backend.List(ctx, gridBase)
+	if err != nil {
+		log.Errorf("Failed to list warm pool: %v", err)
+		return nil, false
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Created.Before(members[j].Created) })
+
+	maxAge := time.Duration(pool.Lifetime()) * time.Second
+	for _, member := range members {
+		if member.State != PoolUnclaimed || time.Since(member.Created) >= maxAge {
+			continue
+		}
+		claimed, err := backend.Claim(ctx, member, gridBase.InstanceLabels())
+		if err != nil {
+			log.With(logger.Instance, member.Name).Warnf("Failed to claim from warm pool: %v", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		p.Wake()
+		u, err := url.Parse("http://" + member.IP + ":" + strconv.Itoa(int(gridBase.Grid.Port)))
+		if err != nil {
+			backend.Delete(member.Name)
+			continue
+		}
+		log.With(logger.Instance, member.Name).Infof("Claimed from warm pool")
+		name := member.Name
+		return &StartedGrid{
+			Name:    name,
+			UID:     member.UID,
+			URL:     u,
+			Grid:    gridBase,
+			VNCPort: strconv.Itoa(int(gridBase.Grid.VNCPort)),
+			Cancel: func() {
+				backend.Delete(name)
+			},
+		}, true
+	}
+	log.Infof("Warm pool is empty")
+	p.Wake()
+	return nil, false
+}
+
+// Wake Trigger a refill of the pools
+func (p *WarmPools) Wake() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run Refill the pools and recycle aged instances until ctx is done
+func (p *WarmPools) Run(ctx context.Context) {
+	tick := time.NewTicker(warmPoolInterval)
+	defer tick.Stop()
+	for {
+		p.reconcile(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		case <-p.wake:
+		}
+	}
+}
+
+// Stats Size of the warm pool of the grid version key
+func (p *WarmPools) Stats(key string) (PoolStats, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stats, ok := p.stats[key]
+	return stats, ok
+}
+
+func (p *WarmPools) reconcile(ctx context.Context) {
+	p.GridConfig.Each(func(name string, version string, grid *Grid) {
+		if grid.WarmPool == nil {
+			return
+		}
+		backend, ok := getPoolBackend(grid.Engine)
+		if !ok {
+			logger.Warnf("Engine %s of %s-%s does not support warm pools", grid.Engine, name, version)
+			return
+		}
+		p.reconcileGrid(ctx, backend, GridBase{Name: name, Version: version, Grid: grid})
+	})
+}
+
+func (p *WarmPools) reconcileGrid(ctx context.Context, backend PoolBackend, gridBase GridBase) {
+	conf := config.Get()
+	key := gridBase.Key()
+	pool := gridBase.Grid.WarmPool
+	log := gridBase.Log(ctx)
+	members, err := backend.List(ctx, gridBase)
+	if err != nil {
+		log.Errorf("Failed to list warm pool: %v", err)
+		return
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Created.After(members[j].Created) })
+
+	maxAge := time.Duration(pool.Lifetime()) * time.Second
+	startupTimeout := time.Duration(conf.StartupTimeout) * time.Millisecond
+	minIdle, maxIdle := pool.Limits(time.Now())
+	unclaimed, warming := 0, 0
+	for _, member := range members {
+		age := time.Since(member.Created)
+		switch {
+		case member.State == PoolUnclaimed && (age >= maxAge || unclaimed >= maxIdle):
+			log.With(logger.Instance, member.Name).Infof("Recycling from warm pool")
+			backend.Delete(member.Name)
+		case member.State == PoolUnclaimed:
+			unclaimed++
+		case member.State == PoolWarming && age >= startupTimeout:
+			backend.Delete(member.Name)
+		case member.State == PoolWarming:
+			warming++
+		case member.State == PoolStopped:
+			log.With(logger.Instance, member.Name).Infof("Deleting stopped from warm pool")
+			backend.Delete(member.Name)
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.inflight[key] > warming {
+		warming = p.inflight[key]
+	}
+	p.stats[key] = PoolStats{Idle: unclaimed, Warming: warming, MinIdle: minIdle, MaxIdle: maxIdle}
+	for missing := minIdle - unclaimed - warming; missing > 0; missing-- {
+		p.inflight[key]++
+		go p.warm(ctx, backend, gridBase)
+	}
+}
+
+func (p *WarmPools) warm(ctx context.Context, backend PoolBackend, gridBase GridBase) {
+	conf := config.Get()
+	defer func() {
+		p.lock.Lock()
+		p.inflight[gridBase.Key()]--
+		p.lock.Unlock()
+	}()
+
+	// Unclaimed grids must outlive their maximum age by a full session
+	gridBase.Timeout = conf.GridTimeout + gridBase.Grid.WarmPool.Lifetime()
+	gridBase.DeviceProfile, gridBase.Device = gridBase.Grid.Device("")
+	gridBase.Labels = map[string]string{
+		PoolStateLabel: PoolWarming,
+		PoolGridLabel:  gridBase.Key(),
+	}
+	ctx = gridBase.LogContext(ctx)
+	name, err := backend.Create(ctx, &gridBase)
+	if err != nil {
+		gridBase.Log(ctx).Errorf("Failed to warm: %v", err)
+		return
+	}
+	gridBase.Log(ctx).With(logger.Instance, name).Infof("Added to warm pool")
+}
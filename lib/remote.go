@@ -0,0 +1,315 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/salestock/sersan/logger"
+)
+
+const (
+	// RoundRobin Upstreams are used in turn
+	RoundRobin = "round-robin"
+	// Weighted Upstreams are used proportionally to their weight
+	Weighted = "weighted"
+
+	remoteHealthInterval = 10 * time.Second
+	remoteHealthTimeout  = 5 * time.Second
+)
+
+// Upstream Remote WebDriver hub of a remote grid
+type Upstream struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+// RemoteConfig Remote engine section of a grid
+type RemoteConfig struct {
+	Upstreams []Upstream `yaml:"upstreams"`
+	Balance   string     `yaml:"balance"`
+}
+
+// RemoteClient Remote engine client. Remote grids are not created nor
+// deleted, sessions are forwarded to an existing hub.
+type RemoteClient struct{}
+
+// RemoteEngine Remote engine
+type RemoteEngine struct {
+	GridBase GridBase
+	Caps     Caps
+}
+
+// RemoteUpstreams Health and balancing state of the remote upstreams
+type RemoteUpstreams struct {
+	GridConfig *GridConfig
+	Client     *http.Client
+	lock       sync.Mutex
+	unhealthy  map[string]bool
+	turns      map[string]int
+	weights    map[string]map[string]int
+}
+
+var remoteUpstreams *RemoteUpstreams
+var remoteOnce sync.Once
+
+func init() {
+	RegisterEngine(RemoteType, EngineFactory{
+		Client: func() (Engine, error) { return RemoteClient{}, nil },
+		Starter: func(gridBase GridBase, caps Caps) GridStarter {
+			return RemoteEngine{GridBase: gridBase, Caps: caps}
+		},
+		Config: func() interface{} { return &RemoteConfig{} },
+	})
+}
+
+// remoteConfig Remote section of the grid
+func remoteConfig(grid *Grid) *RemoteConfig {
+	if rc, ok := grid.EngineConfig.(*RemoteConfig); ok {
+		return rc
+	}
+	return &RemoteConfig{}
+}
+
+// GetRemoteUpstreams Get remote upstreams
+func GetRemoteUpstreams() *RemoteUpstreams {
+	remoteOnce.Do(func() {
+		remoteUpstreams = &RemoteUpstreams{
+			GridConfig: GetGridConfig(),
+			Client:     &http.Client{Timeout: remoteHealthTimeout},
+			unhealthy:  make(map[string]bool),
+			turns:      make(map[string]int),
+			weights:    make(map[string]map[string]int),
+		}
+	})
+	return remoteUpstreams
+}
+
+// Run Health check the upstreams until ctx is done
+func (ru *RemoteUpstreams) Run(ctx context.Context) {
+	tick := time.NewTicker(remoteHealthInterval)
+	defer tick.Stop()
+	for {
+		ru.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (ru *RemoteUpstreams) check(ctx context.Context) {
+	ru.GridConfig.Each(func(name string, version string, grid *Grid) {
+		if EngineName(grid.Engine) != RemoteType {
+			return
+		}
+		healthCheck := grid.HealthCheck
+		if healthCheck == "" {
+			healthCheck = "/status"
+		}
+		for _, upstream := range remoteConfig(grid).Upstreams {
+			err := ru.ping(ctx, upstream.URL+healthCheck)
+			ru.lock.Lock()
+			if err != nil && !ru.unhealthy[upstream.URL] {
+				logger.With(logger.Grid, name+"-"+version).Warnf("Upstream %s is unhealthy: %v", redactURL(upstream.URL), err)
+			}
+			ru.unhealthy[upstream.URL] = err != nil
+			ru.lock.Unlock()
+		}
+	})
+}
+
+func (ru *RemoteUpstreams) ping(ctx context.Context, target string) error {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ru.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// MarkUnhealthy Skip the upstream until its next successful health check
+func (ru *RemoteUpstreams) MarkUnhealthy(upstream string) {
+	ru.lock.Lock()
+	defer ru.lock.Unlock()
+	ru.unhealthy[upstream] = true
+}
+
+// Order Upstreams of the grid in the order they should be tried. The first
+// one is chosen by the grid balance, the other healthy ones follow as
+// failover. Unhealthy upstreams are only tried last.
+func (ru *RemoteUpstreams) Order(gridBase GridBase) []Upstream {
+	ru.lock.Lock()
+	defer ru.lock.Unlock()
+	rc := remoteConfig(gridBase.Grid)
+	var healthy, unhealthy []Upstream
+	for _, upstream := range rc.Upstreams {
+		if ru.unhealthy[upstream.URL] {
+			unhealthy = append(unhealthy, upstream)
+		} else {
+			healthy = append(healthy, upstream)
+		}
+	}
+	if len(healthy) == 0 {
+		return unhealthy
+	}
+
+	first := 0
+	key := gridBase.Key()
+	switch strings.ToLower(rc.Balance) {
+	case Weighted:
+		// Smooth weighted round robin
+		if ru.weights[key] == nil {
+			ru.weights[key] = make(map[string]int)
+		}
+		current := ru.weights[key]
+		total := 0
+		for i, upstream := range healthy {
+			weight := upstream.Weight
+			if weight <= 0 {
+				weight = 1
+			}
+			total += weight
+			current[upstream.URL] += weight
+			if current[upstream.URL] > current[healthy[first].URL] {
+				first = i
+			}
+		}
+		current[healthy[first].URL] -= total
+	default:
+		first = ru.turns[key] % len(healthy)
+		ru.turns[key]++
+	}
+
+	order := append([]Upstream{healthy[first]}, healthy[:first]...)
+	order = append(order, healthy[first+1:]...)
+	return append(order, unhealthy...)
+}
+
+// UpstreamUser Credentials configured for the upstream at host, if any
+func UpstreamUser(host string) *url.Userinfo {
+	var user *url.Userinfo
+	GetGridConfig().Each(func(_ string, _ string, grid *Grid) {
+		for _, upstream := range remoteConfig(grid).Upstreams {
+			u, err := url.Parse(upstream.URL)
+			if err == nil && u.User != nil && hostPort(u) == host {
+				user = u.User
+			}
+		}
+	})
+	return user
+}
+
+// hostPort Host with explicit port
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	u.User = nil
+	return u.String()
+}
+
+// CreateGrid Select the upstream to forward to
+func (c RemoteClient) CreateGrid(ctx context.Context, gridBase *GridBase) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	order := GetRemoteUpstreams().Order(*gridBase)
+	if len(order) == 0 {
+		return "", errors.New("Grid has no upstream")
+	}
+	return order[0].URL, nil
+}
+
+// DeleteGrid Nothing to delete, the session itself is deleted on the upstream
+func (c RemoteClient) DeleteGrid(name string) error {
+	return nil
+}
+
+// WaitUntilReady Remote upstreams are always running
+func (c RemoteClient) WaitUntilReady(ctx context.Context, name string, timeout int32) (string, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Hostname(), nil
+}
+
+// StartWithCancel Select an upstream. Failing over to the next upstream is
+// left to the caller through StartedGrid.Failover.
+func (re RemoteEngine) StartWithCancel(ctx context.Context) (*StartedGrid, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	order := GetRemoteUpstreams().Order(re.GridBase)
+	if len(order) == 0 {
+		return nil, errors.New("Grid has no upstream")
+	}
+	return re.started(order, logger.FromContext(ctx))
+}
+
+func (re RemoteEngine) started(order []Upstream, log *logger.Entry) (*StartedGrid, error) {
+	upstream := order[0]
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		return nil, err
+	}
+	grid := *re.GridBase.Grid
+	grid.BaseURL = strings.TrimSuffix(u.Path, "/")
+	gridBase := re.GridBase
+	gridBase.Grid = &grid
+	u.Path = ""
+
+	s := StartedGrid{
+		Name:    "remote-" + u.Hostname(),
+		URL:     u,
+		Grid:    gridBase,
+		VNCPort: "0",
+		Cancel:  func() {},
+	}
+	if len(order) > 1 {
+		s.Failover = func() (*StartedGrid, bool) {
+			GetRemoteUpstreams().MarkUnhealthy(upstream.URL)
+			next, err := re.started(order[1:], log)
+			if err != nil {
+				log.Errorf("Failed to fail over to %s: %v", redactURL(order[1].URL), err)
+				return nil, false
+			}
+			log.Warnf("Failing over from %s to %s", redactURL(upstream.URL), redactURL(order[1].URL))
+			return next, true
+		}
+	}
+	return &s, nil
+}
+
+// SplitHostPort Host and port of the URL, with the default port of its
+// scheme when none is given
+func SplitHostPort(u *url.URL) (string, string) {
+	host, port, _ := net.SplitHostPort(hostPort(u))
+	return host, port
+}
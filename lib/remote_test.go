@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestUpstreams(gc *GridConfig) *RemoteUpstreams {
+	return &RemoteUpstreams{
+		GridConfig: gc,
+		Client:     http.DefaultClient,
+		unhealthy:  make(map[string]bool),
+		turns:      make(map[string]int),
+		weights:    make(map[string]map[string]int),
+	}
+}
+
+func remoteGridBase(balance string, upstreams ...Upstream) GridBase {
+	grid := &Grid{Engine: RemoteType, EngineConfig: &RemoteConfig{Upstreams: upstreams, Balance: balance}}
+	return GridBase{Name: "safari", Version: "13", Grid: grid}
+}
+
+func upstreamURLs(order []Upstream) []string {
+	urls := make([]string, len(order))
+	for i, upstream := range order {
+		urls[i] = upstream.URL
+	}
+	return urls
+}
+
+func TestRemoteOrderRoundRobin(t *testing.T) {
+	ru := newTestUpstreams(&GridConfig{})
+	gridBase := remoteGridBase("", Upstream{URL: "http://a"}, Upstream{URL: "http://b"}, Upstream{URL: "http://c"})
+	for _, want := range [][]string{
+		{"http://a", "http://b", "http://c"},
+		{"http://b", "http://a", "http://c"},
+		{"http://c", "http://a", "http://b"},
+		{"http://a", "http://b", "http://c"},
+	} {
+		if order := upstreamURLs(ru.Order(gridBase)); !equalStrings(order, want) {
+			t.Errorf("Got order %v, want %v", order, want)
+		}
+	}
+}
+
+func TestRemoteOrderWeighted(t *testing.T) {
+	ru := newTestUpstreams(&GridConfig{})
+	gridBase := remoteGridBase(Weighted, Upstream{URL: "http://a", Weight: 3}, Upstream{URL: "http://b", Weight: 1})
+	firsts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		firsts[ru.Order(gridBase)[0].URL]++
+	}
+	if firsts["http://a"] != 6 || firsts["http://b"] != 2 {
+		t.Errorf("Upstreams chosen first %v, want 6 times a and 2 times b", firsts)
+	}
+}
+
+func TestRemoteOrderUnhealthyLast(t *testing.T) {
+	ru := newTestUpstreams(&GridConfig{})
+	gridBase := remoteGridBase("", Upstream{URL: "http://a"}, Upstream{URL: "http://b"})
+	ru.MarkUnhealthy("http://a")
+	for i := 0; i < 2; i++ {
+		if order := upstreamURLs(ru.Order(gridBase)); !equalStrings(order, []string{"http://b", "http://a"}) {
+			t.Errorf("Got order %v, want the unhealthy upstream last", order)
+		}
+	}
+	ru.MarkUnhealthy("http://b")
+	if order := ru.Order(gridBase); len(order) != 2 {
+		t.Errorf("Got order %v, want unhealthy upstreams tried when none is healthy", upstreamURLs(order))
+	}
+}
+
+func TestRemoteHealthCheck(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/wd/hub/status" {
+			t.Errorf("Unexpected health check %s", r.URL.Path)
+		}
+	}))
+	defer healthy.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	gc, err := loadTestGrids(t, `
+safari:
+  versions:
+    13:
+      engine: "remote"
+      healthCheck: "/status"
+      remote:
+        upstreams:
+          - url: "`+broken.URL+`/wd/hub"
+          - url: "`+healthy.URL+`/wd/hub"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ru := newTestUpstreams(gc)
+	ru.check(context.Background())
+	grid, _, _ := gc.Find("safari", "13")
+	gridBase := GridBase{Name: "safari", Version: "13", Grid: grid}
+	for i := 0; i < 2; i++ {
+		if order := ru.Order(gridBase); order[0].URL != healthy.URL+"/wd/hub" {
+			t.Errorf("Got order %v, want the healthy upstream first", upstreamURLs(order))
+		}
+	}
+}
+
+func TestRemoteFailover(t *testing.T) {
+	upstreams := map[string]string{"failover-a": "http://failover-a:4444/wd/hub", "failover-b": "https://failover-b/hub/"}
+	gridBase := remoteGridBase("", Upstream{URL: upstreams["failover-a"]}, Upstream{URL: upstreams["failover-b"]})
+	started, err := RemoteEngine{GridBase: gridBase}.StartWithCancel(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, ok := started.Failover()
+	if !ok {
+		t.Fatal("No failover to the second upstream")
+	}
+	if next.URL.Hostname() == started.URL.Hostname() {
+		t.Errorf("Failed over to the same upstream %s", started.URL)
+	}
+	if next.Failover != nil {
+		t.Error("Failover after the last upstream")
+	}
+	// The failed upstream is only tried last by the next sessions
+	for i := 0; i < 2; i++ {
+		if order := GetRemoteUpstreams().Order(gridBase); order[1].URL != upstreams[started.URL.Hostname()] {
+			t.Errorf("Got order %v, want the failed upstream last", upstreamURLs(order))
+		}
+	}
+	for _, grid := range []*StartedGrid{started, next} {
+		want := map[string]string{"failover-a": "http://failover-a:4444/wd/hub", "failover-b": "https://failover-b/hub"}[grid.URL.Hostname()]
+		if got := grid.URL.String() + grid.Grid.Grid.BaseURL; got != want {
+			t.Errorf("Started grid %s, want %s", got, want)
+		}
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
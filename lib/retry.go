@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/salestock/sersan/config"
+)
+
+// Error classes of failed new session attempts
+const (
+	// RetryTimeout The attempt timed out
+	RetryTimeout = "timeout"
+	// RetryConnection The grid could not be reached, or closed the connection
+	RetryConnection = "connection"
+)
+
+const defaultRetryJitter = 0.2
+
+// defaultRetryStatuses Grid responses retried by default: the grid is not
+// routing new sessions yet, or its node is not ready
+var defaultRetryStatuses = []int{404, 502, 503, 504}
+
+// RetryPolicy New session attempts of a grid. Times are in milliseconds.
+// Unset fields default to NEW_SESSION_ATTEMPT_TIMEOUT, RETRY_COUNT,
+// NEW_SESSION_BACKOFF and NEW_SESSION_MAX_BACKOFF. Attempts failing with a
+// retryable status or error class are retried after an exponential backoff
+// randomized by Jitter. Once MaxAttempts attempts failed, the grid is deleted
+// and started again, up to Recreate times.
+type RetryPolicy struct {
+	AttemptTimeout int32    `yaml:"attemptTimeout"`
+	MaxAttempts    int32    `yaml:"maxAttempts"`
+	Backoff        int32    `yaml:"backoff"`
+	MaxBackoff     int32    `yaml:"maxBackoff"`
+	Jitter         *float64 `yaml:"jitter"`
+	RetryStatuses  []int    `yaml:"retryStatuses"`
+	RetryErrors    []string `yaml:"retryErrors"`
+	Recreate       int      `yaml:"recreate"`
+}
+
+// RetryPolicy Retry policy of the grid, with the defaults of conf filled in
+func (g *Grid) RetryPolicy(conf *config.Config) RetryPolicy {
+	policy := RetryPolicy{}
+	if g.Retry != nil {
+		policy = *g.Retry
+	}
+	if policy.AttemptTimeout <= 0 {
+		policy.AttemptTimeout = conf.NewSessionAttemptTimeout
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = conf.RetryCount
+	}
+	if policy.Backoff <= 0 {
+		policy.Backoff = conf.NewSessionBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = conf.NewSessionMaxBackoff
+	}
+	if policy.Jitter == nil {
+		jitter := defaultRetryJitter
+		policy.Jitter = &jitter
+	}
+	if policy.RetryStatuses == nil {
+		policy.RetryStatuses = defaultRetryStatuses
+	}
+	if policy.RetryErrors == nil {
+		policy.RetryErrors = []string{RetryTimeout, RetryConnection}
+	}
+	return policy
+}
+
+func (p *RetryPolicy) validate() error {
+	if p.Jitter != nil && (*p.Jitter < 0 || *p.Jitter > 1) {
+		return fmt.Errorf("Jitter %v is not between 0 and 1", *p.Jitter)
+	}
+	for _, class := range p.RetryErrors {
+		if class != RetryTimeout && class != RetryConnection {
+			return fmt.Errorf("Unknown retry error %s", class)
+		}
+	}
+	return nil
+}
+
+// RetryStatus Whether attempts answered with status are retried
+func (p RetryPolicy) RetryStatus(status int) bool {
+	for _, retryable := range p.RetryStatuses {
+		if status == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryError Whether attempts failing with the error class are retried
+func (p RetryPolicy) RetryError(class string) bool {
+	for _, retryable := range p.RetryErrors {
+		if class == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay Backoff after the given failed attempt on a grid, counted from 1
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	backoff := time.Duration(p.Backoff) * time.Millisecond
+	maxBackoff := time.Duration(p.MaxBackoff) * time.Millisecond
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	jitter := 0.0
+	if p.Jitter != nil {
+		jitter = *p.Jitter
+	}
+	return time.Duration(float64(backoff) * (1 - jitter + 2*jitter*rand.Float64()))
+}
@@ -0,0 +1,30 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/salestock/sersan/config"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	jitter := 0.0
+	policy := RetryPolicy{Backoff: 100, MaxBackoff: 1000, Jitter: &jitter}
+	for attempt, want := range map[int]time.Duration{1: 100, 2: 200, 4: 800, 5: 1000, 30: 1000} {
+		if delay := policy.Delay(attempt); delay != want*time.Millisecond {
+			t.Errorf("Delay after attempt %d is %v, want %v", attempt, delay, want*time.Millisecond)
+		}
+	}
+}
+
+func TestRetryPolicyDefaults(t *testing.T) {
+	conf := config.Config{NewSessionAttemptTimeout: 1000, RetryCount: 5, NewSessionBackoff: 50, NewSessionMaxBackoff: 500}
+	grid := &Grid{Retry: &RetryPolicy{MaxAttempts: 2, RetryStatuses: []int{503}}}
+	policy := grid.RetryPolicy(&conf)
+	if policy.AttemptTimeout != 1000 || policy.MaxAttempts != 2 || policy.Backoff != 50 || policy.MaxBackoff != 500 {
+		t.Errorf("Unexpected policy %+v", policy)
+	}
+	if policy.RetryStatus(404) || !policy.RetryStatus(503) || !policy.RetryError(RetryTimeout) {
+		t.Errorf("Unexpected retryable failures of %+v", policy)
+	}
+}
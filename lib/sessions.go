@@ -0,0 +1,218 @@
+package lib
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/utils"
+)
+
+// ErrSessionNotFound Session is not live on this replica
+var ErrSessionNotFound = errors.New("Session not found")
+
+// LiveSession Session created or proxied by this replica. Age and Idle are
+// the seconds since the session was created and since its last command.
+type LiveSession struct {
+	SessionID   string             `json:"sessionId"`
+	RequestID   string             `json:"requestId,omitempty"`
+	User        string             `json:"user,omitempty"`
+	Remote      string             `json:"remote,omitempty"`
+	Grid        string             `json:"grid,omitempty"`
+	Engine      string             `json:"engine,omitempty"`
+	Instance    string             `json:"instance"`
+	Host        string             `json:"host"`
+	VNC         bool               `json:"vnc"`
+	Created     time.Time          `json:"created"`
+	LastCommand time.Time          `json:"lastCommand"`
+	Commands    int                `json:"commands"`
+	Age         float64            `json:"age"`
+	Idle        float64            `json:"idle"`
+	Info        *utils.SessionInfo `json:"-"`
+	expires     time.Time
+}
+
+// endedSession Session ended by Sersan, whose later commands are refused
+type endedSession struct {
+	reason  string
+	expires time.Time
+}
+
+// SessionRegistry Live sessions of this replica, by Sersan session ID.
+// Sessions are forgotten once deleted or past their grid lifetime.
+type SessionRegistry struct {
+	lock     sync.Mutex
+	sessions map[string]*LiveSession
+	ended    map[string]endedSession
+}
+
+// Add Register a session created by this replica
+func (sr *SessionRegistry) Add(sessionID string, info *utils.SessionInfo, remote string, lifetime time.Duration) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	sr.add(sessionID, info, lifetime).Remote = remote
+}
+
+// Touch Record a command of the session, registering sessions created by
+// other replicas on their first command
+func (sr *SessionRegistry) Touch(sessionID string, info *utils.SessionInfo, lifetime time.Duration) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	session, ok := sr.sessions[sessionID]
+	if !ok {
+		session = sr.add(sessionID, info, lifetime)
+	}
+	session.LastCommand = time.Now()
+	session.Commands++
+}
+
+func (sr *SessionRegistry) add(sessionID string, info *utils.SessionInfo, lifetime time.Duration) *LiveSession {
+	if sr.sessions == nil {
+		sr.sessions = make(map[string]*LiveSession)
+	}
+	created := time.Now()
+	if info.Created > 0 {
+		created = time.Unix(info.Created, 0)
+	}
+	session := &LiveSession{
+		SessionID: sessionID,
+		RequestID: info.RequestID,
+		User:      info.Owner,
+		Grid:      info.Grid,
+		Engine:    EngineName(info.Engine),
+		Instance:  info.ServiceName,
+		Host:      info.Host,
+		VNC:       info.VNCPort != "" && info.VNCPort != "0",
+		Created:   created,
+		Info:      info,
+		expires:   created.Add(lifetime),
+	}
+	sr.sessions[sessionID] = session
+	return session
+}
+
+// Remove Forget a deleted session
+func (sr *SessionRegistry) Remove(sessionID string) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	delete(sr.sessions, sessionID)
+}
+
+// End Forget a session ended by Sersan. Its later commands are refused with
+// the reason until the end of its grid lifetime.
+func (sr *SessionRegistry) End(sessionID string, reason string) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	sr.expire()
+	expires := time.Now().Add(time.Duration(config.Get().GridTimeout) * time.Second)
+	if session, ok := sr.sessions[sessionID]; ok {
+		expires = session.expires
+		delete(sr.sessions, sessionID)
+	}
+	if sr.ended == nil {
+		sr.ended = make(map[string]endedSession)
+	}
+	sr.ended[sessionID] = endedSession{reason: reason, expires: expires}
+}
+
+// Ended Reason why Sersan ended the session, if it did
+func (sr *SessionRegistry) Ended(sessionID string) (string, bool) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	ended, ok := sr.ended[sessionID]
+	if !ok || time.Now().After(ended.expires) {
+		return "", false
+	}
+	return ended.reason, true
+}
+
+// List Live sessions, oldest first
+func (sr *SessionRegistry) List() []LiveSession {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	sr.expire()
+	sessions := make([]LiveSession, 0, len(sr.sessions))
+	for _, session := range sr.sessions {
+		sessions = append(sessions, session.snapshot())
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	return sessions
+}
+
+// Find Live session of a request ID or Sersan session ID
+func (sr *SessionRegistry) Find(id string) (LiveSession, error) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	sr.expire()
+	if session, ok := sr.sessions[id]; ok {
+		return session.snapshot(), nil
+	}
+	for _, session := range sr.sessions {
+		if session.RequestID == id {
+			return session.snapshot(), nil
+		}
+	}
+	return LiveSession{}, ErrSessionNotFound
+}
+
+// expire Forget the sessions past their grid lifetime
+func (sr *SessionRegistry) expire() {
+	now := time.Now()
+	for sessionID, session := range sr.sessions {
+		if now.After(session.expires) {
+			delete(sr.sessions, sessionID)
+		}
+	}
+	for sessionID, ended := range sr.ended {
+		if now.After(ended.expires) {
+			delete(sr.ended, sessionID)
+		}
+	}
+}
+
+func (s *LiveSession) snapshot() LiveSession {
+	session := *s
+	now := time.Now()
+	session.Age = now.Sub(s.Created).Seconds()
+	lastActive := s.Created
+	if s.LastCommand.After(lastActive) {
+		lastActive = s.LastCommand
+	}
+	session.Idle = now.Sub(lastActive).Seconds()
+	return session
+}
+
+// MergeSessions Sessions listed by several replicas, once each and oldest
+// first. A session proxied by several replicas adds up their commands.
+func MergeSessions(lists ...[]LiveSession) []LiveSession {
+	merged := map[string]int{}
+	sessions := []LiveSession{}
+	for _, list := range lists {
+		for _, session := range list {
+			i, ok := merged[session.SessionID]
+			if !ok {
+				merged[session.SessionID] = len(sessions)
+				sessions = append(sessions, session)
+				continue
+			}
+			if sessions[i].Remote == "" {
+				sessions[i].Remote = session.Remote
+			}
+			if session.LastCommand.After(sessions[i].LastCommand) {
+				sessions[i].LastCommand = session.LastCommand
+			}
+			if session.Idle < sessions[i].Idle {
+				sessions[i].Idle = session.Idle
+			}
+			sessions[i].Commands += session.Commands
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	return sessions
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/salestock/sersan/config"
+)
+
+// StartupScriptData Values available to grid startup script templates
+type StartupScriptData struct {
+	Name         string
+	Version      string
+	Session      string
+	Owner        string
+	DeviceName   string
+	Device       string
+	AVD          string
+	Screen       string
+	Density      int
+	RAM          int
+	AppiumPort   int32
+	AppiumArgs   []string
+	EmulatorArgs []string
+	VNCPort      int32
+	Zone         string
+	Timeout      int
+	CallbackURL  string
+}
+
+// startupScriptFuncs Template functions. Values coming from the session
+// capabilities must be quoted before being used in a shell command.
+var startupScriptFuncs = template.FuncMap{
+	"quote": shellQuote,
+	"args": func(args []string) string {
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = shellQuote(arg)
+		}
+		return strings.Join(quoted, " ")
+	},
+}
+
+// shellQuote Quote s as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// parseStartupScript Parse the startup script template of a grid version
+func parseStartupScript(name string, script string) (*template.Template, error) {
+	return template.New(name).Funcs(startupScriptFuncs).Option("missingkey=error").Parse(script)
+}
+
+// StartupScriptData Values rendered into the startup script of a grid
+// instance in zone
+func (gb GridBase) StartupScriptData(zone string) StartupScriptData {
+	grid := gb.Grid
+	cc := computeConfig(grid)
+	data := StartupScriptData{
+		Name:         gb.Name,
+		Version:      gb.Version,
+		Session:      gb.RequestID,
+		Owner:        gb.Owner,
+		DeviceName:   gb.DeviceName,
+		AVD:          cc.AVD,
+		AppiumPort:   grid.Port,
+		AppiumArgs:   cc.AppiumArgs,
+		EmulatorArgs: cc.EmulatorArgs,
+		VNCPort:      grid.VNCPort,
+		Zone:         zone,
+		Timeout:      gb.Lifetime(),
+		CallbackURL:  config.Get().CallbackURL,
+	}
+	if device := gb.Device; device != nil {
+		data.Device = gb.DeviceProfile
+		if device.AVD != "" {
+			data.AVD = device.AVD
+		}
+		data.Screen, data.Density, data.RAM = device.Screen, device.Density, device.RAM
+	}
+	if data.AVD == "" {
+		data.AVD = "emulator"
+	}
+	if data.AppiumArgs == nil {
+		data.AppiumArgs = []string{"--relaxed-security"}
+	}
+	if data.EmulatorArgs == nil {
+		data.EmulatorArgs = []string{"-gpu", "swiftshader_indirect", "-no-snapshot-save"}
+	}
+	return data
+}
+
+// StartupScript Render the startup script template of the grid for an
+// instance in zone. It is empty when the grid has no template.
+func (gb GridBase) StartupScript(zone string) (string, error) {
+	startupTemplate := computeConfig(gb.Grid).startupTemplate
+	if startupTemplate == nil {
+		return "", nil
+	}
+	var script bytes.Buffer
+	if err := startupTemplate.Execute(&script, gb.StartupScriptData(zone)); err != nil {
+		return "", &GridError{Class: ErrorConfig, Code: "STARTUP_SCRIPT", Message: err.Error()}
+	}
+	return script.String(), nil
+}
@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestStartupScriptQuoting(t *testing.T) {
+	gc, err := loadTestGrids(t, `
+android:
+  versions:
+    9.0.0:
+      engine: "compute"
+      compute:
+        appiumArgs: ["--default-capabilities", "{\"appium:locale\": \"it's\"}"]
+        startupScript: |
+          printf '%s\n' {{quote .DeviceName}} {{quote .AVD}} {{args .AppiumArgs}} {{args .EmulatorArgs}} {{quote .Zone}}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grid, _, _ := gc.Find("android", "9.0.0")
+	deviceName := `Pixel 3'; touch /tmp/pwned; echo '$(id) "x"`
+	gridBase := GridBase{Name: "android", Version: "9.0.0", DeviceName: deviceName, Grid: grid}
+	script, err := gridBase.StartupScript("asia-southeast1-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("/bin/sh", "-c", script).Output()
+	if err != nil {
+		t.Fatalf("Rendered script %q failed: %v", script, err)
+	}
+	want := []string{
+		deviceName,
+		"emulator",
+		"--default-capabilities", `{"appium:locale": "it's"}`,
+		"-gpu", "swiftshader_indirect", "-no-snapshot-save",
+		"asia-southeast1-b",
+	}
+	if got := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"); !equalStrings(got, want) {
+		t.Errorf("Script printed %q, want %q", got, want)
+	}
+}
+
+func TestStartupScriptData(t *testing.T) {
+	cc := &ComputeConfig{AVD: "generic", Devices: map[string]*DeviceProfile{"pixel 3": {AVD: "pixel_3", Screen: "1080x2160", Density: 440}}}
+	grid := &Grid{Engine: ComputeEngineType, Port: 4723, EngineConfig: cc}
+	gridBase := GridBase{Grid: grid}
+	if data := gridBase.StartupScriptData("zone"); data.AVD != "generic" || data.Device != "" || data.AppiumPort != 4723 {
+		t.Errorf("Unexpected data without device %+v", data)
+	}
+	gridBase.DeviceProfile, gridBase.Device = grid.Device("Pixel 3")
+	data := gridBase.StartupScriptData("zone")
+	if data.AVD != "pixel_3" || data.Device != "pixel 3" || data.Screen != "1080x2160" || data.Density != 440 {
+		t.Errorf("Unexpected data of the device %+v", data)
+	}
+	if script, err := gridBase.StartupScript("zone"); script != "" || err != nil {
+		t.Errorf("Got script %q and %v, want none without template", script, err)
+	}
+}
+
+func TestStartupScriptErrors(t *testing.T) {
+	_, err := loadTestGrids(t, `
+android:
+  versions:
+    9.0.0:
+      engine: "compute"
+      compute:
+        startupScript: "{{quote .AVD"
+`)
+	if err == nil || !strings.Contains(err.Error(), "Invalid startup script") {
+		t.Errorf("Got %v, want invalid startup script error", err)
+	}
+
+	gc, err := loadTestGrids(t, `
+android:
+  versions:
+    9.0.0:
+      engine: "compute"
+      compute:
+        startupScript: "{{quote .Unknown}}"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grid, _, _ := gc.Find("android", "9.0.0")
+	_, err = GridBase{Grid: grid}.StartupScript("zone")
+	if ErrorClass(err) != ErrorConfig {
+		t.Errorf("Got %v, want config error", err)
+	}
+}
@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDraining New session requests are refused while draining
+var ErrDraining = errors.New("Sersan is shutting down, new sessions are not accepted")
+
+// ErrPaused New session requests are refused while paused
+var ErrPaused = errors.New("New sessions are paused for maintenance")
+
+// StartTracker Track in-flight grid starts so they can be drained or
+// cancelled together
+type StartTracker struct {
+	lock     sync.Mutex
+	serial   uint64
+	cancels  map[uint64]context.CancelFunc
+	draining bool
+	closed   bool
+	paused   bool
+}
+
+// Track Derive a cancellable context for a grid start. The returned function
+// must be called once the start is finished. Track fails with ErrDraining
+// once the tracker is closed, and with ErrPaused while paused.
+func (t *StartTracker) Track(parent context.Context) (context.Context, func(), error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil, nil, ErrDraining
+	}
+	if t.paused {
+		return nil, nil, ErrPaused
+	}
+	if t.cancels == nil {
+		t.cancels = make(map[uint64]context.CancelFunc)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	id := t.serial
+	t.serial++
+	t.cancels[id] = cancel
+	return ctx, func() {
+		t.lock.Lock()
+		delete(t.cancels, id)
+		t.lock.Unlock()
+		cancel()
+	}, nil
+}
+
+// Drain Mark the tracker as draining. New starts are still accepted until
+// Close is called.
+func (t *StartTracker) Drain() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.draining = true
+}
+
+// Draining Whether the tracker is draining
+func (t *StartTracker) Draining() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.draining
+}
+
+// Close Refuse new starts
+func (t *StartTracker) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.draining = true
+	t.closed = true
+}
+
+// Pause Refuse new starts until resumed. In-flight starts are not affected.
+func (t *StartTracker) Pause() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.paused = true
+}
+
+// Resume Accept new starts again after a pause
+func (t *StartTracker) Resume() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.paused = false
+}
+
+// Paused Whether new starts are paused
+func (t *StartTracker) Paused() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.paused
+}
+
+// Count Number of in-flight starts
+func (t *StartTracker) Count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.cancels)
+}
+
+// Wait Wait until there is no in-flight start or ctx is done
+func (t *StartTracker) Wait(ctx context.Context) error {
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for t.Count() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+	return nil
+}
+
+// CancelAll Cancel every in-flight grid start
+func (t *StartTracker) CancelAll() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, cancel := range t.cancels {
+		cancel()
+	}
+}
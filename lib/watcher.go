@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podWaitingFailures Container waiting reasons which will not resolve by themselves
+var podWaitingFailures = map[string]bool{
+	"ImagePullBackOff":           true,
+	"ErrImageNeverPull":          true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"CrashLoopBackOff":           true,
+}
+
+// PodWatcher Shared pod informer for grid pods. Waiters are woken up on every
+// change of the pod they subscribed to.
+type PodWatcher struct {
+	informer cache.SharedIndexInformer
+	lister   listersv1.PodLister
+	lock     sync.Mutex
+	waiters  map[string]map[chan struct{}]bool
+}
+
+// NewPodWatcher Create pod watcher for the pods matching selector in namespace
+func NewPodWatcher(clientset kubernetes.Interface, namespace string, selector string) *PodWatcher {
+	factory := informers.NewFilteredSharedInformerFactory(clientset, 0, namespace, func(options *metav1.ListOptions) {
+		options.LabelSelector = selector
+	})
+	pods := factory.Core().V1().Pods()
+	pw := &PodWatcher{
+		informer: pods.Informer(),
+		lister:   pods.Lister(),
+		waiters:  make(map[string]map[chan struct{}]bool),
+	}
+	pw.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    pw.notify,
+		UpdateFunc: func(_, obj interface{}) { pw.notify(obj) },
+		DeleteFunc: pw.notify,
+	})
+	return pw
+}
+
+// Run Run the informer until stop is closed
+func (pw *PodWatcher) Run(stop <-chan struct{}) {
+	pw.informer.Run(stop)
+}
+
+// HasSynced Whether the initial pod list has been received
+func (pw *PodWatcher) HasSynced() bool {
+	return pw.informer.HasSynced()
+}
+
+// Get Get pod from the informer cache
+func (pw *PodWatcher) Get(namespace string, name string) (*apiv1.Pod, error) {
+	return pw.lister.Pods(namespace).Get(name)
+}
+
+// List List cached pods
+func (pw *PodWatcher) List(namespace string) ([]*apiv1.Pod, error) {
+	return pw.lister.Pods(namespace).List(labels.Everything())
+}
+
+// Subscribe Receive a notification each time the named pod changes
+func (pw *PodWatcher) Subscribe(name string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	if pw.waiters[name] == nil {
+		pw.waiters[name] = make(map[chan struct{}]bool)
+	}
+	pw.waiters[name][ch] = true
+	return ch, func() {
+		pw.lock.Lock()
+		defer pw.lock.Unlock()
+		delete(pw.waiters[name], ch)
+		if len(pw.waiters[name]) == 0 {
+			delete(pw.waiters, name)
+		}
+	}
+}
+
+func (pw *PodWatcher) notify(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*apiv1.Pod)
+	if !ok {
+		return
+	}
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	for ch := range pw.waiters[pod.Name] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// podFailure Return an error when the pod will never become ready. Pods
+// which stay unschedulable for longer than unschedulableTimeout are also
+// considered failed; recheck tells when to look again otherwise.
+func podFailure(pod *apiv1.Pod, unschedulableTimeout time.Duration) (recheck time.Duration, err error) {
+	switch pod.Status.Phase {
+	case apiv1.PodFailed, apiv1.PodSucceeded:
+		return 0, fmt.Errorf("Pod %s terminated: %s %s", pod.Name, pod.Status.Reason, pod.Status.Message)
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting != nil && podWaitingFailures[status.State.Waiting.Reason] {
+			return 0, fmt.Errorf("Pod %s failed to start: %s %s", pod.Name, status.State.Waiting.Reason, status.State.Waiting.Message)
+		}
+		if status.State.Terminated != nil {
+			return 0, fmt.Errorf("Pod %s container %s terminated: %s %s", pod.Name, status.Name, status.State.Terminated.Reason, status.State.Terminated.Message)
+		}
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type != apiv1.PodScheduled || condition.Status != apiv1.ConditionFalse || condition.Reason != apiv1.PodReasonUnschedulable {
+			continue
+		}
+		stuck := time.Since(condition.LastTransitionTime.Time)
+		if stuck >= unschedulableTimeout {
+			return 0, fmt.Errorf("Pod %s is not schedulable: %s %s", pod.Name, condition.Reason, condition.Message)
+		}
+		return unschedulableTimeout - stuck, nil
+	}
+	return 0, nil
+}
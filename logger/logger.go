@@ -0,0 +1,243 @@
+package logger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level Log level
+type Level int
+
+// Log levels
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+// Correlation fields
+const (
+	RequestID = "request_id"
+	SessionID = "session_id"
+	Grid      = "grid"
+	Instance  = "instance"
+	User      = "user"
+	Engine    = "engine"
+	Remote    = "remote"
+	TraceID   = "trace_id"
+)
+
+var levelNames = map[Level]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+// Fields Structured fields of a log line
+type Fields map[string]interface{}
+
+// Entry Logger carrying fields added to each of its lines
+type Entry struct {
+	fields Fields
+}
+
+type output struct {
+	lock   sync.Mutex
+	writer io.Writer
+	level  Level
+	json   bool
+}
+
+var out = &output{writer: os.Stderr, level: InfoLevel, json: true}
+
+type contextKey struct{}
+
+// Configure Set the minimum level, one of debug, info, warn and error, and
+// the format, json or text
+func Configure(level string, format string) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	out.level = l
+	out.json = strings.ToLower(format) != "text"
+	return nil
+}
+
+// SetOutput Set the writer log lines are written to
+func SetOutput(w io.Writer) {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	out.writer = w
+}
+
+// ParseLevel Parse level name
+func ParseLevel(level string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(level, name) {
+			return l, nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("Unknown log level %s", level)
+}
+
+// Enabled Whether lines at level are written
+func Enabled(level Level) bool {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	return level >= out.level
+}
+
+// With Entry with the field added
+func (e *Entry) With(key string, value interface{}) *Entry {
+	return e.WithFields(Fields{key: value})
+}
+
+// WithFields Entry with the fields added
+func (e *Entry) WithFields(fields Fields) *Entry {
+	merged := make(Fields, len(e.fields)+len(fields))
+	for key, value := range e.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &Entry{fields: merged}
+}
+
+// Debugf Log at debug level
+func (e *Entry) Debugf(format string, args ...interface{}) {
+	e.log(DebugLevel, format, args...)
+}
+
+// Infof Log at info level
+func (e *Entry) Infof(format string, args ...interface{}) {
+	e.log(InfoLevel, format, args...)
+}
+
+// Warnf Log at warn level
+func (e *Entry) Warnf(format string, args ...interface{}) {
+	e.log(WarnLevel, format, args...)
+}
+
+// Errorf Log at error level
+func (e *Entry) Errorf(format string, args ...interface{}) {
+	e.log(ErrorLevel, format, args...)
+}
+
+// Fatalf Log at error level and exit
+func (e *Entry) Fatalf(format string, args ...interface{}) {
+	e.log(ErrorLevel, format, args...)
+	os.Exit(1)
+}
+
+func (e *Entry) log(level Level, format string, args ...interface{}) {
+	if !Enabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	now := time.Now()
+
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	if out.json {
+		line := make(map[string]interface{}, len(e.fields)+3)
+		for key, value := range e.fields {
+			if err, ok := value.(error); ok {
+				value = err.Error()
+			}
+			line[key] = value
+		}
+		line["time"] = now.Format(time.RFC3339Nano)
+		line["level"] = levelNames[level]
+		line["msg"] = msg
+		buf, err := json.Marshal(line)
+		if err != nil {
+			buf, _ = json.Marshal(map[string]interface{}{"time": line["time"], "level": line["level"], "msg": msg})
+		}
+		out.writer.Write(append(buf, '\n'))
+		return
+	}
+
+	keys := make([]string, 0, len(e.fields))
+	for key := range e.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(levelNames[level]), msg)
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%v", key, e.fields[key])
+	}
+	b.WriteByte('\n')
+	io.WriteString(out.writer, b.String())
+}
+
+var std = &Entry{}
+
+// With Entry with the field added to the standard logger
+func With(key string, value interface{}) *Entry {
+	return std.With(key, value)
+}
+
+// WithFields Entry with the fields added to the standard logger
+func WithFields(fields Fields) *Entry {
+	return std.WithFields(fields)
+}
+
+// Debugf Log at debug level
+func Debugf(format string, args ...interface{}) {
+	std.log(DebugLevel, format, args...)
+}
+
+// Infof Log at info level
+func Infof(format string, args ...interface{}) {
+	std.log(InfoLevel, format, args...)
+}
+
+// Warnf Log at warn level
+func Warnf(format string, args ...interface{}) {
+	std.log(WarnLevel, format, args...)
+}
+
+// Errorf Log at error level
+func Errorf(format string, args ...interface{}) {
+	std.log(ErrorLevel, format, args...)
+}
+
+// Fatalf Log at error level and exit
+func Fatalf(format string, args ...interface{}) {
+	std.Fatalf(format, args...)
+}
+
+// NewContext Context carrying the entry, whose fields are added to the lines
+// logged with FromContext
+func NewContext(ctx context.Context, entry *Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, entry)
+}
+
+// FromContext Entry carried by ctx, or the standard logger
+func FromContext(ctx context.Context) *Entry {
+	if ctx != nil {
+		if entry, ok := ctx.Value(contextKey{}).(*Entry); ok {
+			return entry
+		}
+	}
+	return std
+}
+
+// WithContext Context whose entry carries the field as well
+func WithContext(ctx context.Context, key string, value interface{}) context.Context {
+	return NewContext(ctx, FromContext(ctx).With(key, value))
+}
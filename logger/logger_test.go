@@ -0,0 +1,62 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestContextFields(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stderr)
+	if err := Configure("info", "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewContext(context.Background(), With(RequestID, "r1"))
+	ctx = WithContext(ctx, Instance, "sersan-grid-1")
+	FromContext(ctx).With(SessionID, "s1").Infof("Session %s", "created")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Invalid JSON line %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"level":   "info",
+		"msg":     "Session created",
+		RequestID: "r1",
+		Instance:  "sersan-grid-1",
+		SessionID: "s1",
+	}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("Field %s is %v, want %v", key, line[key], value)
+		}
+	}
+}
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stderr)
+	if err := Configure("warn", "text"); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure("info", "json")
+
+	Infof("hidden")
+	Debugf("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("Lines below warn were written: %q", buf.String())
+	}
+	Warnf("shown")
+	if buf.Len() == 0 {
+		t.Error("Warn line was not written")
+	}
+	if err := Configure("verbose", "json"); err == nil {
+		t.Error("Unknown level was accepted")
+	}
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,35 +14,48 @@ import (
 	cache "github.com/patrickmn/go-cache"
 	"github.com/salestock/sersan/config"
 	"github.com/salestock/sersan/lib"
+	"github.com/salestock/sersan/logger"
+	"github.com/salestock/sersan/tracing"
 )
 
+// drainCleanupTimeout Time given to cancelled grid starts and proxied
+// commands to finish once the drain grace period is over
+const drainCleanupTimeout = 30 * time.Second
+
+// peerSyncTimeout Time given to the replicas already running to tell whether
+// they are paused and which grids are drained
+const peerSyncTimeout = 10 * time.Second
+
 func main() {
 	conf := config.Get()
+	if err := logger.Configure(conf.LogLevel, conf.LogFormat); err != nil {
+		logger.Warnf("Invalid log config: %v", err)
+	}
 
 	// Display some important configuration items
-	log.Printf("[INIT] Node selector: %s:%s", conf.NodeSelectorKey, conf.NodeSelectorValue)
-	log.Printf("[INIT] Cpu request - limit: %s-%s", conf.CPURequest, conf.CPULimit)
-	log.Printf("[INIT] Memory request - limit: %s-%s", conf.MemoryRequest, conf.MemoryLimit)
+	logger.Infof("[INIT] Node selector: %s:%s", conf.NodeSelectorKey, conf.NodeSelectorValue)
+	logger.Infof("[INIT] Cpu request - limit: %s-%s", conf.CPURequest, conf.CPULimit)
+	logger.Infof("[INIT] Memory request - limit: %s-%s", conf.MemoryRequest, conf.MemoryLimit)
 
 	// Load grid config
 	gridConfig := lib.GetGridConfig()
 	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
-		log.Printf("Could not get current directory:%s", err)
+		logger.Errorf("Could not get current directory:%s", err)
 	}
-	log.Printf("Current directory: %v", dir)
+	logger.Debugf("Current directory: %v", dir)
 	err = gridConfig.Load(filepath.Join(dir, conf.GridConfigFile))
 	if err != nil {
-		log.Printf("Could not load grid config file: %v", err)
+		logger.Fatalf("Could not load grid config file: %v", err)
 	}
 
 	// Tuned http round tripper
 	defaultRoundTripper := http.DefaultTransport
 	defaultTransportPointer, ok := defaultRoundTripper.(*http.Transport)
 	if !ok {
-		log.Printf("defaultRoundTripper not an *http.Transport")
+		logger.Errorf("defaultRoundTripper not an *http.Transport")
 	}
-	tunedTransport := *defaultTransportPointer
+	tunedTransport := defaultTransportPointer.Clone()
 	tunedTransport.MaxIdleConns = conf.MaxIdleConns
 	tunedTransport.MaxIdleConnsPerHost = conf.MaxIdleConnsPerHost
 	tunedTransport.MaxConnsPerHost = conf.MaxConnsPerHost
@@ -50,11 +63,46 @@ func main() {
 	// Setup dependency injection
 	var rh RootHandler
 	c := cache.New(time.Duration(conf.CacheTimeout)*time.Minute, time.Duration(conf.CacheTimeout)*time.Duration(2)*time.Minute)
-	err = inject.Populate(&rh, c, &tunedTransport)
+	tracker := &lib.StartTracker{}
+	sessions := &lib.SessionRegistry{}
+	err = inject.Populate(&rh, &conf, gridConfig, c, tunedTransport, tracker, sessions, lib.GetEventBus(), lib.GetHistoryStore(), lib.GetPeers(), lib.GetAppCache())
 	if err != nil {
-		log.Printf("%v", err)
+		logger.Errorf("Dependency injection failed: %v", err)
 	}
 
+	// Follow the pause and drained grids of the replicas already running
+	syncCtx, syncCancel := context.WithTimeout(context.Background(), peerSyncTimeout)
+	rh.SyncPeers(syncCtx)
+	syncCancel()
+
+	// Keep the warm pools filled, the remote upstreams checked, the app cache
+	// trimmed and idle sessions ended in the background
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	go lib.GetWarmPools().Run(backgroundCtx)
+	go lib.GetRemoteUpstreams().Run(backgroundCtx)
+	go lib.GetAppCache().Run(backgroundCtx)
+	go rh.ReapIdle(backgroundCtx)
+
+	// Spans and webhooks are delivered, and sessions recorded, until the
+	// drain is over. Every event is recorded, whereas webhooks and streams
+	// may drop them.
+	lib.GetEventBus().Observe(lib.GetHistoryStore().Enqueue)
+	deliveryCtx, stopDelivery := context.WithCancel(context.Background())
+	var delivery sync.WaitGroup
+	delivery.Add(3)
+	go func() {
+		defer delivery.Done()
+		tracing.GetTracer().Run(deliveryCtx)
+	}()
+	go func() {
+		defer delivery.Done()
+		lib.GetEventBus().Run(deliveryCtx)
+	}()
+	go func() {
+		defer delivery.Done()
+		lib.GetHistoryStore().Run(deliveryCtx)
+	}()
+
 	// Setup router
 	r := CreateRouter(rh)
 
@@ -67,17 +115,48 @@ func main() {
 
 		<-sigint
 
-		if err = srv.Shutdown(context.Background()); err != nil {
-			log.Printf("Sersan API shutdown: %v", err)
-		}
+		stopBackground()
+		drain(&srv, tracker, conf)
+		stopDelivery()
+		delivery.Wait()
 		close(idleConnsClosed)
 	}()
 	srv.Addr = ":" + conf.Port
 	srv.Handler = r
-	log.Printf("Sersan API started in port: %v", conf.Port)
-	if err = srv.ListenAndServe(); err != nil {
-		log.Printf("Error starting Sersan API: %v", err)
+	logger.Infof("Sersan API started in port: %v", conf.Port)
+	if err = srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Errorf("Error starting Sersan API: %v", err)
 	}
 
 	<-idleConnsClosed
 }
+
+// drain Fail readiness, then refuse new sessions and give in-flight session
+// creations a grace period. Grid starts still running after the grace period
+// are cancelled, which deletes their pods or instances.
+func drain(srv *http.Server, tracker *lib.StartTracker, conf config.Config) {
+	logger.Infof("[DRAIN] Failing readiness for %d ms", conf.DrainDelay)
+	tracker.Drain()
+	time.Sleep(time.Duration(conf.DrainDelay) * time.Millisecond)
+
+	tracker.Close()
+	logger.Infof("[DRAIN] Refusing new sessions, waiting for %d in-flight session(s)", tracker.Count())
+	graceCtx, graceCancel := context.WithTimeout(context.Background(), time.Duration(conf.DrainTimeout)*time.Millisecond)
+	defer graceCancel()
+	if err := tracker.Wait(graceCtx); err != nil {
+		logger.Warnf("[DRAIN] Cancelling %d session creation(s) still in progress", tracker.Count())
+		tracker.CancelAll()
+		cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), drainCleanupTimeout)
+		defer cleanupCancel()
+		if err := tracker.Wait(cleanupCtx); err != nil {
+			logger.Errorf("[DRAIN] %d grid(s) were not cleaned up: %v", tracker.Count(), err)
+		}
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), drainCleanupTimeout)
+	defer shutdownCancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("Sersan API shutdown: %v", err)
+	}
+	logger.Infof("[DRAIN] Done")
+}
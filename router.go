@@ -1,6 +1,7 @@
 package main
 
 import (
+    "expvar"
     "net"
     "net/http"
     "strings"
@@ -33,5 +34,23 @@ func CreateRouter(rh RootHandler) http.Handler {
         mux(rh).ServeHTTP(w, r)
     })
     router.HandleFunc("/health", rh.HealthCheck)
+    router.HandleFunc("/apps", rh.Apps)
+    router.HandleFunc("/apps/", rh.App)
+    router.HandleFunc("/admin/events", rh.Events)
+    router.HandleFunc("/admin/history", rh.History)
+    router.HandleFunc("/admin/history/", rh.HistoryRecord)
+    router.HandleFunc("/admin/status", rh.AdminStatus)
+    router.HandleFunc("/admin/pause", rh.AdminPause)
+    router.HandleFunc("/admin/resume", rh.AdminResume)
+    router.HandleFunc("/admin/sessions", rh.AdminSessions)
+    router.HandleFunc("/admin/sessions/", rh.AdminSession)
+    router.HandleFunc("/admin/grids", rh.AdminGrids)
+    router.HandleFunc("/admin/grids/", rh.AdminGrid)
+    router.HandleFunc("/admin/dashboard", rh.DashboardOverview)
+    router.HandleFunc("/admin/vnc/", rh.SessionVNC)
+    router.HandleFunc("/admin/logs/", rh.SessionLogs)
+    router.HandleFunc("/admin/video/", rh.SessionVideo)
+    router.HandleFunc("/dashboard", rh.Dashboard)
+    router.Handle("/debug/vars", expvar.Handler())
     return router
 }
@@ -6,11 +6,26 @@ export ANDROID_HOME=$HOME/android-sdk
 export ANDROID_SDK_ROOT=$ANDROID_HOME/
 export PATH=${PATH}:$ANDROID_HOME/tools:$ANDROID_HOME/platform-tools:$ANDROID_HOME/emulators
 
+METADATA=http://metadata.google.internal/computeMetadata/v1/instance
+
+# Lifetime of the instance in seconds, set by Sersan from the session gridTimeout
+GRID_TIMEOUT=$(curl -sf -H Metadata-Flavor:Google $METADATA/attributes/sersan-grid-timeout || echo 1200)
+
+# Device profile selected by Sersan from the session deviceName
+AVD=$(curl -sf -H Metadata-Flavor:Google $METADATA/attributes/sersan-avd || echo emulator)
+SCREEN=$(curl -sf -H Metadata-Flavor:Google $METADATA/attributes/sersan-screen)
+DENSITY=$(curl -sf -H Metadata-Flavor:Google $METADATA/attributes/sersan-density)
+RAM=$(curl -sf -H Metadata-Flavor:Google $METADATA/attributes/sersan-ram)
+EMULATOR_OPTS=""
+[ -n "$SCREEN" ] && EMULATOR_OPTS="$EMULATOR_OPTS -skin $SCREEN"
+[ -n "$RAM" ] && EMULATOR_OPTS="$EMULATOR_OPTS -memory $RAM"
+
 source /root/.bashrc
 /usr/bin/vncserver
 export DISPLAY=:1
 cd /root/android-sdk/emulator
-./emulator -avd emulator -gpu swiftshader_indirect -no-snapshot-save & xterm -e "/usr/bin/appium -p 4444 --relaxed-security" & \
-    sleep 20m; VMNAME=$(curl -H Metadata-Flavor:Google http://metadata/computeMetadata/v1/instance/hostname | cut -d. -f1); \
-    ZONE=$(curl -H Metadata-Flavor:Google http://metadata/computeMetadata/v1/instance/zone | cut -d/ -f4); \
+./emulator -avd "$AVD" $EMULATOR_OPTS -gpu swiftshader_indirect -no-snapshot-save & \
+    ([ -n "$DENSITY" ] && adb wait-for-device shell wm density $DENSITY) & xterm -e "/usr/bin/appium -p 4444 --relaxed-security" & \
+    sleep ${GRID_TIMEOUT}; VMNAME=$(curl -H Metadata-Flavor:Google $METADATA/hostname | cut -d. -f1); \
+    ZONE=$(curl -H Metadata-Flavor:Google $METADATA/zone | cut -d/ -f4); \
     gcloud compute instances delete $VMNAME --zone $ZONE --quiet
@@ -0,0 +1,226 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader W3C trace context header
+const TraceparentHeader = "traceparent"
+
+// Span kinds
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// SpanContext Trace and span ID propagated between services
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// Valid Whether the trace and span IDs are set
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceIDString Trace ID in hex
+func (sc SpanContext) TraceIDString() string {
+	return hex.EncodeToString(sc.TraceID[:])
+}
+
+// Traceparent traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceIDString(), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent Parse a version 00 traceparent header value
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("Invalid traceparent %q", value)
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return sc, fmt.Errorf("Invalid trace ID %q", parts[1])
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return sc, fmt.Errorf("Invalid span ID %q", parts[2])
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, fmt.Errorf("Invalid trace flags %q", parts[3])
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.Valid() {
+		return sc, fmt.Errorf("Invalid traceparent %q", value)
+	}
+	return sc, nil
+}
+
+// Span Timed operation of a trace. Spans which are not sampled or started
+// while tracing is disabled are not exported.
+type Span struct {
+	Name    string
+	Kind    int
+	Context SpanContext
+	Parent  SpanContext
+	Start   time.Time
+
+	lock       sync.Mutex
+	attributes map[string]interface{}
+	end        time.Time
+	err        error
+	recorded   bool
+	tracer     *Tracer
+	timings    *Timings
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+type timingsKey struct{}
+
+// Timings Total duration of the spans ended below a context, by span name,
+// recorded whether or not spans are exported
+type Timings struct {
+	lock    sync.Mutex
+	seconds map[string]float64
+}
+
+// WithTimings Context recording the durations of the spans started below it
+func WithTimings(ctx context.Context) (context.Context, *Timings) {
+	timings := &Timings{seconds: make(map[string]float64)}
+	return context.WithValue(ctx, timingsKey{}, timings), timings
+}
+
+// Seconds Copy of the recorded durations in seconds
+func (t *Timings) Seconds() map[string]float64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	seconds := make(map[string]float64, len(t.seconds))
+	for name, d := range t.seconds {
+		seconds[name] = d
+	}
+	return seconds
+}
+
+func (t *Timings) add(name string, d time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.seconds[name] += d.Seconds()
+}
+
+// Start Start an internal span, child of the span of ctx
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartKind(ctx, name, KindInternal)
+}
+
+// StartKind Start a span of the kind, child of the span of ctx or of the
+// remote span extracted into ctx
+func StartKind(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	tracer := GetTracer()
+	parent := SpanContextFrom(ctx)
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Parent:     parent,
+		Start:      time.Now(),
+		attributes: make(map[string]interface{}),
+		tracer:     tracer,
+	}
+	span.timings, _ = ctx.Value(timingsKey{}).(*Timings)
+	if !tracer.Enabled() {
+		// The parent is propagated as is when spans are not exported
+		span.Context = parent
+		return context.WithValue(ctx, spanKey{}, span), span
+	}
+	if parent.Valid() {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+	} else {
+		randomID(span.Context.TraceID[:])
+		span.Context.Sampled = tracer.sample()
+	}
+	randomID(span.Context.SpanID[:])
+	span.recorded = span.Context.Sampled
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// FromContext Span of ctx, or nil
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanContextFrom Span context of the span of ctx or of the remote span
+// extracted into ctx
+func SpanContextFrom(ctx context.Context) SpanContext {
+	if span := FromContext(ctx); span != nil {
+		return span.Context
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// Extract Context carrying the remote span of the traceparent header of r
+func Extract(r *http.Request) context.Context {
+	ctx := r.Context()
+	sc, err := ParseTraceparent(r.Header.Get(TraceparentHeader))
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Inject Set the traceparent header to the span of ctx
+func Inject(ctx context.Context, header http.Header) {
+	if sc := SpanContextFrom(ctx); sc.Valid() {
+		header.Set(TraceparentHeader, sc.Traceparent())
+	}
+}
+
+// SetAttribute Set a span attribute, a string, bool or number
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes[key] = value
+}
+
+// End End the span, failed when err is not nil
+func (s *Span) End(err error) {
+	s.lock.Lock()
+	if !s.end.IsZero() {
+		s.lock.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	s.lock.Unlock()
+	if s.timings != nil {
+		s.timings.add(s.Name, s.end.Sub(s.Start))
+	}
+	if s.recorded {
+		s.tracer.export(s)
+	}
+}
+
+func randomID(id []byte) {
+	rand.Read(id)
+}
@@ -0,0 +1,239 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/logger"
+)
+
+const (
+	traceQueueSize      = 2048
+	traceBatchSize      = 512
+	traceExportInterval = 5 * time.Second
+	traceExportTimeout  = 10 * time.Second
+)
+
+// droppedSpans Spans dropped because the export queue was full, served
+// with the other expvars on /debug/vars
+var droppedSpans = expvar.NewInt("trace_spans_dropped")
+
+// Tracer Exporter of finished spans to an OTLP/HTTP collector. Spans are
+// queued and sent in batches, so a slow collector never delays sessions.
+type Tracer struct {
+	Endpoint    string
+	ServiceName string
+	SampleRatio float64
+	Client      *http.Client
+	queue       chan *Span
+}
+
+var tracer *Tracer
+var tracerOnce sync.Once
+
+// GetTracer Get tracer
+func GetTracer() *Tracer {
+	tracerOnce.Do(func() {
+		conf := config.Get()
+		tracer = &Tracer{
+			Endpoint:    strings.TrimSuffix(conf.OTLPEndpoint, "/"),
+			ServiceName: conf.TraceServiceName,
+			SampleRatio: conf.TraceSampleRatio,
+			Client:      &http.Client{Timeout: traceExportTimeout},
+			queue:       make(chan *Span, traceQueueSize),
+		}
+	})
+	return tracer
+}
+
+// Enabled Whether spans are exported
+func (t *Tracer) Enabled() bool {
+	return t.Endpoint != ""
+}
+
+func (t *Tracer) sample() bool {
+	return t.SampleRatio >= 1 || rand.Float64() < t.SampleRatio
+}
+
+func (t *Tracer) export(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		droppedSpans.Add(1)
+	}
+}
+
+// Run Export queued spans until ctx is done, then export the remaining ones
+func (t *Tracer) Run(ctx context.Context) {
+	if !t.Enabled() {
+		return
+	}
+	tick := time.NewTicker(traceExportInterval)
+	defer tick.Stop()
+	var batch []*Span
+	for {
+		select {
+		case <-ctx.Done():
+			t.post(t.drain(batch))
+			return
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-tick.C:
+		}
+		t.post(batch)
+		batch = nil
+	}
+}
+
+func (t *Tracer) drain(batch []*Span) []*Span {
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+		default:
+			return batch
+		}
+	}
+}
+
+func (t *Tracer) post(batch []*Span) {
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > traceBatchSize {
+			n = traceBatchSize
+		}
+		if err := t.send(batch[:n]); err != nil {
+			logger.Warnf("Failed to export %d span(s): %v", n, err)
+		}
+		batch = batch[n:]
+	}
+}
+
+func (t *Tracer) send(spans []*Span) error {
+	buf, err := json.Marshal(t.request(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := t.Client.Post(t.Endpoint+"/v1/traces", "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// OTLP JSON encoding of the export request
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+)
+
+func (t *Tracer) request(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		encoded = append(encoded, span.otlp())
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			attribute("service.name", t.ServiceName),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "sersan"},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	encoded := otlpSpan{
+		TraceID:           s.Context.TraceIDString(),
+		SpanID:            hex.EncodeToString(s.Context.SpanID[:]),
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: 1},
+	}
+	if s.Parent.Valid() {
+		encoded.ParentSpanID = hex.EncodeToString(s.Parent.SpanID[:])
+	}
+	for key, value := range s.attributes {
+		encoded.Attributes = append(encoded.Attributes, attribute(key, value))
+	}
+	if s.err != nil {
+		encoded.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	return encoded
+}
+
+func attribute(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int32:
+		v = map[string]interface{}{"intValue": strconv.Itoa(int(value))}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
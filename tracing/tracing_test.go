@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.Sampled || sc.Traceparent() != value {
+		t.Errorf("Parsed %s, want %s", sc.Traceparent(), value)
+	}
+	for _, invalid := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceparent(invalid); err == nil {
+			t.Errorf("Invalid traceparent %q was accepted", invalid)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("Spans posted to %s", r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		requests <- req
+	}))
+	defer collector.Close()
+	tracer := GetTracer()
+	tracer.Endpoint = collector.URL
+	defer func() { tracer.Endpoint = "" }()
+
+	client := httptest.NewRequest(http.MethodPost, "/session", nil)
+	client.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := StartKind(Extract(client), "NewSession", KindServer)
+	_, child := Start(ctx, "CreateGrid")
+	child.SetAttribute("sersan.instance", "sersan-grid-1")
+	child.End(nil)
+	root.End(nil)
+
+	header := http.Header{}
+	Inject(ctx, header)
+	if header.Get(TraceparentHeader) != root.Context.Traceparent() {
+		t.Errorf("Injected %q, want the root span", header.Get(TraceparentHeader))
+	}
+
+	runCtx, stop := context.WithCancel(context.Background())
+	stop()
+	tracer.Run(runCtx)
+	spans := (<-requests).ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Exported %d spans, want 2", len(spans))
+	}
+	if spans[0].Name != "CreateGrid" || spans[0].ParentSpanID != spans[1].SpanID {
+		t.Errorf("CreateGrid is not a child of NewSession: %+v", spans)
+	}
+	if spans[1].TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spans[1].ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("NewSession does not continue the client trace: %+v", spans[1])
+	}
+}
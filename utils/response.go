@@ -2,10 +2,11 @@ package utils
 
 import (
     "encoding/json"
-    "log"
     "fmt"
     "net/http"
 
+    "github.com/salestock/sersan/logger"
+
 )
 
 // ResponseOk Response OK
@@ -31,9 +32,9 @@ func ResponseOk(w http.ResponseWriter, status int, data interface{}) {
 // ResponseFailed Response Failed
 func ResponseFailed(w http.ResponseWriter, status int, err error) {
     if status/1e2 == 4 {
-        log.Printf("%v", err)
+        logger.Warnf("%v", err)
     } else {
-        log.Printf("%v", err)
+        logger.Errorf("%v", err)
     }
 
     errMsg := err.Error()
@@ -48,6 +49,6 @@ func ResponseFailed(w http.ResponseWriter, status int, err error) {
     }
     js, _ := json.Marshal(resp)
     w.Header().Set("Content-Type", "application/json")
-    w.WriteHeader(500)
+    w.WriteHeader(status)
     w.Write(js)
 }
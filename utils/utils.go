@@ -1,18 +1,21 @@
 package utils
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
-	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/salestock/sersan/config"
+	"github.com/salestock/sersan/logger"
+	"github.com/salestock/sersan/tracing"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -37,17 +40,31 @@ func Serial() uint64 {
 
 type CachedInfo struct {
 	Session *SessionInfo
-	Proxy   *httputil.ReverseProxy
 }
 
 type SessionInfo struct {
 	SessionID   string
 	ServiceName string
+	Scheme      string
 	Host        string
 	Port        string
 	BaseURL     string
 	VNCPort     string
 	Engine      string
+	// Grid Grid name and version, Owner the user who created the session,
+	// RequestID the ID of its new session request and Created its creation
+	// time in Unix seconds. ServiceUID is the unique ID of the grid
+	// instance, empty when its engine has none, and Lifetime the lifetime of
+	// the grid in seconds. IdleTimeout is the newCommandTimeout of the
+	// session in seconds, zero when not set. It is only known by the replica
+	// which created the session.
+	Grid        string
+	Owner       string
+	RequestID   string
+	Created     int64
+	ServiceUID  string
+	Lifetime    int
+	IdleTimeout int
 }
 
 // JsonError JSON error
@@ -63,6 +80,34 @@ func JsonError(w http.ResponseWriter, msg string, code int) {
 		})
 }
 
+// webDriverStatus Legacy JSON wire protocol status of the W3C error codes
+var webDriverStatus = map[string]int{
+	"invalid session id":  6,
+	"timeout":             21,
+	"session not created": 33,
+	"unknown error":       13,
+}
+
+// WebDriverError W3C WebDriver error, with the matching legacy status for
+// JSON wire protocol clients
+func WebDriverError(w http.ResponseWriter, code string, msg string, status int) {
+	legacyStatus, ok := webDriverStatus[code]
+	if !ok {
+		legacyStatus = 13
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(
+		map[string]interface{}{
+			"value": map[string]string{
+				"error":      code,
+				"message":    msg,
+				"stacktrace": "",
+			},
+			"status": legacyStatus,
+		})
+}
+
 // SecondsSince Calculate seconds since specified time until now
 func SecondsSince(start time.Time) float64 {
 	return float64(time.Now().Sub(start).Seconds())
@@ -84,75 +129,133 @@ func RequestInfo(r *http.Request) (string, string) {
 	return user, remote
 }
 
+// ErrUnauthorized Admin token is missing or wrong
+var ErrUnauthorized = errors.New("Unauthorized")
+
+// AdminAuthorized Whether r carries the admin token as bearer token. Admin
+// endpoints are disabled when no admin token is configured.
+func AdminAuthorized(r *http.Request, adminToken string) bool {
+	auth := r.Header.Get("Authorization")
+	if adminToken == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(adminToken)) == 1
+}
+
+// BrowserAuthorized Whether r carries the admin token, either as bearer token
+// or as token query parameter. Only for the read only endpoints opened by
+// browsers without headers, i.e. event streams, websockets and videos, as the
+// query parameter ends up in access logs.
+func BrowserAuthorized(r *http.Request, adminToken string) bool {
+	if AdminAuthorized(r, adminToken) {
+		return true
+	}
+	token := r.URL.Query().Get("token")
+	return adminToken != "" && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
 //GenerateSessionID Generate Session ID in JWT token format
-func GenerateSessionID(sessionInfo *SessionInfo) (sessionID string, err error) {
-	conf := config.Get()
+func GenerateSessionID(sessionInfo *SessionInfo, signingKey string) (sessionID string, err error) {
 	data := jwt.MapClaims{
 		"sessionID":   sessionInfo.SessionID,
 		"serviceName": sessionInfo.ServiceName,
+		"serviceUID":  sessionInfo.ServiceUID,
+		"lifetime":    sessionInfo.Lifetime,
+		"scheme":      sessionInfo.Scheme,
 		"host":        sessionInfo.Host,
 		"port":        sessionInfo.Port,
 		"baseURL":     sessionInfo.BaseURL,
 		"vncPort":     sessionInfo.VNCPort,
 		"engine":      sessionInfo.Engine,
+		"grid":        sessionInfo.Grid,
+		"owner":       sessionInfo.Owner,
+		"requestID":   sessionInfo.RequestID,
+		"created":     sessionInfo.Created,
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, data)
-	sessionID, err = token.SignedString([]byte(conf.SigningKey))
+	sessionID, err = token.SignedString([]byte(signingKey))
 	if err != nil {
-		log.Printf("Failed to create formatted session id %v", err)
+		logger.Errorf("Failed to create formatted session id %v", err)
 		return
 	}
-	log.Printf("Generated Session ID %s", sessionID)
+	logger.Debugf("Generated Session ID %s", sessionID)
 	return
 }
 
 // ParseSessionID Extract session id information
-func ParseSessionID(sessionID string) (sessionInfo *SessionInfo, err error) {
-	conf := config.Get()
+func ParseSessionID(sessionID string, signingKey string) (sessionInfo *SessionInfo, err error) {
 	token, err := jwt.Parse(sessionID, func(token *jwt.Token) (interface{}, error) {
-		return []byte(conf.SigningKey), nil
+		return []byte(signingKey), nil
 	})
 	if err != nil {
-		log.Printf("Failed to parse session id %v", err)
+		logger.Warnf("Failed to parse session id %v", err)
 		return
 	}
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+		// Session IDs issued before the scheme claim existed are plain HTTP
+		scheme, ok := claims["scheme"].(string)
+		if !ok || scheme == "" {
+			scheme = "http"
+		}
+		// Claims added later are missing from older session IDs
+		grid, _ := claims["grid"].(string)
+		owner, _ := claims["owner"].(string)
+		requestID, _ := claims["requestID"].(string)
+		serviceUID, _ := claims["serviceUID"].(string)
+		lifetime, _ := claims["lifetime"].(float64)
+		created, _ := claims["created"].(float64)
 		return &SessionInfo{
 			SessionID:   claims["sessionID"].(string),
 			ServiceName: claims["serviceName"].(string),
+			ServiceUID:  serviceUID,
+			Lifetime:    int(lifetime),
+			Scheme:      scheme,
 			Host:        claims["host"].(string),
 			Port:        claims["port"].(string),
 			BaseURL:     claims["baseURL"].(string),
 			VNCPort:     claims["vncPort"].(string),
 			Engine:      claims["engine"].(string),
+			Grid:        grid,
+			Owner:       owner,
+			RequestID:   requestID,
+			Created:     int64(created),
 		}, nil
 	}
 
 	return
 }
 
-func WaitUntilGridReady(url *url.URL, healthCheck string) (err error) {
+// WaitUntilGridReady Poll the grid health check until it responds with 200 or ctx is done
+func WaitUntilGridReady(ctx context.Context, url *url.URL, healthCheck string) (err error) {
 	conf := config.Get()
-	log.Printf("Health Check: %s%s", url, healthCheck)
+	ctx, span := tracing.Start(ctx, "WaitUntilGridReady")
+	span.SetAttribute("http.url", url.Scheme+"://"+url.Host+healthCheck)
+	defer func() { span.End(err) }()
+	log := logger.FromContext(ctx)
+	log.Debugf("Health Check: %s%s", url, healthCheck)
 	waitTimeout := time.NewTimer(time.Duration(conf.GridStartupTimeout) * time.Millisecond)
 	defer waitTimeout.Stop()
-	tick := time.Tick(200 * time.Millisecond)
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
 		case <-waitTimeout.C:
 			err = errors.New("Grid is not ready")
 			return
-		case <-tick:
-			resp, _ := http.Get(url.String() + healthCheck)
+		case <-tick.C:
+			req, _ := http.NewRequest(http.MethodGet, url.String()+healthCheck, nil)
+			resp, _ := http.DefaultClient.Do(req.WithContext(ctx))
 
 			if resp != nil {
-				defer resp.Body.Close()
+				resp.Body.Close()
 				if resp.StatusCode == 200 {
-					log.Printf("Grid is ready")
+					log.Infof("Grid is ready")
 					return nil
 				}
 			}
 		}
 	}
-	return
 }